@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 
 	"github.com/timskillet/distributed-filestore/internal/api"
 	"github.com/timskillet/distributed-filestore/internal/config"
+	"github.com/timskillet/distributed-filestore/internal/metadata"
 )
 
 func main() {
@@ -16,25 +18,49 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	// Initialize API server with DynamoDB
+	// Initialize API server with the configured metadata backend
 	srv, err := api.NewServer(cfg)
 	if err != nil {
 		log.Fatalf("Failed to initialize API server: %v", err)
 	}
 	api.SetServer(srv)
 
+	// Keep the cached node directory in sync with the registry
+	go srv.StartNodeDirectory(context.Background())
+
+	// Start re-replication daemon for chunks held by dead nodes
+	go srv.StartRepairDaemon(context.Background())
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/init-upload", api.HandleInitUpload)
 	mux.HandleFunc("/finalize-upload", api.HandleFinalizeUpload)
 	mux.HandleFunc("/download-plan", api.HandleDownloadPlan)
 	mux.HandleFunc("/proxy-chunk-upload", api.HandleProxyChunkUpload)
 	mux.HandleFunc("/proxy-chunk-download", api.HandleProxyChunkDownload)
+	mux.HandleFunc("/repair-status", api.HandleRepairStatus)
+	mux.HandleFunc("/rebalance", api.HandleRebalance)
+	mux.HandleFunc("/rebalance-status", api.HandleRebalanceStatus)
+	mux.HandleFunc("/drain", api.HandleDrain)
+	mux.HandleFunc("/drain-status", api.HandleDrainStatus)
+
+	// Share a process-local metadata backend with storage nodes (METADATA_BACKEND=remote)
+	if metadata.ServesRemote(cfg) {
+		if cfg.MetadataToken != "" {
+			mux.Handle("/metadata/", metadata.NewHandler(srv.GetStore(), cfg.MetadataToken))
+		} else {
+			fmt.Printf("Warning: METADATA_TOKEN is not set, storage nodes cannot use this server's metadata\n")
+		}
+	}
 
 	fmt.Printf("Starting DFS API server on port 8080\n")
+	fmt.Printf("Metadata Backend: %s\n", cfg.MetadataBackend)
 	fmt.Printf("AWS Region: %s\n", cfg.AWSRegion)
 	fmt.Printf("Chunk Metadata Table: %s\n", cfg.ChunkMetadataTable)
 	fmt.Printf("Node Registry Table: %s\n", cfg.NodeRegistryTable)
 	fmt.Printf("Replication Factor: %d\n", cfg.ReplicationFactor)
+	fmt.Printf("Write Quorum: %d, Read Quorum: %d\n", cfg.WriteQuorum, cfg.ReadQuorum)
+	fmt.Printf("Repair Interval: %d seconds\n", cfg.RepairInterval)
+	fmt.Printf("Node Directory Refresh: %d seconds\n", cfg.NodeDirectoryRefresh)
 
 	if err := http.ListenAndServe(":8080", mux); err != nil {
 		log.Fatalf("Server failed: %v", err)
@@ -13,6 +13,7 @@ func main() {
 		fmt.Println("Usage:")
 		fmt.Println("Upload: dfs-client upload <API_SERVER_URL> <FILE_PATH>")
 		fmt.Println("Download: dfs-client download <API_SERVER_URL> <FILE_ID> <OUTPUT_PATH>")
+		fmt.Println("Drain: dfs-client drain <API_SERVER_URL> <NODE_ID>")
 		os.Exit(1)
 	}
 
@@ -22,6 +23,8 @@ func main() {
 	case "upload":
 		uploadFlags := flag.NewFlagSet("upload", flag.ExitOnError)
 		chunkSize := uploadFlags.Int("chunk-size", 1024, "Chunk size in bytes (default: 1KB)")
+		dataShards := uploadFlags.Int("data-shards", 0, "Erasure-code chunks into this many data shards instead of replicating them")
+		parityShards := uploadFlags.Int("parity-shards", 2, "Parity shards per chunk when -data-shards is set")
 		uploadFlags.Parse(os.Args[2:])
 
 		if uploadFlags.NArg() < 2 {
@@ -35,20 +38,20 @@ func main() {
 		fmt.Println("Initializing upload for:", filePath)
 
 		// 1. Initialize upload plan
-		uploadPlan, err := client.InitUpload(apiURL, filePath, *chunkSize)
+		uploadPlan, err := client.InitUpload(apiURL, filePath, *chunkSize, *dataShards, *parityShards)
 		if err != nil {
 			panic(err)
 		}
 
 		// 2. Upload chunks concurrently
 		fmt.Printf("Uploading file %s in %dKB chunks...\n", filePath, uploadPlan.ChunkSize)
-		err = client.UploadChunks(filePath, uploadPlan)
+		checksums, shardChecksums, err := client.UploadChunks(filePath, uploadPlan)
 		if err != nil {
 			panic(err)
 		}
 
 		// 3. Finalize upload
-		err = client.FinalizeUpload(apiURL, uploadPlan.FileID)
+		err = client.FinalizeUpload(apiURL, uploadPlan.FileID, checksums, shardChecksums)
 		if err != nil {
 			panic(err)
 		}
@@ -68,6 +71,18 @@ func main() {
 			panic(err)
 		}
 
+	case "drain":
+		if len(os.Args) != 4 {
+			fmt.Println("Usage: dfs-client drain <API_SERVER_URL> <NODE_ID>")
+			os.Exit(1)
+		}
+		apiURL := os.Args[2]
+		nodeID := os.Args[3]
+
+		if err := client.DrainNode(apiURL, nodeID); err != nil {
+			panic(err)
+		}
+
 	default:
 		fmt.Println("Invalid command:", command)
 	}
@@ -21,7 +21,7 @@ func main() {
 
 	// Get node ID and private IP from EC2 metadata or environment
 	nodeID := os.Getenv("NODE_ID")
-	instanceID, privateIP, err := node.GetEC2InstanceMetadata()
+	instanceID, privateIP, failureDomain, err := node.GetEC2InstanceMetadata()
 	if err != nil {
 		log.Printf("Warning: Failed to get EC2 metadata: %v. Using environment variables.", err)
 		if nodeID == "" {
@@ -30,6 +30,7 @@ func main() {
 		if privateIP == "" {
 			privateIP = "127.0.0.1"
 		}
+		failureDomain = os.Getenv("NODE_FAILURE_DOMAIN")
 	} else {
 		if nodeID == "" {
 			nodeID = instanceID // Use instance ID as node ID
@@ -40,11 +41,12 @@ func main() {
 
 	// Create node info
 	nodeInfo := &dynamodb.NodeInfo{
-		NodeID:     nodeID,
-		PrivateIP:  privateIP,
-		Port:       port,
-		Status:     "active",
-		InstanceID: instanceID,
+		NodeID:        nodeID,
+		PrivateIP:     privateIP,
+		Port:          port,
+		Status:        dynamodb.NodeStatusActive,
+		InstanceID:    instanceID,
+		FailureDomain: failureDomain,
 	}
 
 	// Initialize node server
@@ -54,25 +56,48 @@ func main() {
 	}
 	node.SetServer(srv)
 
-	// Register node in DynamoDB
+	// Register node in the metadata store
 	ctx := context.Background()
 	if err := srv.Register(ctx); err != nil {
 		log.Fatalf("Failed to register node: %v", err)
 	}
 	fmt.Printf("Node %s registered successfully\n", nodeID)
 
+	// Chunk bodies are shared between replicas; correct their reference counts before serving
+	if err := srv.ReconcileRefs(ctx); err != nil {
+		log.Printf("Warning: Failed to reconcile chunk references: %v", err)
+	}
+
 	// Start heartbeat goroutine
 	go srv.StartHeartbeat(ctx)
 	fmt.Printf("Heartbeat started (interval: %d seconds)\n", cfg.NodeHeartbeatInterval)
 
+	// Start async replication worker (also drains tasks queued before a restart)
+	go srv.StartReplicationWorker(ctx)
+	fmt.Printf("Replication strategy: %s (pending tasks: %d)\n", cfg.ReplicationStrategy, srv.GetReplicationQueue().Depth())
+
+	// Start the checksum scrubber
+	if cfg.ScrubInterval > 0 {
+		go srv.StartScrubber(ctx)
+		fmt.Printf("Scrubber started (interval: %d seconds, rate: %d KB/s)\n", cfg.ScrubInterval, cfg.ScrubRateKB)
+	}
+
 	// Start HTTP server
 	mux := http.NewServeMux()
 	mux.HandleFunc("/store-chunk", node.HandleStoreChunk())
 	mux.HandleFunc("/get-chunk", node.HandleGetChunk())
+	mux.HandleFunc("/link-chunk", node.HandleLinkChunk())
+	mux.HandleFunc("/delete-chunk", node.HandleDeleteChunk())
+	mux.HandleFunc("/replication-status", node.HandleReplicationStatus())
+	mux.HandleFunc("/replication-failures", node.HandleReplicationFailures())
+	mux.HandleFunc("/scrub-status", node.HandleScrubStatus())
+	mux.HandleFunc("/scrub-losses", node.HandleScrubLosses())
 
 	fmt.Printf("Starting DFS storage node on port %d\n", port)
 	fmt.Printf("Node ID: %s\n", nodeID)
 	fmt.Printf("Private IP: %s\n", privateIP)
+	fmt.Printf("Failure Domain: %s\n", failureDomain)
+	fmt.Printf("Metadata Backend: %s\n", cfg.MetadataBackend)
 	fmt.Printf("AWS Region: %s\n", cfg.AWSRegion)
 
 	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), mux); err != nil {
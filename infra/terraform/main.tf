@@ -210,6 +210,24 @@ resource "aws_dynamodb_table" "dfs_node_registry" {
     type = "S"
   }
 
+  attribute {
+    name = "status"
+    type = "S"
+  }
+
+  attribute {
+    name = "heartbeat_ts"
+    type = "N"
+  }
+
+  # Active-node lookups query by status instead of scanning the registry
+  global_secondary_index {
+    name            = "status-index"
+    hash_key        = "status"
+    range_key       = "heartbeat_ts"
+    projection_type = "ALL"
+  }
+
   # TTL for automatic cleanup of stale nodes
   ttl {
     attribute_name = "heartbeat_ts"
@@ -221,6 +239,45 @@ resource "aws_dynamodb_table" "dfs_node_registry" {
   }
 }
 
+# File Metadata Table - one manifest record per file ("uploading" -> "complete")
+resource "aws_dynamodb_table" "dfs_file_metadata" {
+  name         = "dfs-file-metadata"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "file_id"
+
+  attribute {
+    name = "file_id"
+    type = "S"
+  }
+
+  tags = {
+    Name = "dfs-file-metadata"
+  }
+}
+
+# Chunk Refs Table - how many chunk replicas on each node share one stored body
+# Chunk bodies are content-addressed, so identical chunks are kept once per node
+resource "aws_dynamodb_table" "dfs_chunk_refs" {
+  name         = "dfs-chunk-refs"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "checksum"
+  range_key    = "node_id"
+
+  attribute {
+    name = "checksum"
+    type = "S"
+  }
+
+  attribute {
+    name = "node_id"
+    type = "S"
+  }
+
+  tags = {
+    Name = "dfs-chunk-refs"
+  }
+}
+
 ######################
 # S3 Bucket
 ######################
@@ -41,6 +41,16 @@ output "dfs_node_registry_table" {
   value       = aws_dynamodb_table.dfs_node_registry.name
 }
 
+output "dfs_file_metadata_table" {
+  description = "DynamoDB table used for file manifests"
+  value       = aws_dynamodb_table.dfs_file_metadata.name
+}
+
+output "dfs_chunk_refs_table" {
+  description = "DynamoDB table used for chunk reference counts"
+  value       = aws_dynamodb_table.dfs_chunk_refs.name
+}
+
 # IAM instance profile
 output "dfs_instance_profile" {
   description = "IAM instance profile attached to EC2"
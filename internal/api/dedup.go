@@ -0,0 +1,136 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/timskillet/distributed-filestore/internal/dynamodb"
+)
+
+// dedupConcurrency bounds how many chunks an upload plan links at once
+const dedupConcurrency = 8
+
+// deduplicate marks every chunk of a replicated upload that the cluster already
+// stores as deduplicated. Nodes keep one body per checksum, so a chunk whose checksum
+// is held by enough active nodes is recorded on them without any data being sent.
+// Chunks that cannot be linked keep their planned upload target. Nothing proves the
+// client has the data behind a checksum, so callers only deduplicate for trusted
+// clients (DEDUP_TRUSTED_CLIENTS).
+func deduplicate(ctx context.Context, s *Server, fileID string, targets []UploadTarget, checksums []string, nodes []*dynamodb.NodeInfo) {
+	nodeMap := make(map[string]*dynamodb.NodeInfo, len(nodes))
+	for _, node := range nodes {
+		nodeMap[node.NodeID] = node
+	}
+	// Linked replicas must spread as far as a fresh placement would
+	minDomains := min(s.cfg.ReplicationFactor, countDomains(nodes))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, dedupConcurrency)
+	for i := range targets {
+		if checksums[i] == "" {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if node, ok := linkChunk(ctx, s, fileID, i, checksums[i], nodeMap, minDomains); ok {
+				targets[i] = UploadTarget{ChunkIndex: i, Node: node, Deduplicated: true}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// linkChunk records a chunk on ReplicationFactor active nodes that already store its
+// body, returning the node holding the primary replica. It fails if too few nodes hold
+// the body or they span fewer than minDomains failure domains; if a link fails, the
+// replicas already linked are removed so the chunk's upload starts clean.
+func linkChunk(ctx context.Context, s *Server, fileID string, chunkIndex int, checksum string, nodeMap map[string]*dynamodb.NodeInfo, minDomains int) (string, bool) {
+	refs, err := s.store.GetChunkRefs(ctx, s.cfg.ChunkRefsTable, checksum)
+	if err != nil {
+		fmt.Printf("Warning: Failed to look up chunk %s: %v\n", checksum, err)
+		return "", false
+	}
+
+	var holders []*dynamodb.NodeInfo
+	for _, ref := range refs {
+		if node, ok := nodeMap[ref.NodeID]; ok && ref.Refs > 0 {
+			holders = append(holders, node)
+		}
+	}
+	if len(holders) < s.cfg.ReplicationFactor {
+		return "", false
+	}
+	holders = RendezvousNodes(fileID, chunkIndex, holders, s.cfg.ReplicationFactor, nil)
+	if countDomains(holders) < minDomains {
+		return "", false
+	}
+
+	for i, node := range holders {
+		replicaType := "secondary"
+		if i == 0 {
+			replicaType = "primary"
+		}
+		if err := sendLink(ctx, node, fileID, chunkIndex, checksum, replicaType); err != nil {
+			fmt.Printf("Warning: Failed to link chunk %d of %s on %s: %v\n", chunkIndex, fileID, node.NodeID, err)
+			unlinkChunk(ctx, s, fileID, chunkIndex, checksum, holders[:i])
+			return "", false
+		}
+	}
+	return holders[0].NodeID, true
+}
+
+// unlinkChunk removes replicas linkChunk recorded, first from the metadata and then
+// the nodes' references to the body
+func unlinkChunk(ctx context.Context, s *Server, fileID string, chunkIndex int, checksum string, nodes []*dynamodb.NodeInfo) {
+	for _, node := range nodes {
+		if err := s.store.DeleteChunkMetadata(ctx, s.cfg.ChunkMetadataTable, fileID, chunkIndex, node.NodeID); err != nil {
+			fmt.Printf("Warning: Failed to unlink chunk %d of %s on %s: %v\n", chunkIndex, fileID, node.NodeID, err)
+			continue
+		}
+		if err := deleteChunk(ctx, node, fileID, chunkIndex, checksum); err != nil {
+			fmt.Printf("Warning: Failed to release chunk %d of %s on %s: %v\n", chunkIndex, fileID, node.NodeID, err)
+		}
+	}
+}
+
+// countDomains counts the failure domains of nodes; nodes without one count as their own
+func countDomains(nodes []*dynamodb.NodeInfo) int {
+	domains := make(map[string]bool)
+	count := 0
+	for _, node := range nodes {
+		if node.FailureDomain == "" {
+			count++
+		} else if !domains[node.FailureDomain] {
+			domains[node.FailureDomain] = true
+			count++
+		}
+	}
+	return count
+}
+
+// sendLink asks a node to record a replica of a chunk from a body it already stores
+func sendLink(ctx context.Context, node *dynamodb.NodeInfo, fileID string, chunkIndex int, checksum string, replicaType string) error {
+	url := fmt.Sprintf("http://%s:%d/link-chunk?file_id=%s&chunk_index=%d&checksum=%s&replica_type=%s", node.PrivateIP, node.Port, fileID, chunkIndex, checksum, replicaType)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := transferClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
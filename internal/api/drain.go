@@ -0,0 +1,338 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/timskillet/distributed-filestore/internal/dynamodb"
+)
+
+// DrainStatus reports the progress of moving a node's chunks away before it is retired
+type DrainStatus struct {
+	NodeID          string `json:"node_id"`
+	State           string `json:"state"` // Node status: "draining" until every chunk has another copy, then "decommissioned"
+	Running         bool   `json:"running"`
+	Started         int64  `json:"started,omitempty"`
+	Finished        int64  `json:"finished,omitempty"`
+	ChunksTotal     int    `json:"chunks_total"`
+	ChunksMoved     int    `json:"chunks_moved"`
+	ChunksFailed    int    `json:"chunks_failed"`
+	ChunksRemaining int    `json:"chunks_remaining"` // Chunks on the node with no copy anywhere else
+	BytesMoved      int64  `json:"bytes_moved"`
+	LastError       string `json:"last_error,omitempty"`
+}
+
+var errDrainRunning = errors.New("a drain is already running for this node")
+
+// Drainer retires nodes: it marks a node draining so placement skips it, moves each
+// of its replicas to another node, and marks it decommissioned once nothing on it
+// lacks another copy
+type Drainer struct {
+	server *Server
+
+	mu     sync.Mutex
+	drains map[string]*DrainStatus
+}
+
+func NewDrainer(s *Server) *Drainer {
+	return &Drainer{
+		server: s,
+		drains: make(map[string]*DrainStatus),
+	}
+}
+
+// Status returns a snapshot of the current or most recent drain of a node
+func (d *Drainer) Status(nodeID string) (DrainStatus, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status, ok := d.drains[nodeID]
+	if !ok {
+		return DrainStatus{}, false
+	}
+	return *status, true
+}
+
+// Statuses returns snapshots of every drain started by this process, sorted by node ID
+func (d *Drainer) Statuses() []DrainStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	statuses := make([]DrainStatus, 0, len(d.drains))
+	for _, status := range d.drains {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].NodeID < statuses[j].NodeID
+	})
+	return statuses
+}
+
+// Start marks a node draining and moves its chunks away in the background.
+// Draining a node again resumes from whatever is still recorded on it.
+func (d *Drainer) Start(ctx context.Context, nodeID string) error {
+	cfg := d.server.cfg
+	node, err := d.server.store.GetNode(ctx, cfg.NodeRegistryTable, nodeID)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	if status, ok := d.drains[nodeID]; ok && status.Running {
+		d.mu.Unlock()
+		return errDrainRunning
+	}
+	status := &DrainStatus{NodeID: nodeID, State: dynamodb.NodeStatusDraining, Running: true, Started: time.Now().Unix()}
+	d.drains[nodeID] = status
+	d.mu.Unlock()
+
+	if err := d.server.store.SetNodeStatus(ctx, cfg.NodeRegistryTable, nodeID, dynamodb.NodeStatusDraining); err != nil {
+		d.finish(status, err)
+		return fmt.Errorf("failed to mark node draining: %w", err)
+	}
+	node.Status = dynamodb.NodeStatusDraining
+
+	go func() {
+		err := d.drain(ctx, node, status)
+		d.finish(status, err)
+		if err != nil {
+			fmt.Printf("Warning: Drain of %s failed: %v\n", nodeID, err)
+		}
+	}()
+	return nil
+}
+
+func (d *Drainer) finish(status *DrainStatus, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status.Running = false
+	status.Finished = time.Now().Unix()
+	if err != nil {
+		status.LastError = err.Error()
+	}
+}
+
+func (d *Drainer) drain(ctx context.Context, node *dynamodb.NodeInfo, status *DrainStatus) error {
+	cfg := d.server.cfg
+	chunks, err := d.server.store.GetChunksByNodeID(ctx, cfg.ChunkMetadataTable, node.NodeID)
+	if err != nil {
+		return fmt.Errorf("failed to list chunks on %s: %w", node.NodeID, err)
+	}
+
+	d.mu.Lock()
+	status.ChunksTotal = len(chunks)
+	d.mu.Unlock()
+
+	for _, chunk := range chunks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n, moveErr := d.moveOff(ctx, node, chunk)
+
+		d.mu.Lock()
+		if moveErr != nil {
+			status.ChunksFailed++
+			status.LastError = moveErr.Error()
+		} else {
+			status.ChunksMoved++
+			status.BytesMoved += n
+		}
+		d.mu.Unlock()
+
+		if moveErr != nil {
+			fmt.Printf("Warning: Failed to move chunk %d of %s off %s: %v\n", chunk.ChunkIndex, chunk.FileID, node.NodeID, moveErr)
+			continue
+		}
+		if err := d.server.moveLimiter.Wait(ctx, n); err != nil {
+			return err
+		}
+	}
+
+	remaining, err := d.unreplicated(ctx, node.NodeID)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	status.ChunksRemaining = remaining
+	d.mu.Unlock()
+
+	if remaining > 0 {
+		return fmt.Errorf("%d chunks on %s have no other copy", remaining, node.NodeID)
+	}
+	if err := d.server.store.SetNodeStatus(ctx, cfg.NodeRegistryTable, node.NodeID, dynamodb.NodeStatusDecommissioned); err != nil {
+		return fmt.Errorf("failed to mark node decommissioned: %w", err)
+	}
+
+	d.mu.Lock()
+	status.State = dynamodb.NodeStatusDecommissioned
+	d.mu.Unlock()
+	return nil
+}
+
+// moveOff relocates the node's replica of one chunk to an active node that does not
+// hold it yet, preferring a failure domain the other replicas are not in
+func (d *Drainer) moveOff(ctx context.Context, node *dynamodb.NodeInfo, chunk *dynamodb.ChunkMetadata) (int64, error) {
+	cfg := d.server.cfg
+	replicas, err := d.server.store.GetChunkReplicas(ctx, cfg.ChunkMetadataTable, chunk.FileID, chunk.ChunkIndex)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load replicas: %w", err)
+	}
+
+	nodes, err := d.server.nodes.ReadableNodes(ctx)
+	if err != nil {
+		return 0, err
+	}
+	domainOf := make(map[string]string, len(nodes))
+	for _, n := range nodes {
+		domainOf[n.NodeID] = n.FailureDomain
+	}
+
+	var own *dynamodb.ChunkMetadata
+	holders := make(map[string]bool)
+	domains := make(map[string]bool)
+	for _, replica := range replicas {
+		holders[replica.NodeID] = true
+		if replica.NodeID == node.NodeID {
+			own = replica
+		} else if domain := domainOf[replica.NodeID]; domain != "" {
+			domains[domain] = true
+		}
+	}
+	if own == nil {
+		return 0, nil // Moved or repaired since the chunk list was read
+	}
+	// Another copy of a replica keeps the replication factor only if this one moves,
+	// but a shard that repair already rebuilt elsewhere needs no second copy. A shard
+	// still avoids every node holding part of its stripe.
+	if own.ReplicaType == "shard" && heldElsewhere(own, replicas) {
+		return 0, nil
+	}
+
+	var candidates []*dynamodb.NodeInfo
+	for _, n := range nodes {
+		if !holders[n.NodeID] && n.Status == dynamodb.NodeStatusActive {
+			candidates = append(candidates, n)
+		}
+	}
+	candidates = nodesAboveReserve(candidates, int64(cfg.PlacementReserveMB)<<20)
+	if len(candidates) == 0 {
+		return 0, fmt.Errorf("no active node can take chunk %d of %s", chunk.ChunkIndex, chunk.FileID)
+	}
+
+	target := d.server.placement.Place(PlacementRequest{
+		FileID:      chunk.FileID,
+		ChunkIndex:  chunk.ChunkIndex,
+		Count:       1,
+		Nodes:       candidates,
+		UsedDomains: domains,
+	})[0]
+	return moveReplica(ctx, d.server, chunk.FileID, chunk.ChunkIndex, node, target)
+}
+
+// unreplicated counts the chunks still recorded on a node that no other node holds,
+// treating each shard of a stripe as a chunk of its own
+func (d *Drainer) unreplicated(ctx context.Context, nodeID string) (int, error) {
+	cfg := d.server.cfg
+	chunks, err := d.server.store.GetChunksByNodeID(ctx, cfg.ChunkMetadataTable, nodeID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list chunks on %s: %w", nodeID, err)
+	}
+
+	count := 0
+	for _, chunk := range chunks {
+		replicas, err := d.server.store.GetChunkReplicas(ctx, cfg.ChunkMetadataTable, chunk.FileID, chunk.ChunkIndex)
+		if err != nil {
+			return 0, fmt.Errorf("failed to load replicas: %w", err)
+		}
+		if !heldElsewhere(chunk, replicas) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// heldElsewhere reports whether a node other than chunk's holds the same data. Any
+// replica of a chunk does, but a shard is only covered by a shard with its index.
+func heldElsewhere(chunk *dynamodb.ChunkMetadata, replicas []*dynamodb.ChunkMetadata) bool {
+	for _, replica := range replicas {
+		if replica.NodeID == chunk.NodeID {
+			continue
+		}
+		if chunk.ReplicaType != "shard" || replica.ShardIndex == chunk.ShardIndex {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleDrain starts draining the node named by node_id (POST)
+func HandleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method not allowed"))
+		return
+	}
+
+	if apiServer == nil || apiServer.drainer == nil {
+		http.Error(w, "API server not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	nodeID := r.URL.Query().Get("node_id")
+	if nodeID == "" {
+		http.Error(w, "missing node_id", http.StatusBadRequest)
+		return
+	}
+
+	if err := apiServer.drainer.Start(context.Background(), nodeID); err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, errDrainRunning):
+			status = http.StatusConflict
+		case errors.Is(err, dynamodb.ErrNotFound):
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	status, _ := apiServer.drainer.Status(nodeID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(status)
+}
+
+// HandleDrainStatus reports the progress of one node's drain, or of every drain
+// when node_id is omitted
+func HandleDrainStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method not allowed"))
+		return
+	}
+
+	if apiServer == nil || apiServer.drainer == nil {
+		http.Error(w, "API server not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	nodeID := r.URL.Query().Get("node_id")
+	if nodeID == "" {
+		json.NewEncoder(w).Encode(apiServer.drainer.Statuses())
+		return
+	}
+
+	status, ok := apiServer.drainer.Status(nodeID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no drain has been started for %s", nodeID), http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/timskillet/distributed-filestore/internal/dynamodb"
+)
+
+// drainNode drains a node and waits for the drain to finish
+func drainNode(t *testing.T, s *Server, nodeID string) DrainStatus {
+	t.Helper()
+	if err := s.drainer.Start(context.Background(), nodeID); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, _ := s.drainer.Status(nodeID)
+		if !status.Running {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("drain of %s did not finish: %+v", nodeID, status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// shardHolders maps each shard index of chunk 0 to the node recorded as holding it
+func shardHolders(t *testing.T, s *Server, fileID string) map[int]string {
+	t.Helper()
+	replicas, err := s.store.GetChunkReplicas(context.Background(), s.cfg.ChunkMetadataTable, fileID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	holders := make(map[int]string)
+	for _, replica := range replicas {
+		if replica.ReplicaType != "shard" {
+			t.Fatalf("%s holds a %q replica, want a shard", replica.NodeID, replica.ReplicaType)
+		}
+		holders[replica.ShardIndex] = replica.NodeID
+	}
+	return holders
+}
+
+func TestDrainMovesShards(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	nodes := []*fakeNode{
+		addFakeNode(t, s, "node-a"),
+		addFakeNode(t, s, "node-b"),
+		addFakeNode(t, s, "node-c"),
+	}
+	spare := addFakeNode(t, s, "node-d")
+	data := bytes.Repeat([]byte("striped "), 64)
+	fileID := storeStripe(t, s, data, 2, 1, nodes)
+	want := shardHolders(t, s, fileID)
+
+	status := drainNode(t, s, "node-b")
+	if status.State != dynamodb.NodeStatusDecommissioned || status.ChunksMoved != 1 || status.ChunksRemaining != 0 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	want[1] = spare.id
+	if got := shardHolders(t, s, fileID); len(got) != 3 || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Fatalf("shards are on %v, want %v", got, want)
+	}
+	if len(nodes[1].bodies) != 0 || len(spare.bodies) != 1 {
+		t.Fatalf("drained node keeps %d bodies, spare holds %d", len(nodes[1].bodies), len(spare.bodies))
+	}
+}
+
+func TestDrainKeepsNodeWhoseShardHasNowhereToGo(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	nodes := []*fakeNode{
+		addFakeNode(t, s, "node-a"),
+		addFakeNode(t, s, "node-b"),
+		addFakeNode(t, s, "node-c"),
+	}
+	fileID := storeStripe(t, s, bytes.Repeat([]byte("striped "), 64), 2, 1, nodes)
+
+	// Every other node holds another shard of the stripe, which covers nothing
+	status := drainNode(t, s, "node-a")
+	if status.State != dynamodb.NodeStatusDraining || status.ChunksFailed != 1 || status.ChunksRemaining != 1 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if got := shardHolders(t, s, fileID); got[0] != "node-a" {
+		t.Fatalf("shard 0 is recorded on %s", got[0])
+	}
+}
+
+func TestDrainLeavesShardRebuiltElsewhere(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	nodes := []*fakeNode{
+		addFakeNode(t, s, "node-a"),
+		addFakeNode(t, s, "node-b"),
+		addFakeNode(t, s, "node-c"),
+		addFakeNode(t, s, "node-d"),
+	}
+	fileID := storeStripe(t, s, bytes.Repeat([]byte("striped "), 64), 2, 1, nodes[:3])
+
+	// Repair rebuilt shard 0 on node-d while node-a was unreachable
+	replicas, err := s.store.GetChunkReplicas(context.Background(), s.cfg.ChunkMetadataTable, fileID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, replica := range replicas {
+		if replica.ShardIndex == 0 {
+			rebuilt := *replica
+			rebuilt.NodeID = "node-d"
+			if err := s.store.PutChunkMetadata(context.Background(), s.cfg.ChunkMetadataTable, &rebuilt); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	status := drainNode(t, s, "node-a")
+	if status.State != dynamodb.NodeStatusDecommissioned || status.ChunksFailed != 0 || status.BytesMoved != 0 || status.ChunksRemaining != 0 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}
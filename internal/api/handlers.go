@@ -1,35 +1,59 @@
 package api
 
 import (
-	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"math/rand"
 	"net/http"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/timskillet/distributed-filestore/internal/chunkstore"
+	"github.com/timskillet/distributed-filestore/internal/config"
 	"github.com/timskillet/distributed-filestore/internal/dynamodb"
+	"github.com/timskillet/distributed-filestore/internal/erasure"
 )
 
 type InitUploadRequest struct {
-	Filename  string `json:"filename"`
-	Size      int64  `json:"size"`
-	ChunkSize int    `json:"chunk_size"`
+	Filename     string `json:"filename"`
+	Size         int64  `json:"size"`
+	ChunkSize    int    `json:"chunk_size"`
+	DataShards   int    `json:"data_shards,omitempty"`   // Erasure-code each chunk into this many data shards
+	ParityShards int    `json:"parity_shards,omitempty"` // plus this many parity shards instead of replicating it
+	// Checksum of each chunk, if known up front. Replicated chunks the cluster already
+	// stores are linked to the existing copies instead of being uploaded again.
+	ChunkChecksums []string `json:"chunk_checksums,omitempty"`
 }
 
-type UploadTarget struct {
-	ChunkIndex int    `json:"chunk_index"`
+// ShardTarget locates one shard of an erasure-coded chunk
+type ShardTarget struct {
+	ShardIndex int    `json:"shard_index"`
 	Node       string `json:"node"`
 	URL        string `json:"url"`
+	Checksum   string `json:"checksum,omitempty"`
+}
+
+type UploadTarget struct {
+	ChunkIndex   int           `json:"chunk_index"`
+	Node         string        `json:"node"`
+	URL          string        `json:"url"`
+	Replicas     []string      `json:"replicas,omitempty"`     // Secondary node IDs the primary replicates to
+	Shards       []ShardTarget `json:"shards,omitempty"`       // Erasure-coded chunks: where each shard goes, instead of Node and URL
+	Deduplicated bool          `json:"deduplicated,omitempty"` // Already stored in the cluster; nothing to upload
 }
 
 type InitUploadResponse struct {
 	FileID        string         `json:"file_id"`
 	ChunkSize     int            `json:"chunk_size"`
+	DataShards    int            `json:"data_shards,omitempty"`
+	ParityShards  int            `json:"parity_shards,omitempty"`
 	UploadTargets []UploadTarget `json:"upload_targets"`
 }
 
@@ -62,16 +86,37 @@ func HandleInitUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Load available storage nodes from DynamoDB
+	// Each chunk goes to ReplicationFactor nodes, or one shard per node when erasure-coded
+	erasureCoded := req.DataShards > 0 || req.ParityShards > 0
+	width := apiServer.cfg.ReplicationFactor
+	if erasureCoded {
+		if err := erasure.Validate(req.DataShards, req.ParityShards); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		width = req.DataShards + req.ParityShards
+	}
+
+	// Load available storage nodes from the node directory
 	ctx := context.Background()
-	nodes, err := apiServer.dbClient.ListActiveNodes(ctx, apiServer.cfg.NodeRegistryTable, int64(apiServer.cfg.NodeHeartbeatTimeout))
+	nodes, err := apiServer.nodes.ActiveNodes(ctx)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to get nodes: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	if len(nodes) < apiServer.cfg.ReplicationFactor {
-		http.Error(w, fmt.Sprintf("Not enough active nodes. Required: %d, Available: %d", apiServer.cfg.ReplicationFactor, len(nodes)), http.StatusServiceUnavailable)
+	if len(nodes) < width {
+		http.Error(w, fmt.Sprintf("Not enough active nodes. Required: %d, Available: %d", width, len(nodes)), http.StatusServiceUnavailable)
+		return
+	}
+
+	// Leave nodes that are nearly full out of the placement. Deduplicated chunks take no
+	// space, so they may still be linked on any active node.
+	active := nodes
+	reserve := int64(apiServer.cfg.PlacementReserveMB) << 20
+	nodes = nodesAboveReserve(nodes, reserve)
+	if len(nodes) < width {
+		http.Error(w, fmt.Sprintf("Not enough nodes with free space. Required: %d, Available: %d", width, len(nodes)), http.StatusServiceUnavailable)
 		return
 	}
 
@@ -80,57 +125,294 @@ func HandleInitUpload(w http.ResponseWriter, r *http.Request) {
 	if chunkSize <= 0 {
 		chunkSize = 1024 // Default to 1KB
 	}
+	if chunkSize > apiServer.cfg.MaxChunkSize {
+		http.Error(w, fmt.Sprintf("chunk_size exceeds the maximum of %d bytes", apiServer.cfg.MaxChunkSize), http.StatusBadRequest)
+		return
+	}
 	totalChunks := int((req.Size + int64(chunkSize) - 1) / int64(chunkSize))
+	if len(req.ChunkChecksums) > 0 && len(req.ChunkChecksums) != totalChunks {
+		http.Error(w, fmt.Sprintf("expected %d chunk checksums, got %d", totalChunks, len(req.ChunkChecksums)), http.StatusBadRequest)
+		return
+	}
 
 	fileID := uuid.New().String()
 	uploadTargets := make([]UploadTarget, totalChunks)
-	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
 
 	// Get API server base URL from request
 	apiBaseURL := getAPIBaseURL(r)
 
+	// Bytes each selected node stores per chunk
+	stored := int64(chunkSize)
+	if erasureCoded {
+		stored = int64((chunkSize + req.DataShards - 1) / req.DataShards)
+	}
+
 	// Select nodes for each chunk with replication
 	for i := 0; i < totalChunks; i++ {
-		// Select N nodes (replication factor) for this chunk
-		selectedNodes := selectNodesForChunk(nodes, apiServer.cfg.ReplicationFactor, rng)
+		// Select N nodes (replication factor, or one per shard) for this chunk
+		selectedNodes := apiServer.placement.Place(PlacementRequest{
+			FileID:     fileID,
+			ChunkIndex: i,
+			Count:      width,
+			Nodes:      nodes,
+		})
+		for _, node := range selectedNodes {
+			// Account for this plan's own writes until the next heartbeat reports real usage
+			if node.AvailableSpace >= 0 {
+				node.AvailableSpace = max(node.AvailableSpace-stored, 0)
+			}
+		}
+
+		if erasureCoded {
+			// Shard j of the stripe goes to the j-th selected node
+			shards := make([]ShardTarget, len(selectedNodes))
+			for j, node := range selectedNodes {
+				url := fmt.Sprintf("%s/proxy-chunk-upload?file_id=%s&chunk_index=%d&node_id=%s&shard_index=%d", apiBaseURL, fileID, i, node.NodeID, j)
+				shards[j] = ShardTarget{ShardIndex: j, Node: node.NodeID, URL: url}
+			}
+			uploadTargets[i] = UploadTarget{ChunkIndex: i, Shards: shards}
+			continue
+		}
 
 		// First node is primary, rest are secondary
 		primaryNode := selectedNodes[0]
+		var secondaries []string
+		for _, node := range selectedNodes[1:] {
+			secondaries = append(secondaries, node.NodeID)
+		}
+
 		// Use proxy URL instead of direct node URL
 		url := fmt.Sprintf("%s/proxy-chunk-upload?file_id=%s&chunk_index=%d&node_id=%s", apiBaseURL, fileID, i, primaryNode.NodeID)
-		uploadTargets[i] = UploadTarget{i, primaryNode.NodeID, url}
+		if len(secondaries) > 0 {
+			url += fmt.Sprintf("&replicas=%s&quorum=%d", strings.Join(secondaries, ","), apiServer.cfg.WriteQuorum)
+		}
+		uploadTargets[i] = UploadTarget{ChunkIndex: i, Node: primaryNode.NodeID, URL: url, Replicas: secondaries}
+	}
+
+	// Record the file manifest so finalize can verify the plan was fulfilled
+	file := &dynamodb.FileMetadata{
+		FileID:     fileID,
+		Filename:   req.Filename,
+		Size:       req.Size,
+		ChunkSize:  chunkSize,
+		ChunkCount: totalChunks,
+	}
+	if erasureCoded {
+		file.DataShards = req.DataShards
+		file.ParityShards = req.ParityShards
+	}
+	if err := apiServer.store.CreateFileMetadata(ctx, apiServer.cfg.FileMetadataTable, file); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create file record: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// A checksum alone would let any client claim a body it never had, so chunks are
+	// only linked when every client is trusted. Erasure-coded chunks are stored as
+	// shards, which only deduplicate on the nodes. Small chunks are cheaper to upload
+	// again than to look up one by one.
+	if apiServer.cfg.DedupTrustedClients && len(req.ChunkChecksums) > 0 && !erasureCoded && chunkSize >= apiServer.cfg.DedupMinChunkSize {
+		deduplicate(ctx, apiServer, fileID, uploadTargets, req.ChunkChecksums, active)
 	}
 
-	resp := InitUploadResponse{fileID, chunkSize, uploadTargets}
+	resp := InitUploadResponse{
+		FileID:        fileID,
+		ChunkSize:     chunkSize,
+		DataShards:    file.DataShards,
+		ParityShards:  file.ParityShards,
+		UploadTargets: uploadTargets,
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(resp)
 }
 
-// selectNodesForChunk selects N random nodes for replication
-func selectNodesForChunk(nodes []*dynamodb.NodeInfo, count int, rng *rand.Rand) []*dynamodb.NodeInfo {
-	if len(nodes) <= count {
-		return nodes
+type FinalizeUploadRequest struct {
+	FileID         string     `json:"file_id"`
+	ChunkChecksums []string   `json:"chunk_checksums,omitempty"` // Client-computed checksum per chunk index
+	ShardChecksums [][]string `json:"shard_checksums,omitempty"` // Erasure-coded files: client-computed checksum per chunk and shard index
+}
+
+type FinalizeUploadResponse struct {
+	FileID     string `json:"file_id"`
+	State      string `json:"state"`
+	ChunkCount int    `json:"chunk_count"`
+}
+
+func HandleFinalizeUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method not allowed"))
+		return
+	}
+
+	if apiServer == nil {
+		http.Error(w, "API server not initialized", http.StatusInternalServerError)
+		return
 	}
 
-	// Shuffle and take first N
-	shuffled := make([]*dynamodb.NodeInfo, len(nodes))
-	copy(shuffled, nodes)
-	rng.Shuffle(len(shuffled), func(i, j int) {
-		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
-	})
+	var req FinalizeUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.FileID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	file, err := apiServer.store.GetFileMetadata(ctx, apiServer.cfg.FileMetadataTable, req.FileID)
+	if errors.Is(err, dynamodb.ErrNotFound) {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get file: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if file.State == dynamodb.FileStateComplete {
+		writeFinalizeResponse(w, file)
+		return
+	}
+
+	if req.ChunkChecksums != nil && len(req.ChunkChecksums) != file.ChunkCount {
+		http.Error(w, fmt.Sprintf("expected %d chunk checksums, got %d", file.ChunkCount, len(req.ChunkChecksums)), http.StatusBadRequest)
+		return
+	}
+
+	chunks, err := apiServer.store.GetChunksByFileID(ctx, apiServer.cfg.ChunkMetadataTable, req.FileID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get chunks: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	var checksums []string
+	if file.ErasureCoded() {
+		checksums, err = verifyShards(file, chunks, req.ChunkChecksums, req.ShardChecksums)
+	} else {
+		checksums, err = verifyChunks(file, chunks, req.ChunkChecksums, requiredReplicas(apiServer.cfg))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	// Commit: only one finalize can move the file out of "uploading"
+	if err := apiServer.store.CompleteFile(ctx, apiServer.cfg.FileMetadataTable, req.FileID, checksums); err != nil {
+		if errors.Is(err, dynamodb.ErrConditionFailed) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to finalize file: %v", err), http.StatusInternalServerError)
+		return
+	}
 
-	return shuffled[:count]
+	file.State = dynamodb.FileStateComplete
+	writeFinalizeResponse(w, file)
 }
 
-func HandleFinalizeUpload(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintln(w, "File upload finalized successfully!")
+func writeFinalizeResponse(w http.ResponseWriter, file *dynamodb.FileMetadata) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(FinalizeUploadResponse{file.FileID, file.State, file.ChunkCount})
+}
+
+// requiredReplicas is the number of stored replicas a chunk needs before its file can be finalized:
+// the write quorum the storage nodes acknowledged uploads with
+func requiredReplicas(cfg *config.Config) int {
+	return cfg.WriteQuorum
+}
+
+// verifyChunks checks that every planned chunk index has enough replicas agreeing on one checksum,
+// and returns the checksum of each chunk in index order
+func verifyChunks(file *dynamodb.FileMetadata, chunks []*dynamodb.ChunkMetadata, expected []string, required int) ([]string, error) {
+	chunkMap := make(map[int][]*dynamodb.ChunkMetadata)
+	for _, chunk := range chunks {
+		chunkMap[chunk.ChunkIndex] = append(chunkMap[chunk.ChunkIndex], chunk)
+	}
+
+	checksums := make([]string, file.ChunkCount)
+	for i := 0; i < file.ChunkCount; i++ {
+		replicas := chunkMap[i]
+		if len(replicas) == 0 {
+			return nil, fmt.Errorf("chunk %d is missing", i)
+		}
+
+		checksum := replicas[0].Checksum
+		for _, replica := range replicas {
+			if replica.ReplicaType == "primary" {
+				checksum = replica.Checksum
+				break
+			}
+		}
+		if expected != nil && expected[i] != checksum {
+			return nil, fmt.Errorf("chunk %d checksum mismatch: expected %s, stored %s", i, expected[i], checksum)
+		}
+
+		matching := 0
+		for _, replica := range replicas {
+			if replica.Checksum == checksum {
+				matching++
+			}
+		}
+		if matching < required {
+			return nil, fmt.Errorf("chunk %d has %d of %d required replicas", i, matching, required)
+		}
+
+		checksums[i] = checksum
+	}
+
+	return checksums, nil
+}
+
+// verifyShards checks that every shard of every stripe of an erasure-coded file is stored
+// with the checksum the client computed for it. The nodes verified each shard against its
+// checksum when storing it, so the stripe checksums are only recorded once every shard
+// the client encoded from that stripe is confirmed.
+func verifyShards(file *dynamodb.FileMetadata, chunks []*dynamodb.ChunkMetadata, expected []string, expectedShards [][]string) ([]string, error) {
+	width := file.DataShards + file.ParityShards
+	if len(expected) != file.ChunkCount || len(expectedShards) != file.ChunkCount {
+		return nil, fmt.Errorf("erasure-coded files need chunk and shard checksums for all %d chunks", file.ChunkCount)
+	}
+	for i, stripe := range expectedShards {
+		if len(stripe) != width {
+			return nil, fmt.Errorf("chunk %d needs %d shard checksums, got %d", i, width, len(stripe))
+		}
+	}
+
+	shards := make(map[int]map[int]bool)
+	for _, chunk := range chunks {
+		if chunk.ReplicaType != "shard" || chunk.ChunkIndex < 0 || chunk.ChunkIndex >= file.ChunkCount ||
+			chunk.ShardIndex < 0 || chunk.ShardIndex >= width {
+			continue
+		}
+		if chunk.Checksum != expectedShards[chunk.ChunkIndex][chunk.ShardIndex] {
+			return nil, fmt.Errorf("shard %d of chunk %d checksum mismatch: expected %s, stored %s",
+				chunk.ShardIndex, chunk.ChunkIndex, expectedShards[chunk.ChunkIndex][chunk.ShardIndex], chunk.Checksum)
+		}
+		if shards[chunk.ChunkIndex] == nil {
+			shards[chunk.ChunkIndex] = make(map[int]bool)
+		}
+		shards[chunk.ChunkIndex][chunk.ShardIndex] = true
+	}
+
+	for i := 0; i < file.ChunkCount; i++ {
+		for j := 0; j < width; j++ {
+			if !shards[i][j] {
+				return nil, fmt.Errorf("shard %d of chunk %d is missing", j, i)
+			}
+		}
+	}
+
+	return expected, nil
 }
 
 type DownloadTarget struct {
-	ChunkIndex int    `json:"chunk_index"`
-	URL        string `json:"url"`
-	Checksum   string `json:"checksum"`
+	ChunkIndex   int           `json:"chunk_index"`
+	URL          string        `json:"url,omitempty"`            // Best replica, the same as URLs[0]
+	URLs         []string      `json:"urls,omitempty"`           // Every replica in the order to try them
+	HedgeAfterMS int           `json:"hedge_after_ms,omitempty"` // Wait this long for a replica before also asking the next one
+	Checksum     string        `json:"checksum"`
+	Size         int           `json:"size,omitempty"`          // Erasure-coded chunks: bytes in the stripe
+	DataShards   int           `json:"data_shards,omitempty"`   // Erasure-coded chunks: shards needed to rebuild
+	ParityShards int           `json:"parity_shards,omitempty"` // Erasure-coded chunks: extra shards
+	Shards       []ShardTarget `json:"shards,omitempty"`        // Erasure-coded chunks: available shards, instead of URL
 }
 
 func HandleDownloadPlan(w http.ResponseWriter, r *http.Request) {
@@ -152,9 +434,24 @@ func HandleDownloadPlan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Query DynamoDB for all chunks of this file
+	// Only finalized files can be downloaded
 	ctx := context.Background()
-	chunks, err := apiServer.dbClient.GetChunksByFileID(ctx, apiServer.cfg.ChunkMetadataTable, fileID)
+	file, err := apiServer.store.GetFileMetadata(ctx, apiServer.cfg.FileMetadataTable, fileID)
+	if errors.Is(err, dynamodb.ErrNotFound) {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get file: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if file.State != dynamodb.FileStateComplete {
+		http.Error(w, "file upload has not been finalized", http.StatusConflict)
+		return
+	}
+
+	// Query DynamoDB for all chunks of this file
+	chunks, err := apiServer.store.GetChunksByFileID(ctx, apiServer.cfg.ChunkMetadataTable, fileID)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to get chunks: %v", err), http.StatusInternalServerError)
 		return
@@ -165,8 +462,8 @@ func HandleDownloadPlan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get active nodes to map node_id to IP/port
-	nodes, err := apiServer.dbClient.ListActiveNodes(ctx, apiServer.cfg.NodeRegistryTable, int64(apiServer.cfg.NodeHeartbeatTimeout))
+	// Get readable nodes to map node_id to IP/port; draining nodes still serve their chunks
+	nodes, err := apiServer.nodes.ReadableNodes(ctx)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to get nodes: %v", err), http.StatusInternalServerError)
 		return
@@ -183,19 +480,66 @@ func HandleDownloadPlan(w http.ResponseWriter, r *http.Request) {
 		chunkMap[chunk.ChunkIndex] = append(chunkMap[chunk.ChunkIndex], chunk)
 	}
 
+	// Get API server base URL from request
+	apiBaseURL := getAPIBaseURL(r)
+
+	// A replica slower than most recent reads is probably stuck, so the client hedges
+	var hedgeAfterMS int
+	if apiServer.cfg.HedgePercentile > 0 {
+		// Round up so sub-millisecond reads still hedge rather than sending 0 (off)
+		hedgeAfter := apiServer.latency.Percentile(apiServer.cfg.HedgePercentile)
+		if hedgeAfter > 0 {
+			hedgeAfterMS = int((hedgeAfter + time.Millisecond - 1) / time.Millisecond)
+		}
+	}
+
 	var targets []DownloadTarget
 	for chunkIndex, replicas := range chunkMap {
-		// Select best replica (prefer primary, then healthy nodes)
-		selectedReplica := selectBestReplica(replicas, nodeMap)
-		if selectedReplica == nil {
+		if file.ErasureCoded() {
+			// The client rebuilds missing shards as long as DataShards of them can be read
+			target, ok := shardDownloadTarget(file, chunkIndex, replicas, nodeMap, apiBaseURL)
+			if ok {
+				targets = append(targets, target)
+			}
 			continue
 		}
 
-		// Get API server base URL from request
-		apiBaseURL := getAPIBaseURL(r)
-		// Use proxy URL instead of direct node URL
-		url := fmt.Sprintf("%s/proxy-chunk-download?file_id=%s&chunk_index=%d&node_id=%s", apiBaseURL, fileID, chunkIndex, selectedReplica.NodeID)
-		targets = append(targets, DownloadTarget{chunkIndex, url, selectedReplica.Checksum})
+		// Every replica, best first, so the client can fail over (fastest healthy nodes first)
+		ranked := rankReplicas(replicas, nodeMap, apiServer.latency)
+		if quorum := apiServer.cfg.ReadQuorum; quorum > 1 {
+			// A plan that cannot meet the read quorum would serve unchecked copies
+			if readable := countReadable(ranked, nodeMap); readable < quorum {
+				http.Error(w, fmt.Sprintf("chunk %d has %d readable replicas, fewer than the read quorum of %d", chunkIndex, readable, quorum), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		urls := make([]string, len(ranked))
+		for i, replica := range ranked {
+			// Use proxy URL instead of direct node URL
+			urls[i] = fmt.Sprintf("%s/proxy-chunk-download?file_id=%s&chunk_index=%d&node_id=%s&checksum=%s", apiBaseURL, fileID, chunkIndex, replica.NodeID, replica.Checksum)
+			if apiServer.cfg.ReadQuorum > 1 {
+				// The proxy compares this replica with the others until the read quorum answers
+				var others []string
+				for _, other := range ranked {
+					if other.NodeID != replica.NodeID {
+						others = append(others, other.NodeID)
+					}
+				}
+				urls[i] += "&replicas=" + strings.Join(others, ",")
+			}
+		}
+
+		checksum := ranked[0].Checksum
+		if chunkIndex < len(file.ChunkChecksums) {
+			checksum = file.ChunkChecksums[chunkIndex]
+		}
+		targets = append(targets, DownloadTarget{
+			ChunkIndex:   chunkIndex,
+			URL:          urls[0],
+			URLs:         urls,
+			HedgeAfterMS: hedgeAfterMS,
+			Checksum:     checksum,
+		})
 	}
 
 	// Sort by chunk index
@@ -207,35 +551,109 @@ func HandleDownloadPlan(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "no valid chunks found for file", http.StatusNotFound)
 		return
 	}
+	if len(targets) < file.ChunkCount {
+		http.Error(w, fmt.Sprintf("only %d of %d chunks are available", len(targets), file.ChunkCount), http.StatusServiceUnavailable)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(targets)
 }
 
-// selectBestReplica selects the best replica from available replicas
-func selectBestReplica(replicas []*dynamodb.ChunkMetadata, nodeMap map[string]*dynamodb.NodeInfo) *dynamodb.ChunkMetadata {
-	// Prefer primary replicas
+// shardDownloadTarget lists the readable shards of an erasure-coded chunk, or reports
+// false if fewer than DataShards of them are readable
+func shardDownloadTarget(file *dynamodb.FileMetadata, chunkIndex int, replicas []*dynamodb.ChunkMetadata, nodeMap map[string]*dynamodb.NodeInfo, apiBaseURL string) (DownloadTarget, bool) {
+	target := DownloadTarget{
+		ChunkIndex:   chunkIndex,
+		Size:         file.StripeSize(chunkIndex),
+		DataShards:   file.DataShards,
+		ParityShards: file.ParityShards,
+	}
+	if chunkIndex < len(file.ChunkChecksums) {
+		target.Checksum = file.ChunkChecksums[chunkIndex]
+	}
+
+	seen := make(map[int]bool)
 	for _, replica := range replicas {
-		if replica.ReplicaType == "primary" {
-			if node, ok := nodeMap[replica.NodeID]; ok && node.Status == "active" {
-				return replica
-			}
+		node, ok := nodeMap[replica.NodeID]
+		if replica.ReplicaType != "shard" || seen[replica.ShardIndex] || !ok || !servesReads(node) {
+			continue
 		}
-	}
+		seen[replica.ShardIndex] = true
+		url := fmt.Sprintf("%s/proxy-chunk-download?file_id=%s&chunk_index=%d&node_id=%s&checksum=%s&shard_index=%d", apiBaseURL, file.FileID, chunkIndex, replica.NodeID, replica.Checksum, replica.ShardIndex)
+		target.Shards = append(target.Shards, ShardTarget{
+			ShardIndex: replica.ShardIndex,
+			Node:       replica.NodeID,
+			URL:        url,
+			Checksum:   replica.Checksum,
+		})
+	}
+
+	// Data shards first, so a healthy stripe is read without touching parity
+	sort.Slice(target.Shards, func(i, j int) bool {
+		return target.Shards[i].ShardIndex < target.Shards[j].ShardIndex
+	})
+	return target, len(target.Shards) >= file.DataShards
+}
 
-	// Fallback to any active secondary
+// rankReplicas orders a chunk's replicas for reading: replicas on readable nodes by the
+// nodes' moving average read latency, primaries first among equals. Nodes not read from
+// yet are ranked at the mean of the measured ones, so they are neither preferred over
+// fast nodes nor starved. If no replica is on a readable node, all of them are returned
+// so the client can still try.
+func rankReplicas(replicas []*dynamodb.ChunkMetadata, nodeMap map[string]*dynamodb.NodeInfo, latency *latencyTracker) []*dynamodb.ChunkMetadata {
+	var ranked []*dynamodb.ChunkMetadata
+	averages := make(map[string]time.Duration)
+	var measured time.Duration
+	var measuredCount int
 	for _, replica := range replicas {
-		if node, ok := nodeMap[replica.NodeID]; ok && node.Status == "active" {
-			return replica
+		node, ok := nodeMap[replica.NodeID]
+		if !ok || !servesReads(node) {
+			continue
+		}
+		ranked = append(ranked, replica)
+		if avg, ok := latency.Average(replica.NodeID); ok {
+			averages[replica.NodeID] = avg
+			measured += avg
+			measuredCount++
 		}
 	}
+	if len(ranked) == 0 {
+		return replicas
+	}
+	if measuredCount > 0 {
+		for _, replica := range ranked {
+			if _, ok := averages[replica.NodeID]; !ok {
+				averages[replica.NodeID] = measured / time.Duration(measuredCount)
+			}
+		}
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := averages[ranked[i].NodeID], averages[ranked[j].NodeID]
+		if a != b {
+			return a < b
+		}
+		return ranked[i].ReplicaType == "primary" && ranked[j].ReplicaType != "primary"
+	})
+	return ranked
+}
 
-	// Return first replica if no active nodes found (will fail but at least we try)
-	if len(replicas) > 0 {
-		return replicas[0]
+// countReadable counts the replicas on nodes that serve reads
+func countReadable(replicas []*dynamodb.ChunkMetadata, nodeMap map[string]*dynamodb.NodeInfo) int {
+	readable := 0
+	for _, replica := range replicas {
+		if node, ok := nodeMap[replica.NodeID]; ok && servesReads(node) {
+			readable++
+		}
 	}
+	return readable
+}
 
-	return nil
+// servesReads reports whether a node's chunks can be read: active nodes and draining
+// nodes whose replicas have not all moved away yet
+func servesReads(node *dynamodb.NodeInfo) bool {
+	return node.Status == dynamodb.NodeStatusActive || node.Status == dynamodb.NodeStatusDraining
 }
 
 // getAPIBaseURL constructs the API server base URL from the request
@@ -274,30 +692,44 @@ func HandleProxyChunkUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Look up node information from DynamoDB
+	// Look up node information from the node directory
 	ctx := context.Background()
-	node, err := apiServer.dbClient.GetNode(ctx, apiServer.cfg.NodeRegistryTable, nodeID)
+	node, err := apiServer.nodes.Node(ctx, nodeID)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to get node info: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Read chunk data from request body
-	chunkData, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to read chunk data: %v", err), http.StatusInternalServerError)
+	// Chunks may be no larger than the upload plan allows
+	file, err := apiServer.store.GetFileMetadata(ctx, apiServer.cfg.FileMetadataTable, fileID)
+	if errors.Is(err, dynamodb.ErrNotFound) {
+		file = nil // No manifest to size the chunk by, so MAX_CHUNK_SIZE applies
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get file: %v", err), http.StatusInternalServerError)
+		return
+	}
+	limit := file.ChunkSizeLimit(int64(apiServer.cfg.MaxChunkSize))
+	if r.ContentLength > limit {
+		http.Error(w, fmt.Sprintf("chunk of %d bytes exceeds the limit of %d bytes", r.ContentLength, limit), http.StatusRequestEntityTooLarge)
 		return
 	}
 
-	// Construct node URL
+	// Construct node URL; the primary replicates to any secondaries before acknowledging
 	nodeURL := fmt.Sprintf("http://%s:%d/store-chunk?file_id=%s&chunk_index=%s", node.PrivateIP, node.Port, fileID, chunkIndexStr)
+	if replicas := r.URL.Query().Get("replicas"); replicas != "" {
+		nodeURL += "&replica_type=primary&replicas=" + replicas
+	}
+	if shardIndex := r.URL.Query().Get("shard_index"); shardIndex != "" {
+		nodeURL += "&replica_type=shard&shard_index=" + shardIndex
+	}
 
-	// Create request to forward to node
-	req, err := http.NewRequest(http.MethodPut, nodeURL, bytes.NewReader(chunkData))
+	// Stream the chunk through to the node instead of buffering it
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPut, nodeURL, http.MaxBytesReader(w, r.Body, limit))
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create request: %v", err), http.StatusInternalServerError)
 		return
 	}
+	req.ContentLength = r.ContentLength
 
 	// Copy checksum header if present
 	if checksum := r.Header.Get("X-Chunk-Checksum"); checksum != "" {
@@ -310,6 +742,15 @@ func HandleProxyChunkUpload(w http.ResponseWriter, r *http.Request) {
 	}
 	resp, err := client.Do(req)
 	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("chunk exceeds the limit of %d bytes", limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		// A client that went away mid-upload says nothing about the node
+		if r.Context().Err() == nil {
+			apiServer.nodes.Invalidate(nodeID)
+		}
 		http.Error(w, fmt.Sprintf("Failed to forward request to node: %v", err), http.StatusBadGateway)
 		return
 	}
@@ -356,23 +797,67 @@ func HandleProxyChunkDownload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Look up node information from DynamoDB
-	ctx := context.Background()
-	node, err := apiServer.dbClient.GetNode(ctx, apiServer.cfg.NodeRegistryTable, nodeID)
+	// Look up node information from the node directory
+	ctx := r.Context()
+	node, err := apiServer.nodes.Node(ctx, nodeID)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to get node info: %v", err), http.StatusInternalServerError)
 		return
 	}
 
+	// With a read quorum, compare the replica against others before answering; a
+	// replica alone never satisfies it, so a missing replicas list fails the read.
+	// Shards of a stripe differ from each other, so a shard is checked against the
+	// checksum the plan recorded for it instead.
+	if apiServer.cfg.ReadQuorum > 1 {
+		chunkIndex, err := strconv.Atoi(chunkIndexStr)
+		if err != nil {
+			http.Error(w, "invalid chunk_index", http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Has("shard_index") {
+			key, err := chunkstore.ParseKey(r.URL.Query().Get("checksum"))
+			if err != nil {
+				http.Error(w, "shard reads need a valid checksum", http.StatusBadRequest)
+				return
+			}
+			serveVerifiedRead(ctx, w, node, fileID, chunkIndex, key)
+			return
+		}
+		replicas := r.URL.Query().Get("replicas")
+		serveQuorumRead(ctx, w, fileID, chunkIndex, append([]*dynamodb.NodeInfo{node}, quorumNodes(ctx, replicas)...))
+		return
+	}
+
 	// Construct node URL
 	nodeURL := fmt.Sprintf("http://%s:%d/get-chunk?file_id=%s&chunk_index=%s", node.PrivateIP, node.Port, fileID, chunkIndexStr)
+	if checksum := r.URL.Query().Get("checksum"); checksum != "" {
+		// The plan knows the replica's checksum, which spares the node a metadata lookup
+		key, err := chunkstore.ParseKey(checksum)
+		if err != nil {
+			http.Error(w, "invalid checksum", http.StatusBadRequest)
+			return
+		}
+		nodeURL += "&checksum=" + key.String()
+	}
 
 	// Forward request to storage node
 	client := &http.Client{
 		Timeout: 30 * time.Second,
 	}
-	resp, err := client.Get(nodeURL)
+	started := time.Now()
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, nodeURL, nil)
 	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create request: %v", err), http.StatusInternalServerError)
+		return
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		// A hedged read whose twin answered first is cancelled by the client; the node is fine
+		if r.Context().Err() == nil {
+			apiServer.nodes.Invalidate(nodeID)
+		}
+		observeRead(r.Context(), nodeID, started, false)
 		http.Error(w, fmt.Sprintf("Failed to forward request to node: %v", err), http.StatusBadGateway)
 		return
 	}
@@ -388,10 +873,123 @@ func HandleProxyChunkDownload(w http.ResponseWriter, r *http.Request) {
 	// Set response status
 	w.WriteHeader(resp.StatusCode)
 
-	// Copy response body
+	// Copy response body; the response has already started, so errors are only recorded
 	_, err = io.Copy(w, resp.Body)
+	observeRead(r.Context(), nodeID, started, err == nil && resp.StatusCode == http.StatusOK)
+}
+
+// observeRead records a proxied read's latency. Reads abandoned by the client count as
+// taking at least as long as they ran, failed reads are penalized.
+func observeRead(ctx context.Context, nodeID string, started time.Time, ok bool) {
+	elapsed := time.Since(started)
+	switch {
+	case ok:
+		apiServer.latency.Observe(nodeID, elapsed)
+	case ctx.Err() != nil:
+		apiServer.latency.ObserveCancelled(nodeID, elapsed)
+	default:
+		apiServer.latency.ObserveFailure(nodeID, elapsed)
+	}
+}
+
+// quorumNodes resolves a comma-separated list of node IDs, skipping unknown nodes
+func quorumNodes(ctx context.Context, nodeIDs string) []*dynamodb.NodeInfo {
+	var nodes []*dynamodb.NodeInfo
+	for _, nodeID := range strings.Split(nodeIDs, ",") {
+		if nodeID == "" {
+			continue
+		}
+		node, err := apiServer.nodes.Node(ctx, nodeID)
+		if err != nil {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+type replicaRead struct {
+	node     *dynamodb.NodeInfo
+	data     []byte
+	checksum string
+	err      error
+}
+
+// serveVerifiedRead reads a body from one node and serves it only if it matches key
+func serveVerifiedRead(ctx context.Context, w http.ResponseWriter, node *dynamodb.NodeInfo, fileID string, chunkIndex int, key chunkstore.Key) {
+	started := time.Now()
+	data, err := readChunk(ctx, node, fileID, chunkIndex, key.String())
+	observeRead(ctx, node.NodeID, started, err == nil)
 	if err != nil {
-		// Response already started, can't send error
+		http.Error(w, fmt.Sprintf("Failed to read chunk from node: %v", err), http.StatusBadGateway)
+		return
+	}
+	if checksum := chunkstore.KeyOf(data); checksum != key {
+		fmt.Printf("Warning: Chunk %d of %s on %s does not match its checksum (%s != %s)\n", chunkIndex, fileID, node.NodeID, checksum, key)
+		http.Error(w, "chunk does not match its checksum", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("X-Chunk-Checksum", key.String())
+	w.Write(data)
+}
+
+// serveQuorumRead reads a chunk from ReadQuorum of the given nodes, trying them in order,
+// and serves the data whose checksum a majority of those replicas agree on
+func serveQuorumRead(ctx context.Context, w http.ResponseWriter, fileID string, chunkIndex int, nodes []*dynamodb.NodeInfo) {
+	quorum := apiServer.cfg.ReadQuorum
+
+	var reads []replicaRead
+	pending := nodes
+	for len(reads) < quorum && len(pending) > 0 {
+		batch := pending[:min(quorum-len(reads), len(pending))]
+		pending = pending[len(batch):]
+
+		results := make(chan replicaRead, len(batch))
+		for _, node := range batch {
+			go func(node *dynamodb.NodeInfo) {
+				started := time.Now()
+				// Without a checksum each node serves whatever its own replica holds, so a
+				// diverging replica is outvoted rather than missing
+				data, err := readChunk(ctx, node, fileID, chunkIndex, "")
+				observeRead(ctx, node.NodeID, started, err == nil)
+				hash := sha256.Sum256(data)
+				results <- replicaRead{node, data, hex.EncodeToString(hash[:]), err}
+			}(node)
+		}
+		for range batch {
+			read := <-results
+			if read.err != nil {
+				fmt.Printf("Warning: Quorum read of chunk %d of %s: %v\n", chunkIndex, fileID, read.err)
+				continue
+			}
+			reads = append(reads, read)
+		}
+	}
+
+	if len(reads) < quorum {
+		http.Error(w, fmt.Sprintf("read quorum not met: %d of %d replicas answered", len(reads), quorum), http.StatusServiceUnavailable)
+		return
+	}
+
+	votes := make(map[string]int)
+	var winner replicaRead
+	for _, read := range reads {
+		votes[read.checksum]++
+		if votes[read.checksum] > votes[winner.checksum] {
+			winner = read
+		}
+	}
+	if votes[winner.checksum]*2 <= len(reads) {
+		http.Error(w, fmt.Sprintf("replicas disagree: no checksum is held by a majority of %d replicas", len(reads)), http.StatusBadGateway)
 		return
 	}
+	for _, read := range reads {
+		if read.checksum != winner.checksum {
+			fmt.Printf("Warning: Replica of chunk %d of %s on %s disagrees with the majority (%s != %s)\n", chunkIndex, fileID, read.node.NodeID, read.checksum, winner.checksum)
+		}
+	}
+
+	w.Header().Set("X-Chunk-Checksum", winner.checksum)
+	w.Write(winner.data)
 }
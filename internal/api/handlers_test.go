@@ -0,0 +1,41 @@
+package api
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/timskillet/distributed-filestore/internal/client"
+	"github.com/timskillet/distributed-filestore/internal/config"
+)
+
+func TestDownloadErasureCodedWithReadQuorum(t *testing.T) {
+	s, apiURL := newTestServer(t, func(cfg *config.Config) { cfg.ReadQuorum = 2 })
+	nodes := []*fakeNode{
+		addFakeNode(t, s, "node-a"),
+		addFakeNode(t, s, "node-b"),
+		addFakeNode(t, s, "node-c"),
+	}
+	data := bytes.Repeat([]byte("erasure-coded chunk "), 100)
+	fileID := storeStripe(t, s, data, 2, 1, nodes)
+
+	// A rotted shard must be refused by the proxy and rebuilt from the others
+	for checksum, shard := range nodes[0].bodies {
+		rotted := bytes.Clone(shard)
+		rotted[0] ^= 0xff
+		nodes[0].bodies[checksum] = rotted
+	}
+
+	out := filepath.Join(t.TempDir(), "out")
+	if err := client.DownloadFile(apiURL, fileID, out); err != nil {
+		t.Fatalf("DownloadFile: %v", err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("downloaded %d bytes that differ from the %d stored", len(got), len(data))
+	}
+}
@@ -0,0 +1,208 @@
+package api
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/timskillet/distributed-filestore/internal/chunkstore"
+	"github.com/timskillet/distributed-filestore/internal/config"
+	"github.com/timskillet/distributed-filestore/internal/dynamodb"
+	"github.com/timskillet/distributed-filestore/internal/erasure"
+)
+
+// newTestServer starts an API server on the memory metadata backend and installs it
+// as apiServer. configure may adjust the configuration before the server is built.
+func newTestServer(t *testing.T, configure func(cfg *config.Config)) (*Server, string) {
+	t.Helper()
+	t.Setenv("METADATA_BACKEND", "memory")
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.PlacementReserveMB = 0
+	if configure != nil {
+		configure(cfg)
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetServer(s)
+	t.Cleanup(func() { SetServer(nil) })
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/download-plan", HandleDownloadPlan)
+	mux.HandleFunc("/proxy-chunk-download", HandleProxyChunkDownload)
+	api := httptest.NewServer(mux)
+	t.Cleanup(api.Close)
+	return s, api.URL
+}
+
+// fakeNode is a storage node that keeps bodies in memory and records replicas the way
+// a real node does
+type fakeNode struct {
+	id     string
+	server *Server
+
+	mu     sync.Mutex
+	bodies map[string][]byte // By checksum
+}
+
+// addFakeNode starts a fake storage node and registers it as active
+func addFakeNode(t *testing.T, s *Server, id string) *fakeNode {
+	t.Helper()
+	node := &fakeNode{id: id, server: s, bodies: make(map[string][]byte)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/get-chunk", node.handleGet)
+	mux.HandleFunc("/store-chunk", node.handleStore)
+	mux.HandleFunc("/delete-chunk", node.handleDelete)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNum, _ := strconv.Atoi(port)
+	err = s.store.RegisterNode(context.Background(), s.cfg.NodeRegistryTable, &dynamodb.NodeInfo{
+		NodeID:         id,
+		PrivateIP:      host,
+		Port:           portNum,
+		Status:         dynamodb.NodeStatusActive,
+		HeartbeatTS:    time.Now().Unix(),
+		AvailableSpace: 1 << 30,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+func (n *fakeNode) body(checksum string) ([]byte, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	data, ok := n.bodies[checksum]
+	return data, ok
+}
+
+func (n *fakeNode) handleGet(w http.ResponseWriter, r *http.Request) {
+	checksum := r.URL.Query().Get("checksum")
+	if checksum == "" {
+		chunkIndex, _ := strconv.Atoi(r.URL.Query().Get("chunk_index"))
+		replicas, _ := n.server.store.GetChunkReplicas(r.Context(), n.server.cfg.ChunkMetadataTable, r.URL.Query().Get("file_id"), chunkIndex)
+		for _, replica := range replicas {
+			if replica.NodeID == n.id {
+				checksum = replica.Checksum
+			}
+		}
+	}
+	data, ok := n.body(checksum)
+	if !ok {
+		http.Error(w, "chunk not found", http.StatusNotFound)
+		return
+	}
+	w.Write(data)
+}
+
+func (n *fakeNode) handleStore(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	checksum := chunkstore.KeyOf(data).String()
+	if want := r.Header.Get("X-Chunk-Checksum"); want != "" && want != checksum {
+		http.Error(w, "checksum mismatch", http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	chunkIndex, _ := strconv.Atoi(q.Get("chunk_index"))
+	shardIndex, _ := strconv.Atoi(q.Get("shard_index"))
+	replica := &dynamodb.ChunkMetadata{
+		FileID:      q.Get("file_id"),
+		ChunkIndex:  chunkIndex,
+		NodeID:      n.id,
+		Checksum:    checksum,
+		ReplicaType: q.Get("replica_type"),
+		ShardIndex:  shardIndex,
+		Size:        int64(len(data)),
+	}
+
+	n.mu.Lock()
+	n.bodies[checksum] = data
+	n.mu.Unlock()
+	table := n.server.cfg.ChunkMetadataTable
+	if from := q.Get("move_from"); from != "" {
+		err = n.server.store.MoveChunkReplica(r.Context(), table, replica, from)
+	} else {
+		err = n.server.store.PutChunkMetadata(r.Context(), table, replica)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (n *fakeNode) handleDelete(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	delete(n.bodies, r.URL.Query().Get("checksum"))
+	n.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// storeStripe erasure-codes data as a single-chunk file, puts shard i on nodes[i] and
+// finalizes the file, returning its ID
+func storeStripe(t *testing.T, s *Server, data []byte, dataShards, parityShards int, nodes []*fakeNode) string {
+	t.Helper()
+	ctx := context.Background()
+	file := &dynamodb.FileMetadata{
+		FileID:       "striped-file",
+		Size:         int64(len(data)),
+		ChunkSize:    len(data),
+		ChunkCount:   1,
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+	}
+	if err := s.store.CreateFileMetadata(ctx, s.cfg.FileMetadataTable, file); err != nil {
+		t.Fatal(err)
+	}
+
+	codec, err := erasure.New(dataShards, parityShards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards, err := codec.Encode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, shard := range shards {
+		checksum := chunkstore.KeyOf(shard).String()
+		nodes[i].mu.Lock()
+		nodes[i].bodies[checksum] = shard
+		nodes[i].mu.Unlock()
+		err := s.store.PutChunkMetadata(ctx, s.cfg.ChunkMetadataTable, &dynamodb.ChunkMetadata{
+			FileID:      file.FileID,
+			NodeID:      nodes[i].id,
+			Checksum:    checksum,
+			ReplicaType: "shard",
+			ShardIndex:  i,
+			Size:        int64(len(shard)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.store.CompleteFile(ctx, s.cfg.FileMetadataTable, file.FileID, []string{chunkstore.KeyOf(data).String()}); err != nil {
+		t.Fatal(err)
+	}
+	return file.FileID
+}
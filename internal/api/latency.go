@@ -0,0 +1,95 @@
+package api
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	latencyAlpha      = 0.2 // Weight of the newest sample in a node's moving average
+	latencyWindow     = 512 // Recent samples kept across all nodes for percentiles
+	latencyMinSamples = 20  // Samples needed before a percentile is reported
+
+	// latencyFailurePenalty is charged to a node's moving average for a read that failed
+	latencyFailurePenalty = 5 * time.Second
+)
+
+// latencyTracker records how long storage nodes take to answer chunk reads. It keeps
+// an exponentially weighted moving average per node, used to rank replicas, and a
+// window of recent samples across nodes, used to decide when to hedge a read.
+type latencyTracker struct {
+	mu      sync.Mutex
+	ewma    map[string]float64 // node ID -> milliseconds
+	samples []float64          // ring buffer of milliseconds
+	next    int
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{ewma: make(map[string]float64)}
+}
+
+// Observe records the time a node took to answer a read
+func (t *latencyTracker) Observe(nodeID string, d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.average(nodeID, ms)
+
+	if len(t.samples) < latencyWindow {
+		t.samples = append(t.samples, ms)
+	} else {
+		t.samples[t.next] = ms
+	}
+	t.next = (t.next + 1) % latencyWindow
+}
+
+// ObserveCancelled records a read abandoned after d, such as the slower half of a
+// hedged read. The node took at least d, which only counts toward its average; the
+// percentile window keeps answered reads so hedging does not feed on itself.
+func (t *latencyTracker) ObserveCancelled(nodeID string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.average(nodeID, float64(d)/float64(time.Millisecond))
+}
+
+// ObserveFailure records a read that errored or timed out after d, charging the node
+// at least latencyFailurePenalty so it ranks behind replicas that answer
+func (t *latencyTracker) ObserveFailure(nodeID string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.average(nodeID, float64(max(d, latencyFailurePenalty))/float64(time.Millisecond))
+}
+
+// average folds a sample into a node's moving average; t.mu must be held
+func (t *latencyTracker) average(nodeID string, ms float64) {
+	if avg, ok := t.ewma[nodeID]; ok {
+		t.ewma[nodeID] = latencyAlpha*ms + (1-latencyAlpha)*avg
+	} else {
+		t.ewma[nodeID] = ms
+	}
+}
+
+// Average returns a node's moving average latency, or false if it has not been read from
+func (t *latencyTracker) Average(nodeID string) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	avg, ok := t.ewma[nodeID]
+	return time.Duration(avg * float64(time.Millisecond)), ok
+}
+
+// Percentile returns the p-th percentile of recent read latencies across all nodes,
+// or zero until enough reads have been observed
+func (t *latencyTracker) Percentile(p int) time.Duration {
+	t.mu.Lock()
+	sorted := append([]float64(nil), t.samples...)
+	t.mu.Unlock()
+
+	if len(sorted) < latencyMinSamples {
+		return 0
+	}
+	sort.Float64s(sorted)
+	i := min(len(sorted)*p/100, len(sorted)-1)
+	return time.Duration(sorted[i] * float64(time.Millisecond))
+}
@@ -0,0 +1,234 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/timskillet/distributed-filestore/internal/config"
+	"github.com/timskillet/distributed-filestore/internal/dynamodb"
+	"github.com/timskillet/distributed-filestore/internal/metadata"
+)
+
+// NodeDirectory is an in-memory view of the node registry. Request handlers read
+// nodes from it instead of hitting the registry on every request; a background loop
+// reloads it, and registrations and heartbeats that pass through this process
+// update it immediately.
+type NodeDirectory struct {
+	store metadata.MetadataStore
+	cfg   *config.Config
+
+	mu       sync.RWMutex
+	nodes    map[string]*dynamodb.NodeInfo
+	loadedAt time.Time
+	stale    bool // reload before the next ActiveNodes call
+}
+
+func NewNodeDirectory(store metadata.MetadataStore, cfg *config.Config) *NodeDirectory {
+	return &NodeDirectory{
+		store: store,
+		cfg:   cfg,
+		nodes: make(map[string]*dynamodb.NodeInfo),
+		stale: true,
+	}
+}
+
+// Run reloads the directory every NodeDirectoryRefresh seconds until ctx is cancelled
+func (d *NodeDirectory) Run(ctx context.Context) {
+	if err := d.Refresh(ctx); err != nil {
+		fmt.Printf("Warning: Failed to load node directory: %v\n", err)
+	}
+
+	ticker := time.NewTicker(time.Duration(d.cfg.NodeDirectoryRefresh) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := d.Refresh(ctx); err != nil {
+				fmt.Printf("Warning: Failed to refresh node directory: %v\n", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Refresh replaces the directory with the registry's current active and draining nodes
+func (d *NodeDirectory) Refresh(ctx context.Context) error {
+	timeout := int64(d.cfg.NodeHeartbeatTimeout)
+	nodes, err := d.store.ListActiveNodes(ctx, d.cfg.NodeRegistryTable, timeout)
+	if err != nil {
+		return err
+	}
+	draining, err := d.store.ListNodesByStatus(ctx, d.cfg.NodeRegistryTable, dynamodb.NodeStatusDraining, timeout)
+	if err != nil {
+		return err
+	}
+	nodes = append(nodes, draining...)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fresh := make(map[string]*dynamodb.NodeInfo, len(nodes))
+	for _, node := range nodes {
+		// A heartbeat observed while the reload was in flight is newer than the registry read
+		if cached, ok := d.nodes[node.NodeID]; ok && cached.HeartbeatTS > node.HeartbeatTS {
+			node = cached
+		}
+		fresh[node.NodeID] = node
+	}
+	d.nodes = fresh
+	d.loadedAt = time.Now()
+	d.stale = false
+	return nil
+}
+
+// ActiveNodes returns nodes that accept new chunks: active and heartbeated within
+// the timeout, sorted by node ID
+func (d *NodeDirectory) ActiveNodes(ctx context.Context) ([]*dynamodb.NodeInfo, error) {
+	return d.liveNodes(ctx, dynamodb.NodeStatusActive)
+}
+
+// ReadableNodes returns nodes that can serve reads: active or draining and
+// heartbeated within the timeout, sorted by node ID
+func (d *NodeDirectory) ReadableNodes(ctx context.Context) ([]*dynamodb.NodeInfo, error) {
+	return d.liveNodes(ctx, dynamodb.NodeStatusActive, dynamodb.NodeStatusDraining)
+}
+
+func (d *NodeDirectory) liveNodes(ctx context.Context, statuses ...string) ([]*dynamodb.NodeInfo, error) {
+	d.mu.RLock()
+	stale := d.stale
+	d.mu.RUnlock()
+	if stale {
+		if err := d.Refresh(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	cutoff := time.Now().Unix() - int64(d.cfg.NodeHeartbeatTimeout)
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var live []*dynamodb.NodeInfo
+	for _, node := range d.nodes {
+		if node.HeartbeatTS >= cutoff && slices.Contains(statuses, node.Status) {
+			n := *node
+			live = append(live, &n)
+		}
+	}
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].NodeID < live[j].NodeID
+	})
+	return live, nil
+}
+
+// Node returns a single node, reading through to the registry on a miss
+func (d *NodeDirectory) Node(ctx context.Context, nodeID string) (*dynamodb.NodeInfo, error) {
+	d.mu.RLock()
+	cached, ok := d.nodes[nodeID]
+	d.mu.RUnlock()
+	if ok {
+		n := *cached
+		return &n, nil
+	}
+
+	node, err := d.store.GetNode(ctx, d.cfg.NodeRegistryTable, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	d.observe(node)
+	return node, nil
+}
+
+// Invalidate drops a node whose cached address stopped working and forces the next
+// ActiveNodes call to reload from the registry
+func (d *NodeDirectory) Invalidate(nodeID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.nodes, nodeID)
+	d.stale = true
+}
+
+// LoadedAt returns when the directory was last reloaded from the registry
+func (d *NodeDirectory) LoadedAt() time.Time {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.loadedAt
+}
+
+func (d *NodeDirectory) observe(node *dynamodb.NodeInfo) {
+	n := *node
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nodes[n.NodeID] = &n
+}
+
+func (d *NodeDirectory) heartbeat(nodeID string, ts int64, availableSpace int64, disks []dynamodb.DiskInfo) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	node, ok := d.nodes[nodeID]
+	if !ok {
+		// A node we have not seen yet; pick it up on the next read
+		d.stale = true
+		return
+	}
+	node.HeartbeatTS = ts
+	if node.Status == "" {
+		node.Status = dynamodb.NodeStatusActive
+	}
+	if availableSpace >= 0 {
+		node.AvailableSpace = availableSpace
+	}
+	if disks != nil {
+		node.Disks = append([]dynamodb.DiskInfo(nil), disks...)
+	}
+}
+
+func (d *NodeDirectory) setStatus(nodeID string, status string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if node, ok := d.nodes[nodeID]; ok {
+		node.Status = status
+	} else {
+		d.stale = true
+	}
+}
+
+// directoryStore keeps the node directory current when node registry writes go
+// through this process, as they do when dfs-api serves the metadata backend
+type directoryStore struct {
+	metadata.MetadataStore
+	dir *NodeDirectory
+}
+
+func (s *directoryStore) RegisterNode(ctx context.Context, tableName string, node *dynamodb.NodeInfo) error {
+	if err := s.MetadataStore.RegisterNode(ctx, tableName, node); err != nil {
+		return err
+	}
+	if tableName == s.dir.cfg.NodeRegistryTable {
+		s.dir.observe(node)
+	}
+	return nil
+}
+
+func (s *directoryStore) SetNodeStatus(ctx context.Context, tableName string, nodeID string, status string) error {
+	if err := s.MetadataStore.SetNodeStatus(ctx, tableName, nodeID, status); err != nil {
+		return err
+	}
+	if tableName == s.dir.cfg.NodeRegistryTable {
+		s.dir.setStatus(nodeID, status)
+	}
+	return nil
+}
+
+func (s *directoryStore) UpdateHeartbeat(ctx context.Context, tableName string, nodeID string, availableSpace int64, disks []dynamodb.DiskInfo) error {
+	if err := s.MetadataStore.UpdateHeartbeat(ctx, tableName, nodeID, availableSpace, disks); err != nil {
+		return err
+	}
+	if tableName == s.dir.cfg.NodeRegistryTable {
+		s.dir.heartbeat(nodeID, time.Now().Unix(), availableSpace, disks)
+	}
+	return nil
+}
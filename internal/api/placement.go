@@ -0,0 +1,238 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/timskillet/distributed-filestore/internal/config"
+	"github.com/timskillet/distributed-filestore/internal/dynamodb"
+)
+
+// PlacementRequest describes one chunk that needs replica locations
+type PlacementRequest struct {
+	FileID      string
+	ChunkIndex  int
+	Count       int                  // replicas to place
+	Nodes       []*dynamodb.NodeInfo // candidates, already above the free-space reserve
+	UsedDomains map[string]bool      // failure domains that already hold the chunk
+}
+
+// PlacementPolicy chooses which nodes hold a chunk's replicas
+type PlacementPolicy interface {
+	// Place returns up to req.Count distinct nodes from req.Nodes, primary first
+	Place(req PlacementRequest) []*dynamodb.NodeInfo
+}
+
+// NewPlacementPolicy returns the policy named by cfg.PlacementPolicy
+func NewPlacementPolicy(cfg *config.Config) (PlacementPolicy, error) {
+	reserve := int64(cfg.PlacementReserveMB) << 20
+	switch cfg.PlacementPolicy {
+	case "weighted":
+		return &weightedPolicy{
+			reserve: reserve,
+			rng:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		}, nil
+	case "rendezvous":
+		return rendezvousPolicy{}, nil
+	default:
+		return nil, fmt.Errorf("unknown placement policy: %s", cfg.PlacementPolicy)
+	}
+}
+
+// weightedPolicy draws nodes at random, weighted by free space
+type weightedPolicy struct {
+	reserve int64
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func (p *weightedPolicy) Place(req PlacementRequest) []*dynamodb.NodeInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return selectNodesForChunk(req.Nodes, req.Count, p.reserve, req.UsedDomains, p.rng)
+}
+
+// rendezvousPolicy ranks nodes by a hash of (file_id, chunk_index, node_id), so any
+// API instance with the same node list computes the same replicas, and adding or
+// removing a node only moves the chunks that rank it among their top choices
+type rendezvousPolicy struct{}
+
+func (rendezvousPolicy) Place(req PlacementRequest) []*dynamodb.NodeInfo {
+	return RendezvousNodes(req.FileID, req.ChunkIndex, req.Nodes, req.Count, req.UsedDomains)
+}
+
+// RendezvousNodes returns the count highest-ranked nodes for a chunk, taking them
+// from distinct failure domains (beyond usedDomains) while one is available
+func RendezvousNodes(fileID string, chunkIndex int, nodes []*dynamodb.NodeInfo, count int, usedDomains map[string]bool) []*dynamodb.NodeInfo {
+	ranked := make([]*dynamodb.NodeInfo, len(nodes))
+	copy(ranked, nodes)
+	scores := make(map[string]uint64, len(nodes))
+	for _, node := range ranked {
+		scores[node.NodeID] = rendezvousScore(fileID, chunkIndex, node.NodeID)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		si, sj := scores[ranked[i].NodeID], scores[ranked[j].NodeID]
+		if si != sj {
+			return si > sj
+		}
+		return ranked[i].NodeID < ranked[j].NodeID
+	})
+
+	used := make(map[string]bool)
+	for domain := range usedDomains {
+		used[domain] = true
+	}
+	taken := make(map[string]bool)
+	selected := make([]*dynamodb.NodeInfo, 0, count)
+
+	// First pass spreads across domains; second pass fills from whatever is left
+	for _, spread := range []bool{true, false} {
+		for _, node := range ranked {
+			if len(selected) == count {
+				return selected
+			}
+			if taken[node.NodeID] {
+				continue
+			}
+			if spread && node.FailureDomain != "" && used[node.FailureDomain] {
+				continue
+			}
+			selected = append(selected, node)
+			taken[node.NodeID] = true
+			if node.FailureDomain != "" {
+				used[node.FailureDomain] = true
+			}
+		}
+	}
+	return selected
+}
+
+func rendezvousScore(fileID string, chunkIndex int, nodeID string) uint64 {
+	sum := sha256.Sum256([]byte(fileID + "#" + strconv.Itoa(chunkIndex) + "#" + nodeID))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// nodesAboveReserve drops nodes whose reported free space is at or below reserve,
+// and multi-disk nodes none of whose disks is healthy. Nodes that have not reported
+// free space (AvailableSpace -1) are kept.
+func nodesAboveReserve(nodes []*dynamodb.NodeInfo, reserve int64) []*dynamodb.NodeInfo {
+	var eligible []*dynamodb.NodeInfo
+	for _, node := range nodes {
+		if !hasHealthyDisk(node) {
+			continue
+		}
+		if node.AvailableSpace < 0 || node.AvailableSpace > reserve {
+			eligible = append(eligible, node)
+		}
+	}
+	return eligible
+}
+
+// hasHealthyDisk reports whether a node can store chunks on at least one disk.
+// Nodes that do not report disks are assumed to.
+func hasHealthyDisk(node *dynamodb.NodeInfo) bool {
+	for _, disk := range node.Disks {
+		if disk.Healthy {
+			return true
+		}
+	}
+	return len(node.Disks) == 0
+}
+
+// selectNodesForChunk selects N distinct nodes for replication, each drawn with
+// probability proportional to its free space above the reserve. Each pick comes from
+// a failure domain not yet holding the chunk (including usedDomains) while one is
+// available, so losing a zone or rack cannot take out every replica.
+func selectNodesForChunk(nodes []*dynamodb.NodeInfo, count int, reserve int64, usedDomains map[string]bool, rng *rand.Rand) []*dynamodb.NodeInfo {
+	if len(nodes) <= count {
+		return nodes
+	}
+
+	weights := placementWeights(nodes, reserve)
+	remaining := make([]*dynamodb.NodeInfo, len(nodes))
+	copy(remaining, nodes)
+
+	used := make(map[string]bool)
+	for domain := range usedDomains {
+		used[domain] = true
+	}
+
+	selected := make([]*dynamodb.NodeInfo, 0, count)
+	for len(selected) < count {
+		// Only draw from unused domains while any remain; unlabeled nodes always qualify
+		spread := false
+		for _, node := range remaining {
+			if node.FailureDomain == "" || !used[node.FailureDomain] {
+				spread = true
+				break
+			}
+		}
+		eligible := func(node *dynamodb.NodeInfo) bool {
+			return !spread || node.FailureDomain == "" || !used[node.FailureDomain]
+		}
+
+		var total float64
+		for i, w := range weights {
+			if eligible(remaining[i]) {
+				total += w
+			}
+		}
+		pick := -1
+		r := rng.Float64() * total
+		for i, w := range weights {
+			if !eligible(remaining[i]) {
+				continue
+			}
+			pick = i
+			if r < w {
+				break
+			}
+			r -= w
+		}
+
+		selected = append(selected, remaining[pick])
+		if domain := remaining[pick].FailureDomain; domain != "" {
+			used[domain] = true
+		}
+		remaining = append(remaining[:pick], remaining[pick+1:]...)
+		weights = append(weights[:pick], weights[pick+1:]...)
+	}
+
+	return selected
+}
+
+// placementWeights scores each node by its free space above the reserve. Nodes that
+// have not reported free space get the average score so they are neither starved nor
+// favored.
+func placementWeights(nodes []*dynamodb.NodeInfo, reserve int64) []float64 {
+	var known float64
+	var knownCount int
+	for _, node := range nodes {
+		if node.AvailableSpace >= 0 {
+			known += float64(max(node.AvailableSpace-reserve, 0))
+			knownCount++
+		}
+	}
+	unknown := 1.0
+	if knownCount > 0 && known > 0 {
+		unknown = known / float64(knownCount)
+	}
+
+	weights := make([]float64, len(nodes))
+	for i, node := range nodes {
+		if node.AvailableSpace < 0 {
+			weights[i] = unknown
+			continue
+		}
+		// Keep a floor so a node pushed under the reserve by this plan can still be drawn
+		weights[i] = max(float64(node.AvailableSpace-reserve), 1)
+	}
+	return weights
+}
@@ -0,0 +1,327 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/timskillet/distributed-filestore/internal/dynamodb"
+)
+
+// RebalanceMove is one chunk replica relocation in a rebalance plan
+type RebalanceMove struct {
+	FileID     string `json:"file_id"`
+	ChunkIndex int    `json:"chunk_index"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+	Bytes      int64  `json:"bytes"`
+	State      string `json:"state"` // "planned", "done" or "failed"
+	Error      string `json:"error,omitempty"`
+}
+
+// RebalanceStatus reports planned versus completed moves of the current or most recent rebalance
+type RebalanceStatus struct {
+	Running        bool             `json:"running"`
+	LastStarted    int64            `json:"last_started,omitempty"`
+	LastFinished   int64            `json:"last_finished,omitempty"`
+	NodeBytes      map[string]int64 `json:"node_bytes,omitempty"` // Stored bytes per node when the plan was made
+	PlannedMoves   int              `json:"planned_moves"`
+	CompletedMoves int              `json:"completed_moves"`
+	FailedMoves    int              `json:"failed_moves"`
+	BytesPlanned   int64            `json:"bytes_planned"`
+	BytesMoved     int64            `json:"bytes_moved"`
+	Moves          []RebalanceMove  `json:"moves,omitempty"`
+	LastError      string           `json:"last_error,omitempty"`
+}
+
+var errRebalanceRunning = errors.New("a rebalance is already running")
+
+// Rebalancer moves chunk replicas from nodes holding more than their share of data
+// to nodes holding less, such as nodes that joined after most data was written
+type Rebalancer struct {
+	server *Server
+
+	mu     sync.Mutex
+	status RebalanceStatus
+}
+
+func NewRebalancer(s *Server) *Rebalancer {
+	return &Rebalancer{server: s}
+}
+
+// Status returns a snapshot of the current or most recent rebalance
+func (b *Rebalancer) Status() RebalanceStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := b.status
+	status.Moves = append([]RebalanceMove(nil), b.status.Moves...)
+	if b.status.NodeBytes != nil {
+		status.NodeBytes = make(map[string]int64, len(b.status.NodeBytes))
+		for nodeID, bytes := range b.status.NodeBytes {
+			status.NodeBytes[nodeID] = bytes
+		}
+	}
+	return status
+}
+
+// Start plans a rebalance and executes it in the background
+func (b *Rebalancer) Start(ctx context.Context) error {
+	b.mu.Lock()
+	if b.status.Running {
+		b.mu.Unlock()
+		return errRebalanceRunning
+	}
+	b.status = RebalanceStatus{Running: true, LastStarted: time.Now().Unix()}
+	b.mu.Unlock()
+
+	go func() {
+		err := b.rebalance(ctx)
+
+		b.mu.Lock()
+		b.status.Running = false
+		b.status.LastFinished = time.Now().Unix()
+		if err != nil {
+			b.status.LastError = err.Error()
+		}
+		b.mu.Unlock()
+
+		if err != nil {
+			fmt.Printf("Warning: Rebalance failed: %v\n", err)
+		}
+	}()
+	return nil
+}
+
+func (b *Rebalancer) rebalance(ctx context.Context) error {
+	nodes, err := b.server.nodes.ActiveNodes(ctx)
+	if err != nil {
+		return err
+	}
+
+	moves, nodeBytes, err := b.plan(ctx, nodes)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.status.NodeBytes = nodeBytes
+	b.status.Moves = moves
+	b.status.PlannedMoves = len(moves)
+	for _, move := range moves {
+		b.status.BytesPlanned += move.Bytes
+	}
+	b.mu.Unlock()
+
+	nodeMap := make(map[string]*dynamodb.NodeInfo)
+	for _, node := range nodes {
+		nodeMap[node.NodeID] = node
+	}
+
+	for i := range moves {
+		if err := b.server.moveLimiter.Wait(ctx, moves[i].Bytes); err != nil {
+			return err
+		}
+
+		move := moves[i]
+		_, moveErr := moveReplica(ctx, b.server, move.FileID, move.ChunkIndex, nodeMap[move.From], nodeMap[move.To])
+
+		b.mu.Lock()
+		if moveErr != nil {
+			b.status.Moves[i].State = "failed"
+			b.status.Moves[i].Error = moveErr.Error()
+			b.status.FailedMoves++
+		} else {
+			b.status.Moves[i].State = "done"
+			b.status.CompletedMoves++
+			b.status.BytesMoved += moves[i].Bytes
+		}
+		b.mu.Unlock()
+	}
+
+	return nil
+}
+
+// plan greedily moves chunks from the fullest node to the emptiest eligible one until
+// every node is within RebalanceThreshold percent of the mean stored bytes
+func (b *Rebalancer) plan(ctx context.Context, nodes []*dynamodb.NodeInfo) ([]RebalanceMove, map[string]int64, error) {
+	cfg := b.server.cfg
+	if len(nodes) < 2 {
+		return nil, nil, nil
+	}
+
+	stored := make(map[string]int64)
+	chunksByNode := make(map[string][]*dynamodb.ChunkMetadata)
+	holders := make(map[string]map[string]bool) // file_id#chunk_index -> node IDs
+	fileChunkSizes := make(map[string]int64)
+	var total int64
+
+	for _, node := range nodes {
+		stored[node.NodeID] = 0
+		for chunk, err := range b.server.store.IterChunksByNodeID(ctx, cfg.ChunkMetadataTable, node.NodeID) {
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to list chunks on %s: %w", node.NodeID, err)
+			}
+			if chunk.Size == 0 {
+				chunk.Size = b.fallbackChunkSize(ctx, chunk.FileID, fileChunkSizes)
+			}
+			stored[node.NodeID] += chunk.Size
+			total += chunk.Size
+			chunksByNode[node.NodeID] = append(chunksByNode[node.NodeID], chunk)
+
+			key := chunkKey(chunk.FileID, chunk.ChunkIndex)
+			if holders[key] == nil {
+				holders[key] = make(map[string]bool)
+			}
+			holders[key][node.NodeID] = true
+		}
+	}
+
+	nodeBytes := make(map[string]int64, len(stored))
+	for nodeID, bytes := range stored {
+		nodeBytes[nodeID] = bytes
+	}
+
+	mean := total / int64(len(nodes))
+	slack := mean * int64(cfg.RebalanceThreshold) / 100
+	reserve := int64(cfg.PlacementReserveMB) << 20
+	domains := make(map[string]string)
+	for _, node := range nodes {
+		domains[node.NodeID] = node.FailureDomain
+	}
+
+	var moves []RebalanceMove
+	for {
+		// Fullest node that is over the band gives up a chunk
+		sort.Slice(nodes, func(i, j int) bool {
+			return stored[nodes[i].NodeID] > stored[nodes[j].NodeID]
+		})
+		src := nodes[0]
+		if stored[src.NodeID] <= mean+slack {
+			break
+		}
+
+		moved := false
+		chunks := chunksByNode[src.NodeID]
+		for ci, chunk := range chunks {
+			key := chunkKey(chunk.FileID, chunk.ChunkIndex)
+			// Emptiest node that can take it without worsening redundancy
+			for i := len(nodes) - 1; i > 0; i-- {
+				dst := nodes[i]
+				if stored[dst.NodeID]+chunk.Size > stored[src.NodeID]-chunk.Size {
+					break // Moving would only flip the imbalance
+				}
+				if holders[key][dst.NodeID] || !acceptsChunks(dst, reserve) {
+					continue
+				}
+				if !keepsDomainSpread(holders[key], src, dst, domains) {
+					continue
+				}
+
+				moves = append(moves, RebalanceMove{
+					FileID:     chunk.FileID,
+					ChunkIndex: chunk.ChunkIndex,
+					From:       src.NodeID,
+					To:         dst.NodeID,
+					Bytes:      chunk.Size,
+					State:      "planned",
+				})
+				stored[src.NodeID] -= chunk.Size
+				stored[dst.NodeID] += chunk.Size
+				delete(holders[key], src.NodeID)
+				holders[key][dst.NodeID] = true
+				chunksByNode[src.NodeID] = append(chunks[:ci:ci], chunks[ci+1:]...)
+				chunksByNode[dst.NodeID] = append(chunksByNode[dst.NodeID], chunk)
+				moved = true
+				break
+			}
+			if moved {
+				break
+			}
+		}
+		if !moved {
+			break // Nothing on the fullest node can go anywhere
+		}
+	}
+
+	return moves, nodeBytes, nil
+}
+
+// fallbackChunkSize estimates the size of chunks recorded before ChunkMetadata carried one
+func (b *Rebalancer) fallbackChunkSize(ctx context.Context, fileID string, cache map[string]int64) int64 {
+	if size, ok := cache[fileID]; ok {
+		return size
+	}
+	var size int64 = 1
+	if file, err := b.server.store.GetFileMetadata(ctx, b.server.cfg.FileMetadataTable, fileID); err == nil && file.ChunkSize > 0 {
+		size = int64(file.ChunkSize)
+	}
+	cache[fileID] = size
+	return size
+}
+
+func chunkKey(fileID string, chunkIndex int) string {
+	return fmt.Sprintf("%s#%d", fileID, chunkIndex)
+}
+
+func acceptsChunks(node *dynamodb.NodeInfo, reserve int64) bool {
+	return len(nodesAboveReserve([]*dynamodb.NodeInfo{node}, reserve)) == 1
+}
+
+// keepsDomainSpread reports whether moving a replica from src to dst leaves the chunk
+// in at least as many distinct failure domains as before
+func keepsDomainSpread(holders map[string]bool, src, dst *dynamodb.NodeInfo, domains map[string]string) bool {
+	if dst.FailureDomain == "" || dst.FailureDomain == src.FailureDomain {
+		return true
+	}
+	for nodeID := range holders {
+		if nodeID != src.NodeID && domains[nodeID] == dst.FailureDomain {
+			return false
+		}
+	}
+	return true
+}
+
+// HandleRebalance starts a rebalance (POST)
+func HandleRebalance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method not allowed"))
+		return
+	}
+
+	if apiServer == nil || apiServer.rebalancer == nil {
+		http.Error(w, "API server not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	if err := apiServer.rebalancer.Start(context.Background()); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(apiServer.rebalancer.Status())
+}
+
+// HandleRebalanceStatus reports planned versus completed moves of the rebalancer
+func HandleRebalanceStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method not allowed"))
+		return
+	}
+
+	if apiServer == nil || apiServer.rebalancer == nil {
+		http.Error(w, "API server not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiServer.rebalancer.Status())
+}
@@ -0,0 +1,472 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/timskillet/distributed-filestore/internal/dynamodb"
+	"github.com/timskillet/distributed-filestore/internal/erasure"
+)
+
+// RepairStatus reports the progress of the re-replication daemon
+type RepairStatus struct {
+	Running        bool     `json:"running"`
+	LastStarted    int64    `json:"last_started,omitempty"`
+	LastFinished   int64    `json:"last_finished,omitempty"`
+	DeadNodes      []string `json:"dead_nodes"`
+	ChunksScanned  int      `json:"chunks_scanned"`
+	ChunksRepaired int      `json:"chunks_repaired"`
+	ChunksFailed   int      `json:"chunks_failed"`
+	ChunksLost     int      `json:"chunks_lost"` // No surviving replica to copy from
+	LastError      string   `json:"last_error,omitempty"`
+}
+
+// Repairer restores the replication factor of chunks held by nodes that stopped heartbeating
+type Repairer struct {
+	server  *Server
+	limiter *rateLimiter
+
+	mu     sync.Mutex
+	status RepairStatus
+}
+
+func NewRepairer(s *Server) *Repairer {
+	return &Repairer{
+		server:  s,
+		limiter: newRateLimiter(float64(s.cfg.RepairRate)),
+	}
+}
+
+// Run performs a repair pass every RepairInterval seconds until ctx is cancelled
+func (r *Repairer) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(r.server.cfg.RepairInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.RunOnce(ctx); err != nil {
+				fmt.Printf("Warning: Repair pass failed: %v\n", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Status returns a snapshot of the current or most recent repair pass
+func (r *Repairer) Status() RepairStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := r.status
+	status.DeadNodes = append([]string(nil), r.status.DeadNodes...)
+	return status
+}
+
+// RunOnce finds dead nodes and re-replicates every chunk they held from a surviving replica
+func (r *Repairer) RunOnce(ctx context.Context) error {
+	r.mu.Lock()
+	r.status = RepairStatus{Running: true, LastStarted: time.Now().Unix()}
+	r.mu.Unlock()
+
+	err := r.repair(ctx)
+
+	r.mu.Lock()
+	r.status.Running = false
+	r.status.LastFinished = time.Now().Unix()
+	if err != nil {
+		r.status.LastError = err.Error()
+	}
+	r.mu.Unlock()
+
+	return err
+}
+
+func (r *Repairer) repair(ctx context.Context) error {
+	cfg := r.server.cfg
+	nodes, err := r.server.store.ListNodes(ctx, cfg.NodeRegistryTable)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	liveNodes := make(map[string]*dynamodb.NodeInfo)
+	var deadNodes []*dynamodb.NodeInfo
+	for _, node := range nodes {
+		switch {
+		case now-node.HeartbeatTS > int64(cfg.NodeHeartbeatTimeout):
+			deadNodes = append(deadNodes, node)
+		case node.Status == dynamodb.NodeStatusDecommissioned:
+			// Anything still recorded on a decommissioned node had another copy when
+			// its drain finished; restore those chunks like those of a dead node
+			deadNodes = append(deadNodes, node)
+		case servesReads(node):
+			liveNodes[node.NodeID] = node
+		}
+	}
+
+	r.mu.Lock()
+	for _, node := range deadNodes {
+		r.status.DeadNodes = append(r.status.DeadNodes, node.NodeID)
+	}
+	r.mu.Unlock()
+
+	for _, dead := range deadNodes {
+		// Stream the dead node's chunks page by page so a large node doesn't have to fit in memory
+		for chunk, err := range r.server.store.IterChunksByNodeID(ctx, cfg.ChunkMetadataTable, dead.NodeID) {
+			if err != nil {
+				return fmt.Errorf("failed to list chunks on %s: %w", dead.NodeID, err)
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := r.limiter.Wait(ctx, 1); err != nil {
+				return err
+			}
+
+			r.record(r.repairChunk(ctx, chunk, liveNodes))
+		}
+	}
+
+	// Replicas a node's async replication queue gave up on are restored the same way
+	for _, node := range liveNodes {
+		failures, err := listReplicationFailures(ctx, node)
+		if err != nil {
+			fmt.Printf("Warning: Failed to list replication failures on %s: %v\n", node.NodeID, err)
+			continue
+		}
+		for _, failure := range failures {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := r.limiter.Wait(ctx, 1); err != nil {
+				return err
+			}
+			r.record(r.repairFailure(ctx, node, failure, liveNodes))
+		}
+	}
+
+	// So are replicas whose bodies a node's scrubber found damaged and could not heal
+	for _, node := range liveNodes {
+		lost, err := listScrubLosses(ctx, node)
+		if err != nil {
+			fmt.Printf("Warning: Failed to list lost replicas on %s: %v\n", node.NodeID, err)
+			continue
+		}
+		for _, replica := range lost {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := r.limiter.Wait(ctx, 1); err != nil {
+				return err
+			}
+			r.record(r.repairLoss(ctx, node, replica, liveNodes))
+		}
+	}
+
+	return nil
+}
+
+// record counts the outcome of repairing one chunk
+func (r *Repairer) record(outcome repairOutcome) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status.ChunksScanned++
+	switch outcome {
+	case repairRepaired:
+		r.status.ChunksRepaired++
+	case repairFailed:
+		r.status.ChunksFailed++
+	case repairLost:
+		r.status.ChunksLost++
+	}
+}
+
+// repairFailure restores a secondary replica that a node's replication queue could not
+// write, then removes the task from the node's queue
+func (r *Repairer) repairFailure(ctx context.Context, node *dynamodb.NodeInfo, failure replicationFailure, liveNodes map[string]*dynamodb.NodeInfo) repairOutcome {
+	missing := &dynamodb.ChunkMetadata{
+		FileID:      failure.FileID,
+		ChunkIndex:  failure.ChunkIndex,
+		NodeID:      failure.TargetNode,
+		Checksum:    failure.Checksum,
+		ReplicaType: "secondary",
+	}
+	outcome := r.replenish(ctx, missing, liveNodes)
+	if outcome == repairFailed || outcome == repairLost {
+		return outcome
+	}
+
+	if err := resolveReplicationFailure(ctx, node, failure.ID); err != nil {
+		fmt.Printf("Warning: Failed to clear replication failure %s on %s: %v\n", failure.ID, node.NodeID, err)
+		return repairFailed
+	}
+	return outcome
+}
+
+// repairLoss replaces a replica whose body its node lost, treating the node as dead
+// for that chunk, then removes the chunk from the node's lost list
+func (r *Repairer) repairLoss(ctx context.Context, node *dynamodb.NodeInfo, lost *dynamodb.ChunkMetadata, liveNodes map[string]*dynamodb.NodeInfo) repairOutcome {
+	if lost.NodeID != node.NodeID {
+		fmt.Printf("Warning: %s listed a lost replica of %s, ignoring it\n", node.NodeID, lost.NodeID)
+		return repairFailed
+	}
+	others := make(map[string]*dynamodb.NodeInfo, len(liveNodes))
+	for id, other := range liveNodes {
+		if id != node.NodeID {
+			others[id] = other
+		}
+	}
+	outcome := r.repairChunk(ctx, lost, others)
+	if outcome == repairFailed || outcome == repairLost {
+		return outcome
+	}
+
+	if err := resolveScrubLoss(ctx, node, lost.FileID, lost.ChunkIndex); err != nil {
+		fmt.Printf("Warning: Failed to clear lost replica of chunk %d of %s on %s: %v\n", lost.ChunkIndex, lost.FileID, node.NodeID, err)
+		return repairFailed
+	}
+	return outcome
+}
+
+type repairOutcome int
+
+const (
+	repairSkipped repairOutcome = iota
+	repairRepaired
+	repairFailed
+	repairLost
+)
+
+// repairChunk replaces the dead replica of a single chunk, then drops its metadata record
+func (r *Repairer) repairChunk(ctx context.Context, dead *dynamodb.ChunkMetadata, liveNodes map[string]*dynamodb.NodeInfo) repairOutcome {
+	if dead.ReplicaType == "shard" {
+		return r.repairShard(ctx, dead, liveNodes)
+	}
+
+	outcome := r.replenish(ctx, dead, liveNodes)
+	if outcome == repairFailed || outcome == repairLost {
+		return outcome
+	}
+
+	if err := r.server.store.DeleteChunkMetadata(ctx, r.server.cfg.ChunkMetadataTable, dead.FileID, dead.ChunkIndex, dead.NodeID); err != nil {
+		fmt.Printf("Warning: Failed to remove dead replica of chunk %d of %s: %v\n", dead.ChunkIndex, dead.FileID, err)
+		return repairFailed
+	}
+
+	return outcome
+}
+
+// replenish copies a chunk from a surviving replica to a new node if fewer than
+// ReplicationFactor live nodes hold it. missing describes the replica that was lost.
+func (r *Repairer) replenish(ctx context.Context, missing *dynamodb.ChunkMetadata, liveNodes map[string]*dynamodb.NodeInfo) repairOutcome {
+	cfg := r.server.cfg
+	replicas, err := r.server.store.GetChunkReplicas(ctx, cfg.ChunkMetadataTable, missing.FileID, missing.ChunkIndex)
+	if err != nil {
+		fmt.Printf("Warning: Failed to load replicas for chunk %d of %s: %v\n", missing.ChunkIndex, missing.FileID, err)
+		return repairFailed
+	}
+
+	holders := make(map[string]bool)
+	domains := make(map[string]bool)
+	var sources []*dynamodb.ChunkMetadata
+	for _, replica := range replicas {
+		holders[replica.NodeID] = true
+		if node, ok := liveNodes[replica.NodeID]; ok {
+			sources = append(sources, replica)
+			if node.FailureDomain != "" {
+				domains[node.FailureDomain] = true
+			}
+		}
+	}
+
+	if len(sources) == 0 {
+		fmt.Printf("Warning: Chunk %d of %s has no surviving replica\n", missing.ChunkIndex, missing.FileID)
+		return repairLost
+	}
+
+	outcome := repairSkipped
+	if len(sources) < cfg.ReplicationFactor {
+		var candidates []*dynamodb.NodeInfo
+		for _, node := range liveNodes {
+			// Draining nodes serve as sources but take no new replicas
+			if !holders[node.NodeID] && node.Status == dynamodb.NodeStatusActive {
+				candidates = append(candidates, node)
+			}
+		}
+		target := r.placeRepair(missing, candidates, domains)
+		if target == nil {
+			fmt.Printf("Warning: No spare node to re-replicate chunk %d of %s\n", missing.ChunkIndex, missing.FileID)
+			return repairFailed
+		}
+
+		var copyErr error
+		for _, source := range sources {
+			if _, copyErr = copyChunk(ctx, source, liveNodes[source.NodeID], target, missing.ReplicaType, ""); copyErr == nil {
+				break
+			}
+		}
+		if copyErr != nil {
+			fmt.Printf("Warning: Failed to re-replicate chunk %d of %s to %s: %v\n", missing.ChunkIndex, missing.FileID, target.NodeID, copyErr)
+			return repairFailed
+		}
+		outcome = repairRepaired
+	}
+	return outcome
+}
+
+// repairShard regenerates the dead node's shard of an erasure-coded chunk from the
+// surviving shards, stores it on a node that holds no shard of the stripe, then drops
+// the dead shard's metadata record
+func (r *Repairer) repairShard(ctx context.Context, dead *dynamodb.ChunkMetadata, liveNodes map[string]*dynamodb.NodeInfo) repairOutcome {
+	cfg := r.server.cfg
+	file, err := r.server.store.GetFileMetadata(ctx, cfg.FileMetadataTable, dead.FileID)
+	if err != nil {
+		fmt.Printf("Warning: Failed to load file %s: %v\n", dead.FileID, err)
+		return repairFailed
+	}
+	replicas, err := r.server.store.GetChunkReplicas(ctx, cfg.ChunkMetadataTable, dead.FileID, dead.ChunkIndex)
+	if err != nil {
+		fmt.Printf("Warning: Failed to load shards for chunk %d of %s: %v\n", dead.ChunkIndex, dead.FileID, err)
+		return repairFailed
+	}
+
+	holders := make(map[string]bool)
+	domains := make(map[string]bool)
+	var sources []*dynamodb.ChunkMetadata
+	regenerated := false
+	for _, replica := range replicas {
+		holders[replica.NodeID] = true
+		node, ok := liveNodes[replica.NodeID]
+		if !ok {
+			continue
+		}
+		if replica.ShardIndex == dead.ShardIndex {
+			regenerated = true // An earlier pass already rebuilt this shard
+			continue
+		}
+		sources = append(sources, replica)
+		if node.FailureDomain != "" {
+			domains[node.FailureDomain] = true
+		}
+	}
+
+	outcome := repairSkipped
+	if !regenerated {
+		if len(sources) < file.DataShards {
+			fmt.Printf("Warning: Chunk %d of %s has %d of the %d shards needed to rebuild it\n", dead.ChunkIndex, dead.FileID, len(sources), file.DataShards)
+			return repairLost
+		}
+
+		var candidates []*dynamodb.NodeInfo
+		for _, node := range liveNodes {
+			if !holders[node.NodeID] && node.Status == dynamodb.NodeStatusActive {
+				candidates = append(candidates, node)
+			}
+		}
+		target := r.placeRepair(dead, candidates, domains)
+		if target == nil {
+			fmt.Printf("Warning: No spare node to rebuild shard %d of chunk %d of %s\n", dead.ShardIndex, dead.ChunkIndex, dead.FileID)
+			return repairFailed
+		}
+
+		shard, err := rebuildShard(ctx, file, dead, sources, liveNodes)
+		if err != nil {
+			fmt.Printf("Warning: Failed to rebuild shard %d of chunk %d of %s: %v\n", dead.ShardIndex, dead.ChunkIndex, dead.FileID, err)
+			return repairFailed
+		}
+		if err := storeChunk(ctx, target, dead, shard, "shard", ""); err != nil {
+			fmt.Printf("Warning: Failed to store rebuilt shard %d of chunk %d of %s on %s: %v\n", dead.ShardIndex, dead.ChunkIndex, dead.FileID, target.NodeID, err)
+			return repairFailed
+		}
+		outcome = repairRepaired
+	}
+
+	if err := r.server.store.DeleteChunkMetadata(ctx, cfg.ChunkMetadataTable, dead.FileID, dead.ChunkIndex, dead.NodeID); err != nil {
+		fmt.Printf("Warning: Failed to remove dead shard of chunk %d of %s: %v\n", dead.ChunkIndex, dead.FileID, err)
+		return repairFailed
+	}
+
+	return outcome
+}
+
+// rebuildShard reads DataShards surviving shards of a stripe and recomputes the lost one
+func rebuildShard(ctx context.Context, file *dynamodb.FileMetadata, lost *dynamodb.ChunkMetadata, sources []*dynamodb.ChunkMetadata, liveNodes map[string]*dynamodb.NodeInfo) ([]byte, error) {
+	codec, err := erasure.New(file.DataShards, file.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	shards := make([][]byte, codec.Shards())
+	read := 0
+	for _, source := range sources {
+		if read == file.DataShards {
+			break
+		}
+		if source.ShardIndex < 0 || source.ShardIndex >= len(shards) {
+			continue
+		}
+		data, err := readChunk(ctx, liveNodes[source.NodeID], source.FileID, source.ChunkIndex, source.Checksum)
+		if err != nil {
+			fmt.Printf("Warning: %v\n", err)
+			continue
+		}
+		hash := sha256.Sum256(data)
+		if checksum := hex.EncodeToString(hash[:]); source.Checksum != "" && checksum != source.Checksum {
+			fmt.Printf("Warning: Shard %d of chunk %d of %s on %s is corrupt\n", source.ShardIndex, source.ChunkIndex, source.FileID, source.NodeID)
+			continue
+		}
+		shards[source.ShardIndex] = data
+		read++
+	}
+
+	if err := codec.Reconstruct(shards); err != nil {
+		return nil, err
+	}
+
+	shard := shards[lost.ShardIndex]
+	hash := sha256.Sum256(shard)
+	if checksum := hex.EncodeToString(hash[:]); lost.Checksum != "" && checksum != lost.Checksum {
+		return nil, fmt.Errorf("rebuilt shard does not match its checksum")
+	}
+	return shard, nil
+}
+
+// placeRepair picks the node that receives a repaired replica or shard among candidates
+// above the placement reserve, preferring a failure domain no surviving copy is in
+func (r *Repairer) placeRepair(dead *dynamodb.ChunkMetadata, candidates []*dynamodb.NodeInfo, domains map[string]bool) *dynamodb.NodeInfo {
+	candidates = nodesAboveReserve(candidates, int64(r.server.cfg.PlacementReserveMB)<<20)
+	if len(candidates) == 0 {
+		return nil
+	}
+	return r.server.placement.Place(PlacementRequest{
+		FileID:      dead.FileID,
+		ChunkIndex:  dead.ChunkIndex,
+		Count:       1,
+		Nodes:       candidates,
+		UsedDomains: domains,
+	})[0]
+}
+
+// HandleRepairStatus reports progress of the re-replication daemon
+func HandleRepairStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method not allowed"))
+		return
+	}
+
+	if apiServer == nil || apiServer.repairer == nil {
+		http.Error(w, "API server not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiServer.repairer.Status())
+}
@@ -5,31 +5,81 @@ import (
 	"fmt"
 
 	"github.com/timskillet/distributed-filestore/internal/config"
-	"github.com/timskillet/distributed-filestore/internal/dynamodb"
+	"github.com/timskillet/distributed-filestore/internal/metadata"
 )
 
 type Server struct {
-	dbClient *dynamodb.Client
-	cfg      *config.Config
+	store       metadata.MetadataStore
+	cfg         *config.Config
+	nodes       *NodeDirectory
+	placement   PlacementPolicy
+	moveLimiter *rateLimiter // bytes per second, shared by rebalancing and draining
+	latency     *latencyTracker
+	repairer    *Repairer
+	rebalancer  *Rebalancer
+	drainer     *Drainer
 }
 
 func NewServer(cfg *config.Config) (*Server, error) {
 	ctx := context.Background()
-	dbClient, err := dynamodb.NewClient(ctx, cfg.AWSRegion)
+	store, err := metadata.NewStore(ctx, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create DynamoDB client: %w", err)
+		return nil, fmt.Errorf("failed to create metadata store: %w", err)
 	}
 
-	return &Server{
-		dbClient: dbClient,
-		cfg:      cfg,
-	}, nil
+	placement, err := NewPlacementPolicy(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := NewNodeDirectory(store, cfg)
+	s := &Server{
+		store:       &directoryStore{MetadataStore: store, dir: nodes},
+		cfg:         cfg,
+		nodes:       nodes,
+		placement:   placement,
+		moveLimiter: newRateLimiter(float64(cfg.RebalanceBandwidthKB) * 1024),
+		latency:     newLatencyTracker(),
+	}
+	s.repairer = NewRepairer(s)
+	s.rebalancer = NewRebalancer(s)
+	s.drainer = NewDrainer(s)
+	return s, nil
+}
+
+// StartRepairDaemon runs the background re-replication loop until ctx is cancelled
+func (s *Server) StartRepairDaemon(ctx context.Context) {
+	if s.cfg.RepairInterval <= 0 {
+		return
+	}
+	s.repairer.Run(ctx)
+}
+
+// StartNodeDirectory keeps the cached node directory fresh until ctx is cancelled
+func (s *Server) StartNodeDirectory(ctx context.Context) {
+	s.nodes.Run(ctx)
 }
 
-func (s *Server) GetDBClient() *dynamodb.Client {
-	return s.dbClient
+func (s *Server) GetStore() metadata.MetadataStore {
+	return s.store
 }
 
 func (s *Server) GetConfig() *config.Config {
 	return s.cfg
 }
+
+func (s *Server) GetRepairer() *Repairer {
+	return s.repairer
+}
+
+func (s *Server) GetRebalancer() *Rebalancer {
+	return s.rebalancer
+}
+
+func (s *Server) GetDrainer() *Drainer {
+	return s.drainer
+}
+
+func (s *Server) GetNodeDirectory() *NodeDirectory {
+	return s.nodes
+}
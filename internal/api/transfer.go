@@ -0,0 +1,296 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/timskillet/distributed-filestore/internal/dynamodb"
+)
+
+var transferClient = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+// copyChunk reads a chunk replica from src and stores it on dst, returning the number of bytes copied.
+// The destination node records its own ChunkMetadata entry once the write succeeds; with moveFrom
+// set it instead swaps that node's entry for its own in one atomic step.
+func copyChunk(ctx context.Context, chunk *dynamodb.ChunkMetadata, src, dst *dynamodb.NodeInfo, replicaType string, moveFrom string) (int64, error) {
+	chunkData, err := readChunk(ctx, src, chunk.FileID, chunk.ChunkIndex, chunk.Checksum)
+	if err != nil {
+		return 0, err
+	}
+
+	// Never propagate a corrupt replica
+	hash := sha256.Sum256(chunkData)
+	if checksum := hex.EncodeToString(hash[:]); chunk.Checksum != "" && checksum != chunk.Checksum {
+		return 0, fmt.Errorf("checksum mismatch on %s: expected %s, got %s", src.NodeID, chunk.Checksum, checksum)
+	}
+
+	if err := storeChunk(ctx, dst, chunk, chunkData, replicaType, moveFrom); err != nil {
+		return 0, err
+	}
+	return int64(len(chunkData)), nil
+}
+
+// readChunk fetches the bytes a node stores for a chunk. With the checksum known the
+// node reads the body directly instead of looking up its replica record.
+func readChunk(ctx context.Context, src *dynamodb.NodeInfo, fileID string, chunkIndex int, checksum string) ([]byte, error) {
+	srcURL := fmt.Sprintf("http://%s:%d/get-chunk?file_id=%s&chunk_index=%d", src.PrivateIP, src.Port, fileID, chunkIndex)
+	if checksum != "" {
+		srcURL += "&checksum=" + checksum
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srcURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := transferClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk from %s: %w", src.NodeID, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("source %s returned status %d: %s", src.NodeID, resp.StatusCode, string(body))
+	}
+
+	chunkData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk from %s: %w", src.NodeID, err)
+	}
+	return chunkData, nil
+}
+
+// storeChunk writes chunk data to dst under the file, chunk index, shard index and
+// checksum of the given chunk record
+func storeChunk(ctx context.Context, dst *dynamodb.NodeInfo, chunk *dynamodb.ChunkMetadata, chunkData []byte, replicaType string, moveFrom string) error {
+	dstURL := fmt.Sprintf("http://%s:%d/store-chunk?file_id=%s&chunk_index=%d&replica_type=%s", dst.PrivateIP, dst.Port, chunk.FileID, chunk.ChunkIndex, replicaType)
+	if replicaType == "shard" {
+		dstURL += fmt.Sprintf("&shard_index=%d", chunk.ShardIndex)
+	}
+	if moveFrom != "" {
+		dstURL += "&move_from=" + moveFrom
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, dstURL, bytes.NewReader(chunkData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("X-Chunk-Checksum", chunk.Checksum)
+
+	storeResp, err := transferClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to store chunk on %s: %w", dst.NodeID, err)
+	}
+	defer storeResp.Body.Close()
+
+	if storeResp.StatusCode != http.StatusOK && storeResp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(storeResp.Body)
+		return fmt.Errorf("destination %s returned status %d: %s", dst.NodeID, storeResp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// deleteChunk asks a node to release its copy of a chunk after the replica moved away.
+// The node keeps the body while other chunks with the same checksum still use it.
+func deleteChunk(ctx context.Context, node *dynamodb.NodeInfo, fileID string, chunkIndex int, checksum string) error {
+	url := fmt.Sprintf("http://%s:%d/delete-chunk?file_id=%s&chunk_index=%d&checksum=%s", node.PrivateIP, node.Port, fileID, chunkIndex, checksum)
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := transferClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to delete chunk on %s: %w", node.NodeID, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("node %s returned status %d: %s", node.NodeID, resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// moveReplica copies src's replica of a chunk to dst, which swaps the chunk's metadata
+// over in a single transaction, and then removes the old copy. It returns the number
+// of bytes moved.
+func moveReplica(ctx context.Context, s *Server, fileID string, chunkIndex int, src, dst *dynamodb.NodeInfo) (int64, error) {
+	replicas, err := s.store.GetChunkReplicas(ctx, s.cfg.ChunkMetadataTable, fileID, chunkIndex)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load replicas: %w", err)
+	}
+	var chunk *dynamodb.ChunkMetadata
+	for _, replica := range replicas {
+		if replica.NodeID == dst.NodeID {
+			return 0, fmt.Errorf("%s already holds the chunk", dst.NodeID)
+		}
+		if replica.NodeID == src.NodeID {
+			chunk = replica
+		}
+	}
+	if chunk == nil {
+		return 0, fmt.Errorf("%s no longer holds the chunk", src.NodeID)
+	}
+
+	n, err := copyChunk(ctx, chunk, src, dst, chunk.ReplicaType, src.NodeID)
+	if err != nil {
+		return 0, err
+	}
+
+	// The metadata already points at dst, so a leftover file only wastes space
+	if err := deleteChunk(ctx, src, fileID, chunkIndex, chunk.Checksum); err != nil {
+		fmt.Printf("Warning: Moved chunk %d of %s but failed to delete the old copy: %v\n", chunkIndex, fileID, err)
+	}
+	return n, nil
+}
+
+// replicationFailure is a replica a node's async replication queue gave up writing
+type replicationFailure struct {
+	ID         string `json:"id"`
+	FileID     string `json:"file_id"`
+	ChunkIndex int    `json:"chunk_index"`
+	Checksum   string `json:"checksum"`
+	TargetNode string `json:"target_node"`
+}
+
+// listReplicationFailures fetches the replication tasks a node gave up on
+func listReplicationFailures(ctx context.Context, node *dynamodb.NodeInfo) ([]replicationFailure, error) {
+	url := fmt.Sprintf("http://%s:%d/replication-failures", node.PrivateIP, node.Port)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := transferClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+	}
+	var failures []replicationFailure
+	if err := json.NewDecoder(resp.Body).Decode(&failures); err != nil {
+		return nil, fmt.Errorf("failed to decode replication failures: %w", err)
+	}
+	return failures, nil
+}
+
+// resolveReplicationFailure removes a task from a node's queue once its replica is restored
+func resolveReplicationFailure(ctx context.Context, node *dynamodb.NodeInfo, id string) error {
+	url := fmt.Sprintf("http://%s:%d/replication-failures?id=%s", node.PrivateIP, node.Port, id)
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := transferClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// listScrubLosses fetches the replicas whose bodies a node's scrubber could not heal
+func listScrubLosses(ctx context.Context, node *dynamodb.NodeInfo) ([]*dynamodb.ChunkMetadata, error) {
+	url := fmt.Sprintf("http://%s:%d/scrub-losses", node.PrivateIP, node.Port)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := transferClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+	}
+	var lost []*dynamodb.ChunkMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&lost); err != nil {
+		return nil, fmt.Errorf("failed to decode lost replicas: %w", err)
+	}
+	return lost, nil
+}
+
+// resolveScrubLoss removes a replica from a node's lost list once it is replaced
+func resolveScrubLoss(ctx context.Context, node *dynamodb.NodeInfo, fileID string, chunkIndex int) error {
+	url := fmt.Sprintf("http://%s:%d/scrub-losses?file_id=%s&chunk_index=%d", node.PrivateIP, node.Port, fileID, chunkIndex)
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := transferClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// rateLimiter paces work to a fixed number of units per second
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate float64
+	next time.Time
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	return &rateLimiter{rate: perSecond}
+}
+
+// Wait blocks until n more units may be processed. A non-positive rate disables limiting.
+func (l *rateLimiter) Wait(ctx context.Context, n int64) error {
+	if l.rate <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
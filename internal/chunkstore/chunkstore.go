@@ -0,0 +1,68 @@
+package chunkstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrNotFound is returned when a chunk is not in the store
+var ErrNotFound = errors.New("chunk not found")
+
+// ErrCorrupt is returned when a stored chunk fails the store's own integrity check
+var ErrCorrupt = errors.New("chunk is corrupt")
+
+// Key identifies a stored chunk body by the hex SHA-256 of its content. Chunks with
+// the same content share a key, whichever file they belong to, so a store keeps
+// one copy of them; callers track which chunks use a body.
+type Key string
+
+// KeyOf returns the key of a chunk's content
+func KeyOf(data []byte) Key {
+	sum := sha256.Sum256(data)
+	return Key(hex.EncodeToString(sum[:]))
+}
+
+// ParseKey checks that s is a lowercase hex SHA-256 checksum
+func ParseKey(s string) (Key, error) {
+	if len(s) != sha256.Size*2 || strings.Trim(s, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("invalid chunk key %q", s)
+	}
+	return Key(s), nil
+}
+
+func (k Key) String() string {
+	return string(k)
+}
+
+// Info describes a stored chunk
+type Info struct {
+	Key      Key
+	Size     int64
+	Location string // Where the backend keeps the chunk, e.g. a file path; empty if it has none
+}
+
+// ChunkStore holds the chunk bodies of a storage node. The node's handlers only go
+// through this interface, so backends can be swapped without touching them.
+type ChunkStore interface {
+	// Put stores a chunk body under the checksum of its content. The caller must
+	// verify the content matches the key; storing an existing key replaces the body.
+	Put(ctx context.Context, key Key, r io.Reader) (Info, error)
+	// Get opens a chunk for reading; the caller closes it
+	Get(ctx context.Context, key Key) (io.ReadCloser, error)
+	// Delete removes a chunk; deleting a missing chunk is not an error
+	Delete(ctx context.Context, key Key) error
+	Stat(ctx context.Context, key Key) (Info, error)
+	List(ctx context.Context) ([]Info, error)
+}
+
+var (
+	_ ChunkStore = (*FileStore)(nil)
+	_ ChunkStore = (*MemoryStore)(nil)
+	_ ChunkStore = (*DiskStore)(nil)
+	_ ChunkStore = (*SegmentStore)(nil)
+)
@@ -0,0 +1,376 @@
+package chunkstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const probeFile = ".probe"
+
+// DiskStatus reports the health and capacity of one directory of a DiskStore
+type DiskStatus struct {
+	Dir            string
+	Healthy        bool
+	AvailableSpace int64 // -1 if unknown
+	TotalSpace     int64
+	LastError      string
+}
+
+// diskRecoverer is implemented by stores that tidy up after their disk returns to
+// service
+type diskRecoverer interface {
+	recoverDisk(failedAt time.Time) error
+}
+
+// Opener opens the chunk store kept in one directory
+type Opener func(dir string) (ChunkStore, error)
+
+// OpenFileStore is the Opener of FileStore. It refuses a directory a SegmentStore
+// has written to, whose chunks a FileStore would not see.
+func OpenFileStore(dir string) (ChunkStore, error) {
+	segments, err := filepath.Glob(filepath.Join(dir, "segment-*"+segmentExt))
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		return nil, fmt.Errorf("%s holds chunk segments, open it with the segment store", dir)
+	}
+	return NewFileStore(dir)
+}
+
+// DiskStore spreads chunks over several directories, normally one per disk (JBOD),
+// each holding a store opened with the same Opener. New chunks go to the healthy disk
+// with the most free space. A disk whose I/O fails is marked failed and gets no writes
+// until a health check succeeds on it again; reads still try every disk, so chunks on
+// the remaining disks stay available.
+type DiskStore struct {
+	disks []*disk
+}
+
+type disk struct {
+	dir  string
+	open Opener
+
+	mu        sync.Mutex
+	store     ChunkStore // nil until the directory has been opened
+	healthy   bool
+	failedAt  time.Time // When the disk last went from healthy to failed
+	available int64     // Estimate between checks, reduced as chunks are written
+	total     int64
+	lastError string
+}
+
+// NewDiskStore opens a store over dirs. Disks that cannot be used yet are marked failed
+// rather than failing the node, as long as at least one disk is healthy; they are
+// opened once a later health check passes.
+func NewDiskStore(dirs []string, open Opener) (*DiskStore, error) {
+	if len(dirs) == 0 {
+		return nil, errors.New("no chunk directories configured")
+	}
+
+	s := &DiskStore{}
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		dir = filepath.Clean(dir)
+		if seen[dir] {
+			return nil, fmt.Errorf("chunk directory %s is listed twice", dir)
+		}
+		seen[dir] = true
+		s.disks = append(s.disks, &disk{dir: dir, open: open, available: -1})
+	}
+
+	healthy := 0
+	for _, status := range s.Check(context.Background()) {
+		if status.Healthy {
+			healthy++
+		}
+	}
+	if healthy == 0 {
+		return nil, fmt.Errorf("none of the %d chunk directories is usable", len(dirs))
+	}
+	return s, nil
+}
+
+// Check probes every disk with a small write and refreshes its free space. Failed
+// disks that pass the probe are put back into service, after being opened if they
+// never were, or after clearing what writes that failed with the disk left behind.
+func (s *DiskStore) Check(ctx context.Context) []DiskStatus {
+	for _, d := range s.disks {
+		err := d.probe()
+		if err == nil {
+			if store := d.chunks(); store == nil {
+				if store, err = d.open(d.dir); err == nil {
+					d.mu.Lock()
+					d.store = store
+					d.mu.Unlock()
+				}
+			} else if r, ok := store.(diskRecoverer); ok {
+				d.mu.Lock()
+				failedAt := d.failedAt
+				d.mu.Unlock()
+				if !failedAt.IsZero() {
+					err = r.recoverDisk(failedAt)
+				}
+			}
+		}
+
+		d.mu.Lock()
+		wasHealthy, wasFailed := d.healthy, d.lastError != ""
+		if err != nil {
+			if d.healthy {
+				d.failedAt = time.Now()
+			}
+			d.healthy = false
+			d.lastError = err.Error()
+		} else {
+			d.healthy = true
+			d.failedAt = time.Time{}
+			d.lastError = ""
+			d.available, d.total, err = DiskUsage(d.dir)
+			if err != nil {
+				d.available, d.total = -1, 0 // Unknown, but the disk itself works
+			}
+		}
+		healthy := d.healthy
+		d.mu.Unlock()
+
+		switch {
+		case !healthy && (wasHealthy || !wasFailed):
+			fmt.Printf("Warning: Disk %s failed its health check: %v\n", d.dir, err)
+		case wasFailed && healthy:
+			fmt.Printf("Disk %s is healthy\n", d.dir)
+		}
+	}
+	return s.Disks()
+}
+
+func (d *disk) probe() error {
+	if err := os.MkdirAll(d.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create chunk directory: %w", err)
+	}
+	path := filepath.Join(d.dir, probeFile)
+	if err := os.WriteFile(path, []byte("ok"), 0644); err != nil {
+		return fmt.Errorf("failed to write probe file: %w", err)
+	}
+	return os.Remove(path)
+}
+
+// fail takes a disk out of service for writes until its next successful check
+func (d *disk) fail(err error) {
+	d.mu.Lock()
+	wasHealthy := d.healthy
+	if wasHealthy {
+		d.failedAt = time.Now()
+	}
+	d.healthy = false
+	d.lastError = err.Error()
+	d.mu.Unlock()
+
+	if wasHealthy {
+		fmt.Printf("Warning: Disk %s failed: %v\n", d.dir, err)
+	}
+}
+
+// chunks returns the disk's store, or nil if it has not been opened
+func (d *disk) chunks() ChunkStore {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.store
+}
+
+// Disks returns the last known status of every disk
+func (s *DiskStore) Disks() []DiskStatus {
+	statuses := make([]DiskStatus, len(s.disks))
+	for i, d := range s.disks {
+		d.mu.Lock()
+		statuses[i] = DiskStatus{
+			Dir:            d.dir,
+			Healthy:        d.healthy,
+			AvailableSpace: d.available,
+			TotalSpace:     d.total,
+			LastError:      d.lastError,
+		}
+		d.mu.Unlock()
+	}
+	return statuses
+}
+
+// writable returns the healthy disks, most free space first. Disks whose free space
+// is unknown come last.
+func (s *DiskStore) writable() []*disk {
+	var disks []*disk
+	available := make(map[*disk]int64)
+	for _, d := range s.disks {
+		d.mu.Lock()
+		if d.healthy && d.store != nil {
+			disks = append(disks, d)
+			available[d] = d.available
+		}
+		d.mu.Unlock()
+	}
+	sort.SliceStable(disks, func(i, j int) bool {
+		return available[disks[i]] > available[disks[j]]
+	})
+	return disks
+}
+
+// sourceReader records errors from the chunk's source so they are not blamed on a disk
+type sourceReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *sourceReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// Put writes a chunk to the healthy disk with the most free space. If that disk fails
+// and r can be rewound, the write is retried on the next disk.
+func (s *DiskStore) Put(ctx context.Context, key Key, r io.Reader) (Info, error) {
+	disks := s.writable()
+	if len(disks) == 0 {
+		return Info{}, errors.New("no healthy disk to write to")
+	}
+
+	seeker, rewindable := r.(io.Seeker)
+	var errs []error
+	for i, d := range disks {
+		if i > 0 {
+			if !rewindable {
+				break
+			}
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				break
+			}
+		}
+
+		src := &sourceReader{r: r}
+		info, err := d.chunks().Put(ctx, key, src)
+		if src.err != nil {
+			return Info{}, err // The upload failed, not the disk
+		}
+		if err != nil {
+			d.fail(err)
+			errs = append(errs, fmt.Errorf("%s: %w", d.dir, err))
+			continue
+		}
+
+		d.mu.Lock()
+		if d.available >= 0 {
+			d.available = max(d.available-info.Size, 0)
+		}
+		d.mu.Unlock()
+
+		// A chunk rewritten onto another disk must not leave its old copy behind
+		for _, other := range s.disks {
+			if store := other.chunks(); other != d && store != nil {
+				store.Delete(ctx, key)
+			}
+		}
+		return info, nil
+	}
+	return Info{}, errors.Join(errs...)
+}
+
+func (s *DiskStore) Get(ctx context.Context, key Key) (io.ReadCloser, error) {
+	var errs []error
+	for _, d := range s.disks {
+		store := d.chunks()
+		if store == nil {
+			continue
+		}
+		rc, err := store.Get(ctx, key)
+		if err == nil {
+			return rc, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			if !errors.Is(err, ErrCorrupt) {
+				d.fail(err) // A single bad chunk is the scrubber's job, not a failed disk
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", d.dir, err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return nil, ErrNotFound
+}
+
+func (s *DiskStore) Delete(ctx context.Context, key Key) error {
+	var errs []error
+	for _, d := range s.disks {
+		store := d.chunks()
+		if store == nil {
+			continue
+		}
+		if err := store.Delete(ctx, key); err != nil {
+			d.fail(err)
+			errs = append(errs, fmt.Errorf("%s: %w", d.dir, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *DiskStore) Stat(ctx context.Context, key Key) (Info, error) {
+	var errs []error
+	for _, d := range s.disks {
+		store := d.chunks()
+		if store == nil {
+			continue
+		}
+		info, err := store.Stat(ctx, key)
+		if err == nil {
+			return info, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			errs = append(errs, fmt.Errorf("%s: %w", d.dir, err))
+		}
+	}
+	if len(errs) > 0 {
+		return Info{}, errors.Join(errs...)
+	}
+	return Info{}, ErrNotFound
+}
+
+// List returns every chunk on the disks that can be listed, sorted by key
+func (s *DiskStore) List(ctx context.Context) ([]Info, error) {
+	var infos []Info
+	seen := make(map[Key]bool)
+	listed := 0
+	var errs []error
+	for _, d := range s.disks {
+		store := d.chunks()
+		if store == nil {
+			continue
+		}
+		disk, err := store.List(ctx)
+		if err != nil {
+			d.fail(err)
+			errs = append(errs, fmt.Errorf("%s: %w", d.dir, err))
+			continue
+		}
+		listed++
+		for _, info := range disk {
+			if !seen[info.Key] {
+				seen[info.Key] = true
+				infos = append(infos, info)
+			}
+		}
+	}
+	if listed == 0 {
+		return nil, errors.Join(errs...)
+	}
+	sortInfos(infos)
+	return infos, nil
+}
@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd)
+
+package chunkstore
+
+import "errors"
+
+func DiskUsage(dir string) (available, total int64, err error) {
+	return 0, 0, errors.New("free space reporting is not supported on this platform")
+}
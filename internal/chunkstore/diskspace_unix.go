@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd
+
+package chunkstore
+
+import "syscall"
+
+// DiskUsage returns the bytes available to unprivileged writers on the filesystem
+// holding dir, and the filesystem's total size
+func DiskUsage(dir string) (available, total int64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), int64(st.Blocks) * int64(st.Bsize), nil
+}
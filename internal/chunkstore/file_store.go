@@ -0,0 +1,301 @@
+package chunkstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	chunkExt = ".bin"
+	tempExt  = ".tmp"
+)
+
+// FileStore keeps each chunk body in its own file named after its checksum,
+// <root>/<first two hex digits>/<checksum>.bin, so no directory grows too large.
+// Chunks are written to a temporary file that is fsynced and renamed into place, so a
+// crash leaves either the previous chunk or the complete new one, never a torn file.
+type FileStore struct {
+	root string
+}
+
+// NewFileStore opens a store in root, removing temporary files left by writes that
+// were interrupted by a crash and moving chunks from the old per-file layout
+func NewFileStore(root string) (*FileStore, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create chunk directory: %w", err)
+	}
+	s := &FileStore{root: root}
+	if err := s.prepare(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// prepare tidies the directory after a crash or an upgrade. It must only run before
+// the store accepts writes.
+func (s *FileStore) prepare() error {
+	if err := s.removeTempFiles(time.Time{}); err != nil {
+		return err
+	}
+	return s.migrateLegacy()
+}
+
+// dirs returns the root and every subdirectory that may hold chunks
+func (s *FileStore) dirs() ([]string, error) {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunk directory: %w", err)
+	}
+	dirs := []string{s.root}
+	for _, entry := range entries {
+		if entry.IsDir() && len(entry.Name()) == 2 {
+			dirs = append(dirs, filepath.Join(s.root, entry.Name()))
+		}
+	}
+	return dirs, nil
+}
+
+// removeTempFiles deletes the temporary files of unfinished writes last modified
+// before the given time, or all of them if it is zero
+func (s *FileStore) removeTempFiles(before time.Time) error {
+	dirs, err := s.dirs()
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return fmt.Errorf("failed to list chunk directory: %w", err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), tempExt) {
+				continue
+			}
+			if !before.IsZero() {
+				if info, err := entry.Info(); err != nil || !info.ModTime().Before(before) {
+					continue
+				}
+			}
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("failed to remove incomplete chunk %s: %w", entry.Name(), err)
+			}
+			removed++
+		}
+	}
+	if removed > 0 {
+		fmt.Printf("Removed %d incomplete chunk writes from %s\n", removed, s.root)
+	}
+	return nil
+}
+
+// recoverDisk removes the temporary files that writes failing along with the disk
+// could not clean up. Writes started after the failure are left alone.
+func (s *FileStore) recoverDisk(failedAt time.Time) error {
+	return s.removeTempFiles(failedAt)
+}
+
+// migrateLegacy moves chunks stored as <root>/<file_id>_<chunk_index>.bin by older
+// releases to their checksum. Identical chunks collapse into one file.
+func (s *FileStore) migrateLegacy() error {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return fmt.Errorf("failed to list chunk directory: %w", err)
+	}
+	moved := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), chunkExt) {
+			continue
+		}
+		legacyPath := filepath.Join(s.root, entry.Name())
+		key, err := hashFile(legacyPath)
+		if err != nil {
+			return err
+		}
+		if err := s.ensureDir(key); err != nil {
+			return err
+		}
+		if err := os.Rename(legacyPath, s.path(key)); err != nil {
+			return fmt.Errorf("failed to move chunk %s: %w", entry.Name(), err)
+		}
+		if err := syncDir(filepath.Dir(s.path(key))); err != nil {
+			return fmt.Errorf("failed to sync chunk directory: %w", err)
+		}
+		moved++
+	}
+	if moved > 0 {
+		if err := syncDir(s.root); err != nil {
+			return fmt.Errorf("failed to sync chunk directory: %w", err)
+		}
+		fmt.Printf("Moved %d chunks in %s to content-addressed storage\n", moved, s.root)
+	}
+	return nil
+}
+
+func hashFile(path string) (Key, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open chunk file: %w", err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to read chunk file: %w", err)
+	}
+	return Key(hex.EncodeToString(h.Sum(nil))), nil
+}
+
+// Root returns the directory chunks are stored in
+func (s *FileStore) Root() string {
+	return s.root
+}
+
+func (s *FileStore) path(key Key) string {
+	return filepath.Join(s.root, string(key[:2]), key.String()+chunkExt)
+}
+
+// ensureDir creates the subdirectory of a key, making the new entry durable
+func (s *FileStore) ensureDir(key Key) error {
+	err := os.Mkdir(filepath.Dir(s.path(key)), 0755)
+	if errors.Is(err, fs.ErrExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create chunk directory: %w", err)
+	}
+	if err := syncDir(s.root); err != nil {
+		return fmt.Errorf("failed to sync chunk directory: %w", err)
+	}
+	return nil
+}
+
+func (s *FileStore) Put(ctx context.Context, key Key, r io.Reader) (Info, error) {
+	if _, err := ParseKey(string(key)); err != nil {
+		return Info{}, err
+	}
+	if err := s.ensureDir(key); err != nil {
+		return Info{}, err
+	}
+	path := s.path(key)
+	dir := filepath.Dir(path)
+
+	// Each write gets its own temporary file, so concurrent writes of a chunk never mix
+	f, err := os.CreateTemp(dir, key.String()+chunkExt+".*"+tempExt)
+	if err != nil {
+		return Info{}, fmt.Errorf("failed to create chunk file: %w", err)
+	}
+	tmpPath := f.Name()
+
+	n, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return Info{}, fmt.Errorf("failed to write chunk file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return Info{}, fmt.Errorf("failed to sync chunk file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return Info{}, fmt.Errorf("failed to close chunk file: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return Info{}, fmt.Errorf("failed to commit chunk file: %w", err)
+	}
+	// The rename is only durable once the directory entry is
+	if err := syncDir(dir); err != nil {
+		return Info{}, fmt.Errorf("failed to sync chunk directory: %w", err)
+	}
+	return Info{Key: key, Size: n, Location: path}, nil
+}
+
+func (s *FileStore) Get(ctx context.Context, key Key) (io.ReadCloser, error) {
+	if _, err := ParseKey(string(key)); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open chunk file: %w", err)
+	}
+	return f, nil
+}
+
+func (s *FileStore) Delete(ctx context.Context, key Key) error {
+	if _, err := ParseKey(string(key)); err != nil {
+		return err
+	}
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete chunk file: %w", err)
+	}
+	return nil
+}
+
+func (s *FileStore) Stat(ctx context.Context, key Key) (Info, error) {
+	if _, err := ParseKey(string(key)); err != nil {
+		return Info{}, err
+	}
+	path := s.path(key)
+	fi, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Info{}, ErrNotFound
+	}
+	if err != nil {
+		return Info{}, fmt.Errorf("failed to stat chunk file: %w", err)
+	}
+	return Info{Key: key, Size: fi.Size(), Location: path}, nil
+}
+
+// List returns every chunk in the store, sorted by key. Files that are not chunks are skipped.
+func (s *FileStore) List(ctx context.Context) ([]Info, error) {
+	dirs, err := s.dirs()
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []Info
+	for _, dir := range dirs[1:] {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list chunk directory: %w", err)
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || !strings.HasSuffix(name, chunkExt) {
+				continue
+			}
+			key, err := ParseKey(strings.TrimSuffix(name, chunkExt))
+			if err != nil || !strings.HasPrefix(name, filepath.Base(dir)) {
+				continue
+			}
+			fi, err := entry.Info()
+			if err != nil {
+				continue // Removed since the directory was read
+			}
+			infos = append(infos, Info{Key: key, Size: fi.Size(), Location: filepath.Join(dir, name)})
+		}
+	}
+	sortInfos(infos)
+	return infos, nil
+}
+
+func sortInfos(infos []Info) {
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Key < infos[j].Key
+	})
+}
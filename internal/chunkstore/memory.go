@@ -0,0 +1,73 @@
+package chunkstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// MemoryStore keeps chunks in process memory. Everything is lost on restart, so it is
+// meant for tests and throwaway local clusters.
+type MemoryStore struct {
+	mu     sync.RWMutex
+	chunks map[Key][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{chunks: make(map[Key][]byte)}
+}
+
+func (s *MemoryStore) Put(ctx context.Context, key Key, r io.Reader) (Info, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Info{}, fmt.Errorf("failed to read chunk: %w", err)
+	}
+
+	s.mu.Lock()
+	s.chunks[key] = data
+	s.mu.Unlock()
+	return Info{Key: key, Size: int64(len(data))}, nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key Key) (io.ReadCloser, error) {
+	s.mu.RLock()
+	data, ok := s.chunks[key]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	// Stored slices are never modified, only replaced, so readers can share them
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, key Key) error {
+	s.mu.Lock()
+	delete(s.chunks, key)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemoryStore) Stat(ctx context.Context, key Key) (Info, error) {
+	s.mu.RLock()
+	data, ok := s.chunks[key]
+	s.mu.RUnlock()
+	if !ok {
+		return Info{}, ErrNotFound
+	}
+	return Info{Key: key, Size: int64(len(data))}, nil
+}
+
+// List returns every chunk in the store, sorted by key
+func (s *MemoryStore) List(ctx context.Context) ([]Info, error) {
+	s.mu.RLock()
+	infos := make([]Info, 0, len(s.chunks))
+	for key, data := range s.chunks {
+		infos = append(infos, Info{Key: key, Size: int64(len(data))})
+	}
+	s.mu.RUnlock()
+
+	sortInfos(infos)
+	return infos, nil
+}
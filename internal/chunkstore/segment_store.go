@@ -0,0 +1,1015 @@
+package chunkstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	segmentExt = ".seg"
+	indexExt   = ".idx"
+
+	recordPut       byte = 1
+	recordTombstone byte = 2
+
+	// A record is a header (type, binary key, argument), the body of a put and a
+	// CRC-32 of everything before it. The argument of a put is its body size; the
+	// argument of a tombstone is the segment holding the put it deletes.
+	recordHeaderSize  = 1 + sha256.Size + 8
+	recordTrailerSize = 4
+
+	// An index entry is a record header followed by the record's offset
+	indexEntrySize = recordHeaderSize + 8
+
+	// compactBatchSize bounds how many bytes compaction copies per write lock
+	compactBatchSize = 4 << 20
+
+	// spoolMemorySize is how much of a chunk Put holds in memory; larger chunks are
+	// spooled to a temporary file until they can be appended
+	spoolMemorySize = 1 << 20
+)
+
+// SegmentOptions tunes a SegmentStore
+type SegmentOptions struct {
+	SegmentSize    int64 // A segment is sealed and a new one started once it reaches this size
+	GarbagePercent int   // Sealed segments with at least this share of dead bytes are compacted
+}
+
+// SegmentStore appends chunk bodies to large segment files instead of keeping a file
+// per chunk, so small chunks do not strain the filesystem. Every record carries a
+// CRC and is fsynced before it is acknowledged. Deletes append a tombstone. A full
+// segment is sealed with an index file listing its records, so opening the store only
+// scans the active segment; a torn record at its end is cut off. Sealed segments whose
+// dead bytes reach GarbagePercent are compacted by copying their live records to the
+// active segment and removing the old files. A tombstone is kept through compactions
+// for as long as a segment it may have to override, any up to its target, is on disk.
+type SegmentStore struct {
+	dir  string
+	opts SegmentOptions
+
+	writeMu sync.Mutex // Serializes appends, and the index changes made with them
+
+	mu            sync.RWMutex
+	index         map[Key]location
+	segments      map[uint64]*segment
+	retired       map[uint64]bool // Compacted segments whose files have not been removed yet
+	active        *segment
+	activeRecords []record // Records of the active segment, written to its index when sealed
+
+	compacting atomic.Bool
+}
+
+type segment struct {
+	id         uint64
+	f          *os.File
+	size       int64
+	live       int64            // Bytes of puts the index points at
+	tombstones map[uint64]int64 // Bytes of tombstones by the segment holding the put they delete
+	readers    sync.WaitGroup   // Open chunk readers, waited for before the file is removed
+}
+
+type location struct {
+	seg    *segment
+	offset int64
+	size   int64
+}
+
+type record struct {
+	typ    byte
+	key    Key
+	arg    int64
+	offset int64
+}
+
+func (r record) size() int64 {
+	if r.typ == recordPut {
+		return recordHeaderSize + r.arg + recordTrailerSize
+	}
+	return recordHeaderSize + recordTrailerSize
+}
+
+// NewSegmentStore opens the segments in dir, replaying them to rebuild the index.
+// Chunks a FileStore left in dir are moved into segments.
+func NewSegmentStore(dir string, opts SegmentOptions) (*SegmentStore, error) {
+	if opts.SegmentSize <= 0 {
+		return nil, errors.New("segment size must be positive")
+	}
+	if opts.GarbagePercent < 1 || opts.GarbagePercent > 100 {
+		return nil, errors.New("garbage percent must be between 1 and 100")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create chunk directory: %w", err)
+	}
+
+	s := &SegmentStore{
+		dir:      dir,
+		opts:     opts,
+		index:    make(map[Key]location),
+		segments: make(map[uint64]*segment),
+		retired:  make(map[uint64]bool),
+	}
+	if err := s.load(); err != nil {
+		s.closeSegments()
+		return nil, err
+	}
+	if err := s.importFileStore(); err != nil {
+		s.closeSegments()
+		return nil, err
+	}
+	s.maybeCompact()
+	return s, nil
+}
+
+// load replays every segment in id order. Only the last one may have a torn tail:
+// a bad record that runs to its end is cut off, while damage followed by more data
+// fails the open rather than throwing away acknowledged chunks.
+func (s *SegmentStore) load() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to list chunk directory: %w", err)
+	}
+	var ids []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(name, tempExt) {
+			// An index being written or a chunk being spooled when the node stopped
+			if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("failed to remove incomplete index %s: %w", name, err)
+			}
+			continue
+		}
+		if id, ok := parseSegmentName(name); ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for i, id := range ids {
+		f, err := os.OpenFile(s.segmentPath(id), os.O_RDWR, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open segment %d: %w", id, err)
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("failed to stat segment %d: %w", id, err)
+		}
+		seg := &segment{id: id, f: f, size: fi.Size(), tombstones: make(map[uint64]int64)}
+		s.segments[id] = seg
+
+		last := i == len(ids)-1
+		var records []record
+		if !last {
+			records, err = s.readIndex(seg)
+		}
+		if last || err != nil {
+			scan := scanSegment(f, seg.size)
+			records = scan.records
+			if last {
+				if err := s.cutTornTail(seg, &scan); err != nil {
+					return err
+				}
+			}
+			for _, rec := range scan.damaged {
+				// Skipped; the chunk is missing until the scrubber restores it
+				fmt.Printf("Warning: Segment %s has a corrupt record at offset %d, chunk %s lost\n", f.Name(), rec.offset, rec.key)
+			}
+			if scan.err != nil {
+				// Records past the damage cannot be found; they count as garbage
+				fmt.Printf("Warning: Segment %s is damaged at offset %d, %d bytes of chunks lost: %v\n", f.Name(), scan.valid, seg.size-scan.valid, scan.err)
+			}
+		}
+		for _, rec := range records {
+			s.apply(seg, rec)
+		}
+		if last {
+			s.active = seg
+			s.activeRecords = records
+		}
+	}
+
+	if s.active == nil {
+		return s.createSegment(1)
+	}
+	return nil
+}
+
+// cutTornTail truncates the active segment after a crash in the middle of an append:
+// an incomplete record at the end, or a complete last record that fails its CRC. Any
+// other damage is left in place, and if it hides data after it the open fails.
+func (s *SegmentStore) cutTornTail(seg *segment, scan *segmentScan) error {
+	cut := int64(-1)
+	switch {
+	case scan.err != nil && (errors.Is(scan.err, io.ErrUnexpectedEOF) || zeroFrom(seg.f, scan.valid, seg.size)):
+		cut = scan.valid
+	case scan.err != nil:
+		return fmt.Errorf("segment %s is damaged at offset %d with %d bytes after it: %w", seg.f.Name(), scan.valid, seg.size-scan.valid, scan.err)
+	case len(scan.damaged) > 0 && scan.damaged[len(scan.damaged)-1].offset+scan.damaged[len(scan.damaged)-1].size() == seg.size:
+		cut = scan.damaged[len(scan.damaged)-1].offset
+		scan.damaged = scan.damaged[:len(scan.damaged)-1]
+	}
+	if cut < 0 {
+		return nil
+	}
+
+	fmt.Printf("Warning: Discarding %d bytes of incomplete chunk writes at the end of %s\n", seg.size-cut, seg.f.Name())
+	if err := seg.f.Truncate(cut); err != nil {
+		return fmt.Errorf("failed to truncate segment %d: %w", seg.id, err)
+	}
+	if err := seg.f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync segment %d: %w", seg.id, err)
+	}
+	seg.size = cut
+	scan.valid = cut
+	scan.err = nil
+	return nil
+}
+
+// zeroFrom reports whether a file holds only zero bytes from offset to size, as a
+// crash can leave after an append whose size was persisted before its data
+func zeroFrom(f *os.File, offset, size int64) bool {
+	r := bufio.NewReader(io.NewSectionReader(f, offset, size-offset))
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			return true
+		}
+		if err != nil || b != 0 {
+			return false
+		}
+	}
+}
+
+// importFileStore moves chunks that a FileStore keeps in the same directory into
+// segments, so switching a node to the segment store does not hide them. Each chunk
+// file is removed only once its copy is fsynced, so an interrupted import resumes.
+func (s *SegmentStore) importFileStore() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to list chunk directory: %w", err)
+	}
+	found := false
+	for _, entry := range entries {
+		name := entry.Name()
+		if (entry.IsDir() && len(name) == 2) || (!entry.IsDir() && strings.HasSuffix(name, chunkExt)) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	files, err := NewFileStore(s.dir)
+	if err != nil {
+		return err
+	}
+	infos, err := files.List(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if err := s.importChunk(files, info.Key); err != nil {
+			return fmt.Errorf("failed to import chunk %s: %w", info.Key, err)
+		}
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && len(entry.Name()) == 2 {
+			os.Remove(filepath.Join(s.dir, entry.Name())) // Only succeeds once empty
+		}
+	}
+	if len(infos) > 0 {
+		fmt.Printf("Moved %d chunks in %s from chunk files into segments\n", len(infos), s.dir)
+	}
+	return nil
+}
+
+func (s *SegmentStore) importChunk(files *FileStore, key Key) error {
+	ctx := context.Background()
+	if _, err := s.Stat(ctx, key); errors.Is(err, ErrNotFound) {
+		body, err := files.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		_, err = s.Put(ctx, key, io.TeeReader(body, h))
+		body.Close()
+		if err != nil {
+			return err
+		}
+		if hex.EncodeToString(h.Sum(nil)) != key.String() {
+			// Left out like any other lost chunk, for the scrubber to restore
+			fmt.Printf("Warning: Chunk file %s is corrupt, not importing it\n", files.path(key))
+			if err := s.Delete(ctx, key); err != nil {
+				return err
+			}
+		}
+	} else if err != nil {
+		return err
+	}
+	return files.Delete(ctx, key)
+}
+
+func parseSegmentName(name string) (uint64, bool) {
+	if !strings.HasPrefix(name, "segment-") || !strings.HasSuffix(name, segmentExt) {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, "segment-"), segmentExt), 10, 64)
+	return id, err == nil && id > 0
+}
+
+func (s *SegmentStore) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("segment-%08d%s", id, segmentExt))
+}
+
+func (s *SegmentStore) indexPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("segment-%08d%s", id, indexExt))
+}
+
+func (s *SegmentStore) closeSegments() {
+	for _, seg := range s.segments {
+		seg.f.Close()
+	}
+}
+
+// apply updates the index and live byte counts for a record of seg. Callers hold mu
+// or have not shared the store yet.
+func (s *SegmentStore) apply(seg *segment, rec record) {
+	old, exists := s.index[rec.key]
+	if exists {
+		old.seg.live -= recordHeaderSize + old.size + recordTrailerSize
+	}
+	switch rec.typ {
+	case recordPut:
+		s.index[rec.key] = location{seg: seg, offset: rec.offset, size: rec.arg}
+		seg.live += rec.size()
+	case recordTombstone:
+		delete(s.index, rec.key)
+		seg.tombstones[uint64(rec.arg)] += rec.size()
+	}
+}
+
+// Root returns the directory segments are stored in
+func (s *SegmentStore) Root() string {
+	return s.dir
+}
+
+// createSegment starts a new active segment. Callers hold writeMu.
+func (s *SegmentStore) createSegment(id uint64) error {
+	f, err := os.OpenFile(s.segmentPath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create segment: %w", err)
+	}
+	if err := syncDir(s.dir); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync chunk directory: %w", err)
+	}
+	seg := &segment{id: id, f: f, tombstones: make(map[uint64]int64)}
+
+	s.mu.Lock()
+	s.segments[id] = seg
+	s.active = seg
+	s.activeRecords = nil
+	s.mu.Unlock()
+	return nil
+}
+
+// roll seals the active segment by writing its index, then starts the next one.
+// Callers hold writeMu.
+func (s *SegmentStore) roll() error {
+	s.mu.RLock()
+	seg, records := s.active, s.activeRecords
+	s.mu.RUnlock()
+
+	if err := s.writeIndex(seg, records); err != nil {
+		return err
+	}
+	return s.createSegment(seg.id + 1)
+}
+
+// appendRecords writes encoded records to the active segment and fsyncs it,
+// returning the segment and the offset of each record. Callers hold writeMu.
+func (s *SegmentStore) appendRecords(recs [][]byte) (*segment, []int64, error) {
+	var buf []byte
+	offsets := make([]int64, len(recs))
+	for i, rec := range recs {
+		offsets[i] = int64(len(buf))
+		buf = append(buf, rec...)
+	}
+	seg, start, err := s.append(func(w io.Writer) error {
+		_, err := w.Write(buf)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range offsets {
+		offsets[i] += start
+	}
+	return seg, offsets, nil
+}
+
+// append writes to the end of the active segment through write and fsyncs it,
+// sealing the segment first if it is full. It returns the segment and the offset
+// the write started at. A failed write is cut off again so it cannot be mistaken
+// for data. Callers hold writeMu.
+func (s *SegmentStore) append(write func(w io.Writer) error) (*segment, int64, error) {
+	s.mu.RLock()
+	full := s.active.size >= s.opts.SegmentSize
+	s.mu.RUnlock()
+	if full {
+		if err := s.roll(); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	s.mu.RLock()
+	seg := s.active
+	start := seg.size
+	s.mu.RUnlock()
+
+	w := io.NewOffsetWriter(seg.f, start)
+	if err := write(w); err != nil {
+		seg.f.Truncate(start)
+		return nil, 0, fmt.Errorf("failed to write segment: %w", err)
+	}
+	if err := seg.f.Sync(); err != nil {
+		seg.f.Truncate(start)
+		return nil, 0, fmt.Errorf("failed to sync segment: %w", err)
+	}
+	written, _ := w.Seek(0, io.SeekCurrent)
+
+	s.mu.Lock()
+	seg.size = start + written
+	s.mu.Unlock()
+	return seg, start, nil
+}
+
+// commit applies records appended to seg. Callers hold writeMu.
+func (s *SegmentStore) commit(seg *segment, recs []record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rec := range recs {
+		s.apply(seg, rec)
+		if seg == s.active {
+			s.activeRecords = append(s.activeRecords, rec)
+		}
+	}
+}
+
+func encodeRecord(typ byte, key Key, arg int64, body []byte) []byte {
+	buf := encodeHeader(typ, key, arg, recordHeaderSize+len(body)+recordTrailerSize)
+	buf = append(buf, body...)
+	return binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// encodeHeader returns a record header in a buffer with room for capacity bytes
+func encodeHeader(typ byte, key Key, arg int64, capacity int) []byte {
+	buf := make([]byte, recordHeaderSize, capacity)
+	buf[0] = typ
+	hex.Decode(buf[1:1+sha256.Size], []byte(key))
+	binary.BigEndian.PutUint64(buf[1+sha256.Size:], uint64(arg))
+	return buf
+}
+
+func decodeHeader(buf []byte) (record, error) {
+	rec := record{
+		typ: buf[0],
+		key: Key(hex.EncodeToString(buf[1 : 1+sha256.Size])),
+		arg: int64(binary.BigEndian.Uint64(buf[1+sha256.Size:])),
+	}
+	if (rec.typ != recordPut && rec.typ != recordTombstone) || rec.arg < 0 {
+		return record{}, ErrCorrupt
+	}
+	return rec, nil
+}
+
+// segmentScan is what scanSegment found in a segment
+type segmentScan struct {
+	records []record
+	damaged []record // Complete records that failed their CRC and were skipped
+	valid   int64    // Bytes read before scanning stopped; the segment size unless err is set
+	err     error    // Why scanning stopped early; io.ErrUnexpectedEOF for a record cut short
+}
+
+// scanSegment reads the records of a segment. A record whose header is intact but
+// whose CRC fails is skipped, since its size says where the next one starts. Scanning
+// stops at a header that cannot be decoded or a record that runs past the end.
+func scanSegment(f *os.File, size int64) segmentScan {
+	r := bufio.NewReaderSize(io.NewSectionReader(f, 0, size), 1<<20)
+	var scan segmentScan
+	header := make([]byte, recordHeaderSize)
+	for scan.valid < size {
+		offset := scan.valid
+		if _, err := io.ReadFull(r, header); err != nil {
+			scan.err = fmt.Errorf("failed to read record header: %w", io.ErrUnexpectedEOF)
+			return scan
+		}
+		rec, err := decodeHeader(header)
+		if err != nil {
+			scan.err = err
+			return scan
+		}
+		rec.offset = offset
+		if offset+rec.size() > size {
+			scan.err = io.ErrUnexpectedEOF
+			return scan
+		}
+
+		crc := crc32.NewIEEE()
+		crc.Write(header)
+		if rec.typ == recordPut {
+			if _, err := io.CopyN(crc, r, rec.arg); err != nil {
+				scan.err = fmt.Errorf("failed to read record body: %w", err)
+				return scan
+			}
+		}
+		var sum [recordTrailerSize]byte
+		if _, err := io.ReadFull(r, sum[:]); err != nil {
+			scan.err = fmt.Errorf("failed to read record checksum: %w", err)
+			return scan
+		}
+		if binary.BigEndian.Uint32(sum[:]) == crc.Sum32() {
+			scan.records = append(scan.records, rec)
+		} else {
+			scan.damaged = append(scan.damaged, rec)
+		}
+		scan.valid += rec.size()
+	}
+	return scan
+}
+
+// writeIndex records the records of a sealed segment, so opening the store does not
+// have to read its chunks. The index ends with the segment size and a CRC.
+func (s *SegmentStore) writeIndex(seg *segment, records []record) error {
+	buf := make([]byte, 0, len(records)*indexEntrySize+8+recordTrailerSize)
+	for _, rec := range records {
+		buf = append(buf, rec.typ)
+		key, _ := hex.DecodeString(string(rec.key))
+		buf = append(buf, key...)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(rec.arg))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(rec.offset))
+	}
+	buf = binary.BigEndian.AppendUint64(buf, uint64(seg.size))
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+
+	path := s.indexPath(seg.id)
+	tmpPath := path + tempExt
+	if err := os.WriteFile(tmpPath, buf, 0644); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write segment index: %w", err)
+	}
+	f, err := os.Open(tmpPath)
+	if err == nil {
+		err = f.Sync()
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to sync segment index: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to commit segment index: %w", err)
+	}
+	if err := syncDir(s.dir); err != nil {
+		return fmt.Errorf("failed to sync chunk directory: %w", err)
+	}
+	return nil
+}
+
+// readIndex loads the index of a sealed segment. An index that is damaged or does
+// not match the segment's size is an error, and the segment is scanned instead.
+func (s *SegmentStore) readIndex(seg *segment) ([]record, error) {
+	buf, err := os.ReadFile(s.indexPath(seg.id))
+	if err != nil {
+		return nil, err
+	}
+	n := len(buf) - 8 - recordTrailerSize
+	if n < 0 || n%indexEntrySize != 0 {
+		return nil, errors.New("segment index has an invalid size")
+	}
+	if binary.BigEndian.Uint32(buf[len(buf)-recordTrailerSize:]) != crc32.ChecksumIEEE(buf[:len(buf)-recordTrailerSize]) {
+		return nil, errors.New("segment index is corrupt")
+	}
+	if int64(binary.BigEndian.Uint64(buf[n:])) != seg.size {
+		return nil, errors.New("segment index does not match the segment")
+	}
+
+	records := make([]record, 0, n/indexEntrySize)
+	for i := 0; i < n; i += indexEntrySize {
+		rec, err := decodeHeader(buf[i : i+recordHeaderSize])
+		if err != nil {
+			return nil, err
+		}
+		rec.offset = int64(binary.BigEndian.Uint64(buf[i+recordHeaderSize:]))
+		if rec.offset < 0 || rec.offset+rec.size() > seg.size {
+			return nil, errors.New("segment index points past the segment")
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+func (s *SegmentStore) Put(ctx context.Context, key Key, r io.Reader) (Info, error) {
+	if _, err := ParseKey(string(key)); err != nil {
+		return Info{}, err
+	}
+	// Chunks are spooled, so a slow upload never holds up other writes
+	body, err := s.spool(r)
+	if err != nil {
+		return Info{}, err
+	}
+	defer body.Close()
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	seg, offset, err := s.append(func(w io.Writer) error {
+		crc := crc32.NewIEEE()
+		out := io.MultiWriter(w, crc)
+		if _, err := out.Write(encodeHeader(recordPut, key, body.size, recordHeaderSize)); err != nil {
+			return err
+		}
+		if n, err := io.Copy(out, body); err != nil {
+			return err
+		} else if n != body.size {
+			return fmt.Errorf("spooled chunk changed size from %d to %d bytes", body.size, n)
+		}
+		_, err := w.Write(binary.BigEndian.AppendUint32(nil, crc.Sum32()))
+		return err
+	})
+	if err != nil {
+		return Info{}, err
+	}
+	s.commit(seg, []record{{typ: recordPut, key: key, arg: body.size, offset: offset}})
+	return Info{Key: key, Size: body.size, Location: recordLocation(seg, offset)}, nil
+}
+
+// spooledChunk is a chunk body read ahead of its append: in memory, or in a temporary
+// file once it outgrows spoolMemorySize
+type spooledChunk struct {
+	io.Reader
+	file *os.File
+	size int64
+}
+
+// spool reads a chunk body to its end
+func (s *SegmentStore) spool(r io.Reader) (*spooledChunk, error) {
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r, spoolMemorySize+1)
+	if err == io.EOF {
+		return &spooledChunk{Reader: &buf, size: n}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk: %w", err)
+	}
+
+	f, err := os.CreateTemp(s.dir, "spool-*"+tempExt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to spool chunk: %w", err)
+	}
+	chunk := &spooledChunk{Reader: f, file: f}
+	if chunk.size, err = io.Copy(f, io.MultiReader(&buf, r)); err != nil {
+		chunk.Close()
+		return nil, fmt.Errorf("failed to spool chunk: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		chunk.Close()
+		return nil, fmt.Errorf("failed to spool chunk: %w", err)
+	}
+	return chunk, nil
+}
+
+func (c *spooledChunk) Close() {
+	if c.file != nil {
+		c.file.Close()
+		os.Remove(c.file.Name())
+	}
+}
+
+func recordLocation(seg *segment, offset int64) string {
+	return fmt.Sprintf("%s:%d", seg.f.Name(), offset)
+}
+
+// segmentReader streams a chunk body and checks the record's CRC once it is read
+type segmentReader struct {
+	body  *io.SectionReader
+	crc   hash.Hash32
+	seg   *segment
+	sumAt int64
+	once  sync.Once
+}
+
+func (r *segmentReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.crc.Write(p[:n])
+	if err == io.EOF {
+		var sum [recordTrailerSize]byte
+		if _, err := r.seg.f.ReadAt(sum[:], r.sumAt); err != nil {
+			return n, fmt.Errorf("failed to read chunk checksum: %w", err)
+		}
+		if binary.BigEndian.Uint32(sum[:]) != r.crc.Sum32() {
+			return n, ErrCorrupt
+		}
+	}
+	return n, err
+}
+
+func (r *segmentReader) Close() error {
+	r.once.Do(r.seg.readers.Done)
+	return nil
+}
+
+func (s *SegmentStore) Get(ctx context.Context, key Key) (io.ReadCloser, error) {
+	if _, err := ParseKey(string(key)); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	loc, ok := s.index[key]
+	if ok {
+		// Registered under the lock, so compaction cannot remove the file under us
+		loc.seg.readers.Add(1)
+	}
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	header := make([]byte, recordHeaderSize)
+	if _, err := loc.seg.f.ReadAt(header, loc.offset); err != nil {
+		loc.seg.readers.Done()
+		return nil, fmt.Errorf("failed to read chunk record: %w", err)
+	}
+	if rec, err := decodeHeader(header); err != nil || rec.typ != recordPut || rec.key != key || rec.arg != loc.size {
+		loc.seg.readers.Done()
+		return nil, ErrCorrupt
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write(header)
+	bodyAt := loc.offset + recordHeaderSize
+	return &segmentReader{
+		body:  io.NewSectionReader(loc.seg.f, bodyAt, loc.size),
+		crc:   crc,
+		seg:   loc.seg,
+		sumAt: bodyAt + loc.size,
+	}, nil
+}
+
+func (s *SegmentStore) Delete(ctx context.Context, key Key) error {
+	if _, err := ParseKey(string(key)); err != nil {
+		return err
+	}
+
+	s.writeMu.Lock()
+	s.mu.RLock()
+	loc, ok := s.index[key]
+	s.mu.RUnlock()
+	if !ok {
+		s.writeMu.Unlock()
+		return nil
+	}
+	target := int64(loc.seg.id)
+	seg, offsets, err := s.appendRecords([][]byte{encodeRecord(recordTombstone, key, target, nil)})
+	if err == nil {
+		s.commit(seg, []record{{typ: recordTombstone, key: key, arg: target, offset: offsets[0]}})
+	}
+	s.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	s.maybeCompact()
+	return nil
+}
+
+func (s *SegmentStore) Stat(ctx context.Context, key Key) (Info, error) {
+	if _, err := ParseKey(string(key)); err != nil {
+		return Info{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	loc, ok := s.index[key]
+	if !ok {
+		return Info{}, ErrNotFound
+	}
+	return Info{Key: key, Size: loc.size, Location: recordLocation(loc.seg, loc.offset)}, nil
+}
+
+// List returns every chunk in the store, sorted by key
+func (s *SegmentStore) List(ctx context.Context) ([]Info, error) {
+	s.mu.RLock()
+	infos := make([]Info, 0, len(s.index))
+	for key, loc := range s.index {
+		infos = append(infos, Info{Key: key, Size: loc.size, Location: recordLocation(loc.seg, loc.offset)})
+	}
+	s.mu.RUnlock()
+	sortInfos(infos)
+	return infos, nil
+}
+
+// garbage returns the bytes of seg that compaction would drop: puts that were
+// replaced or deleted, and tombstones no longer needed. Callers hold mu.
+func (s *SegmentStore) garbage(seg *segment) int64 {
+	needed := seg.live
+	oldest := s.oldestSegment(seg.id)
+	for target, size := range seg.tombstones {
+		if tombstoneNeeded(target, oldest) {
+			needed += size
+		}
+	}
+	return seg.size - needed
+}
+
+// oldestSegment returns the lowest id of the segments on disk other than except,
+// including compacted ones whose files are still being removed, or 0 if there are
+// none. Callers hold mu.
+func (s *SegmentStore) oldestSegment(except uint64) uint64 {
+	var oldest uint64
+	for id := range s.segments {
+		if id != except && (oldest == 0 || id < oldest) {
+			oldest = id
+		}
+	}
+	for id := range s.retired {
+		if id != except && (oldest == 0 || id < oldest) {
+			oldest = id
+		}
+	}
+	return oldest
+}
+
+// tombstoneNeeded reports whether a tombstone deleting a put in segment target must be
+// kept while oldest is the oldest segment left. Any segment up to target may hold an
+// earlier put of the key, which replaying would bring back; later segments cannot,
+// since target held the newest put when the tombstone was written.
+func tombstoneNeeded(target, oldest uint64) bool {
+	return oldest != 0 && oldest <= target
+}
+
+// maybeCompact starts a compaction in the background unless one is running
+func (s *SegmentStore) maybeCompact() {
+	if !s.compacting.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer s.compacting.Store(false)
+		if err := s.compact(); err != nil {
+			fmt.Printf("Warning: Failed to compact segments in %s: %v\n", s.dir, err)
+		}
+	}()
+}
+
+// compact rewrites every sealed segment whose garbage has reached GarbagePercent.
+// Only maybeCompact calls it, so compactions never overlap.
+func (s *SegmentStore) compact() error {
+	s.mu.RLock()
+	var candidates []*segment
+	for _, seg := range s.segments {
+		if seg != s.active && seg.size > 0 && s.garbage(seg)*100 >= seg.size*int64(s.opts.GarbagePercent) {
+			candidates = append(candidates, seg)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].id < candidates[j].id })
+
+	for _, seg := range candidates {
+		if err := s.compactSegment(seg); err != nil {
+			return fmt.Errorf("segment %d: %w", seg.id, err)
+		}
+	}
+	return nil
+}
+
+// compactSegment copies the live records of a sealed segment to the active segment
+// and removes it. Copies are fsynced before the old file goes, so a crash at any
+// point leaves every chunk readable.
+func (s *SegmentStore) compactSegment(seg *segment) error {
+	records, err := s.readIndex(seg)
+	if err != nil {
+		s.mu.RLock()
+		size := seg.size
+		s.mu.RUnlock()
+		scan := scanSegment(seg.f, size)
+		if scan.err != nil {
+			return fmt.Errorf("failed to read segment: %w", scan.err)
+		}
+		records = scan.records
+	}
+
+	var copied int64
+	for len(records) > 0 {
+		n, err := s.copyBatch(seg, &records)
+		if err != nil {
+			return err
+		}
+		copied += n
+	}
+
+	s.mu.Lock()
+	size := seg.size
+	delete(s.segments, seg.id)
+	s.retired[seg.id] = true
+	s.mu.Unlock()
+
+	// Readers that opened a chunk before the copy still use the old file. Until the
+	// file is gone, the tombstones overriding its puts are still needed.
+	go func() {
+		seg.readers.Wait()
+		seg.f.Close()
+		os.Remove(s.indexPath(seg.id))
+		err := os.Remove(s.segmentPath(seg.id))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			fmt.Printf("Warning: Failed to remove compacted segment %s: %v\n", seg.f.Name(), err)
+			return
+		}
+		if err := syncDir(s.dir); err != nil {
+			fmt.Printf("Warning: Failed to sync chunk directory %s: %v\n", s.dir, err)
+			return
+		}
+		s.mu.Lock()
+		delete(s.retired, seg.id)
+		s.mu.Unlock()
+	}()
+	fmt.Printf("Compacted segment %s, freeing %d bytes\n", seg.f.Name(), size-copied)
+	return nil
+}
+
+// copyBatch copies the next records of seg that are still needed, up to
+// compactBatchSize bytes, consuming them from records. It returns the bytes copied.
+func (s *SegmentStore) copyBatch(seg *segment, records *[]record) (int64, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	var encoded [][]byte
+	var copies []record
+	var batch int64
+	for len(*records) > 0 && batch < compactBatchSize {
+		rec := (*records)[0]
+		*records = (*records)[1:]
+
+		s.mu.RLock()
+		loc, live := s.index[rec.key]
+		oldest := s.oldestSegment(seg.id)
+		s.mu.RUnlock()
+
+		switch rec.typ {
+		case recordPut:
+			if !live || loc.seg != seg || loc.offset != rec.offset {
+				continue // Replaced or deleted since
+			}
+			buf := make([]byte, rec.size())
+			if _, err := seg.f.ReadAt(buf, rec.offset); err != nil {
+				return 0, fmt.Errorf("failed to read chunk record: %w", err)
+			}
+			end := len(buf) - recordTrailerSize
+			if binary.BigEndian.Uint32(buf[end:]) != crc32.ChecksumIEEE(buf[:end]) {
+				return 0, fmt.Errorf("chunk %s: %w", rec.key, ErrCorrupt)
+			}
+			encoded = append(encoded, buf)
+		case recordTombstone:
+			// A put written since supersedes it; otherwise it must outlive every
+			// segment that may hold an older put of the key
+			if live || !tombstoneNeeded(uint64(rec.arg), oldest) {
+				continue
+			}
+			encoded = append(encoded, encodeRecord(recordTombstone, rec.key, rec.arg, nil))
+		}
+		copies = append(copies, rec)
+		batch += rec.size()
+	}
+	if len(encoded) == 0 {
+		return 0, nil
+	}
+
+	active, offsets, err := s.appendRecords(encoded)
+	if err != nil {
+		return 0, err
+	}
+	for i := range copies {
+		copies[i].offset = offsets[i]
+	}
+	s.commit(active, copies)
+	return batch, nil
+}
@@ -0,0 +1,377 @@
+package chunkstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openSegments(t *testing.T, dir string, opts SegmentOptions) *SegmentStore {
+	t.Helper()
+	s, err := NewSegmentStore(dir, opts)
+	if err != nil {
+		t.Fatalf("NewSegmentStore: %v", err)
+	}
+	t.Cleanup(func() { closeSegmentStore(s) })
+	return s
+}
+
+// heldCompaction records the stores holdCompaction has been called on
+var heldCompaction sync.Map
+
+// holdCompaction waits for a background compaction to finish and keeps new ones
+// from starting, so a test can compact at the points it chooses
+func holdCompaction(s *SegmentStore) {
+	if _, held := heldCompaction.LoadOrStore(s, true); held {
+		return
+	}
+	for !s.compacting.CompareAndSwap(false, true) {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func closeSegmentStore(s *SegmentStore) {
+	holdCompaction(s)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeSegments()
+}
+
+// waitRetired waits until compacted segment files have been removed
+func waitRetired(t *testing.T, s *SegmentStore) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.RLock()
+		n := len(s.retired)
+		s.mu.RUnlock()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d compacted segments were not removed", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func reopenSegments(t *testing.T, s *SegmentStore) *SegmentStore {
+	t.Helper()
+	waitRetired(t, s)
+	closeSegmentStore(s)
+	return openSegments(t, s.dir, s.opts)
+}
+
+func rollSegment(t *testing.T, s *SegmentStore) {
+	t.Helper()
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.roll(); err != nil {
+		t.Fatalf("roll: %v", err)
+	}
+}
+
+func putChunk(t *testing.T, s ChunkStore, data []byte) Key {
+	t.Helper()
+	key := KeyOf(data)
+	info, err := s.Put(context.Background(), key, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if info.Size != int64(len(data)) {
+		t.Fatalf("Put stored %d bytes, want %d", info.Size, len(data))
+	}
+	return key
+}
+
+func wantChunk(t *testing.T, s ChunkStore, data []byte) {
+	t.Helper()
+	rc, err := s.Get(context.Background(), KeyOf(data))
+	if err != nil {
+		t.Fatalf("Get %s: %v", KeyOf(data), err)
+	}
+	defer rc.Close()
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("read %s: %v", KeyOf(data), err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Get %s returned %d different bytes", KeyOf(data), len(got))
+	}
+}
+
+func wantMissing(t *testing.T, s ChunkStore, key Key) {
+	t.Helper()
+	if _, err := s.Get(context.Background(), key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get %s: got %v, want ErrNotFound", key, err)
+	}
+}
+
+func chunkData(seed byte, n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = seed + byte(i*7)
+	}
+	return data
+}
+
+func TestSegmentStorePutGetDelete(t *testing.T) {
+	s := openSegments(t, t.TempDir(), SegmentOptions{SegmentSize: 1 << 20, GarbagePercent: 50})
+	a, b := chunkData(1, 100), chunkData(2, 5000)
+	putChunk(t, s, a)
+	putChunk(t, s, b)
+	wantChunk(t, s, a)
+	wantChunk(t, s, b)
+
+	if err := s.Delete(context.Background(), KeyOf(a)); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	wantMissing(t, s, KeyOf(a))
+	infos, err := s.List(context.Background())
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(infos) != 1 || infos[0].Key != KeyOf(b) {
+		t.Fatalf("List returned %v, want only %s", infos, KeyOf(b))
+	}
+
+	s = reopenSegments(t, s)
+	wantMissing(t, s, KeyOf(a))
+	wantChunk(t, s, b)
+}
+
+func TestSegmentStoreSpoolsLargeChunks(t *testing.T) {
+	s := openSegments(t, t.TempDir(), SegmentOptions{SegmentSize: 1 << 20, GarbagePercent: 50})
+	big := chunkData(3, 3*spoolMemorySize+17)
+	putChunk(t, s, big)
+	wantChunk(t, s, big)
+
+	spools, _ := filepath.Glob(filepath.Join(s.dir, "*"+tempExt))
+	if len(spools) > 0 {
+		t.Fatalf("spool files left behind: %v", spools)
+	}
+	s = reopenSegments(t, s)
+	wantChunk(t, s, big)
+}
+
+// A tombstone must outlive every older segment that may hold a put of its key, even
+// once the put it deleted has been compacted away
+func TestSegmentStoreTombstoneOutlivesOlderPuts(t *testing.T) {
+	s := openSegments(t, t.TempDir(), SegmentOptions{SegmentSize: 1 << 20, GarbagePercent: 50})
+	holdCompaction(s)
+	ctx := context.Background()
+	keep, k := chunkData(4, 10000), chunkData(5, 100)
+
+	// Segment 1 keeps a live chunk, so it is never compacted, and an old put of k
+	putChunk(t, s, keep)
+	putChunk(t, s, k)
+	rollSegment(t, s)
+	if err := s.Delete(ctx, KeyOf(k)); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	rollSegment(t, s)
+	putChunk(t, s, k)
+	rollSegment(t, s)
+	if err := s.compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	waitRetired(t, s)
+
+	if err := s.Delete(ctx, KeyOf(k)); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	rollSegment(t, s)
+	// The first pass removes the put the tombstone names, the second revisits the
+	// tombstone with its target gone
+	for range 2 {
+		if err := s.compact(); err != nil {
+			t.Fatalf("compact: %v", err)
+		}
+		waitRetired(t, s)
+	}
+	if _, ok := s.segments[1]; !ok {
+		t.Fatal("segment 1 was compacted")
+	}
+
+	s = reopenSegments(t, s)
+	wantMissing(t, s, KeyOf(k))
+	wantChunk(t, s, keep)
+}
+
+func TestSegmentStoreDropsTombstonesOnceOlderSegmentsAreGone(t *testing.T) {
+	s := openSegments(t, t.TempDir(), SegmentOptions{SegmentSize: 1 << 20, GarbagePercent: 50})
+	holdCompaction(s)
+	k := chunkData(6, 100)
+
+	putChunk(t, s, k)
+	rollSegment(t, s)
+	if err := s.Delete(context.Background(), KeyOf(k)); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	rollSegment(t, s)
+	if err := s.compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	waitRetired(t, s)
+	// The tombstone was still needed while segment 1 was on disk; now it is not
+	if err := s.compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	waitRetired(t, s)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.segments) != 1 || s.active.size != 0 {
+		t.Fatalf("%d segments left, active holds %d bytes; want only an empty active segment", len(s.segments), s.active.size)
+	}
+}
+
+// activeSegmentPath returns the file of the segment a store is appending to
+func activeSegmentPath(s *SegmentStore) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.segmentPath(s.active.id)
+}
+
+func TestSegmentStoreCutsTornTail(t *testing.T) {
+	for name, tear := range map[string]func(path string, size int64) error{
+		"short record": func(path string, size int64) error {
+			return os.Truncate(path, size-10)
+		},
+		"bad checksum": func(path string, size int64) error {
+			return corruptByte(path, size-1)
+		},
+		"zeroed": func(path string, size int64) error {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = f.Write(make([]byte, 300))
+			return err
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := openSegments(t, t.TempDir(), SegmentOptions{SegmentSize: 1 << 20, GarbagePercent: 50})
+			a, b := chunkData(7, 100), chunkData(8, 200)
+			putChunk(t, s, a)
+			putChunk(t, s, b)
+			path := activeSegmentPath(s)
+			closeSegmentStore(s)
+
+			wantSize := int64(recordHeaderSize + len(a) + recordTrailerSize)
+			if name == "zeroed" {
+				wantSize += recordHeaderSize + int64(len(b)) + recordTrailerSize
+			}
+			if err := tear(path, wantSize+recordHeaderSize+int64(len(b))+recordTrailerSize); err != nil {
+				t.Fatal(err)
+			}
+
+			s = openSegments(t, s.dir, s.opts)
+			wantChunk(t, s, a)
+			if name == "zeroed" {
+				wantChunk(t, s, b)
+			} else {
+				wantMissing(t, s, KeyOf(b))
+			}
+			if fi, err := os.Stat(path); err != nil || fi.Size() != wantSize {
+				t.Fatalf("segment is %v bytes (%v), want %d", fi.Size(), err, wantSize)
+			}
+			putChunk(t, s, b)
+			wantChunk(t, s, b)
+		})
+	}
+}
+
+func corruptByte(path string, offset int64) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, offset); err != nil {
+		return err
+	}
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, offset)
+	return err
+}
+
+func TestSegmentStoreSkipsDamagedRecord(t *testing.T) {
+	s := openSegments(t, t.TempDir(), SegmentOptions{SegmentSize: 1 << 20, GarbagePercent: 50})
+	a, b, c := chunkData(9, 100), chunkData(10, 100), chunkData(11, 100)
+	putChunk(t, s, a)
+	putChunk(t, s, b)
+	putChunk(t, s, c)
+	path := activeSegmentPath(s)
+	closeSegmentStore(s)
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recSize := int64(recordHeaderSize + 100 + recordTrailerSize)
+	if err := corruptByte(path, recSize+recordHeaderSize+50); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openSegments(t, s.dir, s.opts)
+	wantChunk(t, s, a)
+	wantMissing(t, s, KeyOf(b))
+	wantChunk(t, s, c)
+	if after, err := os.Stat(path); err != nil || after.Size() != fi.Size() {
+		t.Fatalf("segment changed size from %d to %v (%v)", fi.Size(), after.Size(), err)
+	}
+}
+
+func TestSegmentStoreRefusesDamageBeforeData(t *testing.T) {
+	s := openSegments(t, t.TempDir(), SegmentOptions{SegmentSize: 1 << 20, GarbagePercent: 50})
+	putChunk(t, s, chunkData(12, 100))
+	putChunk(t, s, chunkData(13, 100))
+	putChunk(t, s, chunkData(14, 100))
+	path := activeSegmentPath(s)
+	closeSegmentStore(s)
+
+	// A damaged header hides where the records after it start
+	recSize := int64(recordHeaderSize + 100 + recordTrailerSize)
+	if err := corruptByte(path, recSize); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := NewSegmentStore(s.dir, s.opts); err == nil {
+		closeSegmentStore(s)
+		t.Fatal("NewSegmentStore opened a segment damaged before acknowledged chunks")
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() != 3*recSize {
+		t.Fatalf("damaged segment was truncated to %v bytes (%v)", fi.Size(), err)
+	}
+}
+
+func TestSegmentStoreImportsFileStoreChunks(t *testing.T) {
+	dir := t.TempDir()
+	files, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := chunkData(15, 100), chunkData(16, 3000)
+	putChunk(t, files, a)
+	putChunk(t, files, b)
+
+	s := openSegments(t, dir, SegmentOptions{SegmentSize: 1 << 20, GarbagePercent: 50})
+	wantChunk(t, s, a)
+	wantChunk(t, s, b)
+	left, _ := filepath.Glob(filepath.Join(dir, "*", "*"+chunkExt))
+	if len(left) > 0 {
+		t.Fatalf("chunk files left after import: %v", left)
+	}
+
+	if _, err := OpenFileStore(dir); err == nil {
+		t.Fatal("OpenFileStore opened a directory holding segments")
+	}
+}
@@ -2,6 +2,7 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -10,20 +11,34 @@ import (
 	"net/http"
 	"os"
 	"sort"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/timskillet/distributed-filestore/internal/erasure"
 )
 
 // --- API Types ---
-type UploadTarget struct {
-	ChunkIndex int    `json:"chunk_index"`
+type ShardTarget struct {
+	ShardIndex int    `json:"shard_index"`
 	Node       string `json:"node"`
 	URL        string `json:"url"`
+	Checksum   string `json:"checksum,omitempty"`
+}
+
+type UploadTarget struct {
+	ChunkIndex   int           `json:"chunk_index"`
+	Node         string        `json:"node"`
+	URL          string        `json:"url"`
+	Shards       []ShardTarget `json:"shards,omitempty"`
+	Deduplicated bool          `json:"deduplicated,omitempty"`
 }
 
 type UploadPlan struct {
 	FileID        string         `json:"file_id"`
 	ChunkSize     int            `json:"chunk_size"`
+	DataShards    int            `json:"data_shards,omitempty"`
+	ParityShards  int            `json:"parity_shards,omitempty"`
 	UploadTargets []UploadTarget `json:"upload_targets"`
 }
 
@@ -33,7 +48,11 @@ const (
 	backoffMultiplier = 2
 )
 
-func InitUpload(apiURL, filePath string, chunkSize int) (*UploadPlan, error) {
+// InitUpload requests an upload plan. With dataShards set, each chunk is erasure-coded
+// into dataShards data and parityShards parity shards instead of being replicated.
+// Replicated uploads send the checksum of every chunk so the API server can skip
+// chunks the cluster already stores.
+func InitUpload(apiURL, filePath string, chunkSize int, dataShards, parityShards int) (*UploadPlan, error) {
 	fileInfo, err := os.Stat(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to stat file: %v", err)
@@ -44,6 +63,16 @@ func InitUpload(apiURL, filePath string, chunkSize int) (*UploadPlan, error) {
 		"size":       fileInfo.Size(),
 		"chunk_size": chunkSize,
 	}
+	if dataShards > 0 {
+		reqBody["data_shards"] = dataShards
+		reqBody["parity_shards"] = parityShards
+	} else if chunkSize > 0 {
+		checksums, err := chunkChecksums(filePath, chunkSize)
+		if err != nil {
+			return nil, err
+		}
+		reqBody["chunk_checksums"] = checksums
+	}
 
 	// Send upload request to API server
 	body, _ := json.Marshal(reqBody)
@@ -66,24 +95,64 @@ func InitUpload(apiURL, filePath string, chunkSize int) (*UploadPlan, error) {
 	return &plan, nil
 }
 
-func UploadChunks(filePath string, plan *UploadPlan) error {
+// chunkChecksums returns the SHA256 checksum of each chunkSize chunk of a file
+func chunkChecksums(filePath string, chunkSize int) ([]string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer file.Close()
+
+	var checksums []string
+	buffer := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(file, buffer)
+		if n > 0 {
+			hash := sha256.Sum256(buffer[:n])
+			checksums = append(checksums, hex.EncodeToString(hash[:]))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return checksums, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file: %v", err)
+		}
+	}
+}
+
+// UploadChunks uploads every chunk in the plan and returns the checksum of each chunk in
+// index order. For erasure-coded plans it also returns the checksum of every shard of
+// each chunk, by shard index.
+func UploadChunks(filePath string, plan *UploadPlan) ([]string, [][]string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, err
 	}
 	defer file.Close()
 
+	var codec *erasure.Codec
+	if plan.DataShards > 0 {
+		if codec, err = erasure.New(plan.DataShards, plan.ParityShards); err != nil {
+			return nil, nil, err
+		}
+	}
+
 	var wg sync.WaitGroup
 	var mu sync.Mutex
 	var failedChunks []int
 	chunkSize := plan.ChunkSize
 	buffer := make([]byte, chunkSize)
+	checksums := make([]string, len(plan.UploadTargets))
+	var shardChecksums [][]string
+	if codec != nil {
+		shardChecksums = make([][]string, len(plan.UploadTargets))
+	}
 
 	for _, target := range plan.UploadTargets {
 		// Read chunk from file
-		n, err := file.Read(buffer)
-		if err != nil && err != io.EOF {
-			return err
+		n, err := io.ReadFull(file, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, nil, err
 		}
 		if n == 0 {
 			break
@@ -96,6 +165,56 @@ func UploadChunks(filePath string, plan *UploadPlan) error {
 		// Calculate SHA256 checksum
 		hash := sha256.Sum256(chunkData)
 		checksum := hex.EncodeToString(hash[:])
+		if target.ChunkIndex >= 0 && target.ChunkIndex < len(checksums) {
+			checksums[target.ChunkIndex] = checksum
+		}
+
+		if target.Deduplicated {
+			fmt.Printf("♻️  Chunk %d already stored on %s, skipping (checksum: %s)\n", target.ChunkIndex, target.Node, checksum[:16]+"...")
+			continue
+		}
+
+		if len(target.Shards) > 0 {
+			if codec == nil {
+				return nil, nil, fmt.Errorf("chunk %d has shard targets but the plan is not erasure-coded", target.ChunkIndex)
+			}
+			shards, err := codec.Encode(chunkData)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to encode chunk %d: %v", target.ChunkIndex, err)
+			}
+			if target.ChunkIndex >= 0 && target.ChunkIndex < len(shardChecksums) {
+				shardChecksums[target.ChunkIndex] = make([]string, len(shards))
+				for i, shard := range shards {
+					shardHash := sha256.Sum256(shard)
+					shardChecksums[target.ChunkIndex][i] = hex.EncodeToString(shardHash[:])
+				}
+			}
+
+			// Upload every shard of the stripe concurrently with retry
+			for _, shardTarget := range target.Shards {
+				if shardTarget.ShardIndex < 0 || shardTarget.ShardIndex >= len(shards) {
+					return nil, nil, fmt.Errorf("chunk %d has invalid shard index %d", target.ChunkIndex, shardTarget.ShardIndex)
+				}
+				shard := shards[shardTarget.ShardIndex]
+				shardHash := sha256.Sum256(shard)
+				shardChecksum := hex.EncodeToString(shardHash[:])
+
+				wg.Add(1)
+				go func(chunkIndex int, shardTarget ShardTarget, shard []byte, checksum string) {
+					defer wg.Done()
+					err := uploadChunkWithRetry(shardTarget.URL, shard, chunkIndex, checksum)
+					if err != nil {
+						mu.Lock()
+						failedChunks = append(failedChunks, chunkIndex)
+						mu.Unlock()
+						fmt.Printf("❌ Shard %d of chunk %d failed after retries: %v\n", shardTarget.ShardIndex, chunkIndex, err)
+					} else {
+						fmt.Printf("✅ Shard %d of chunk %d uploaded to %s (checksum: %s)\n", shardTarget.ShardIndex, chunkIndex, shardTarget.Node, checksum[:16]+"...")
+					}
+				}(target.ChunkIndex, shardTarget, shard, shardChecksum)
+			}
+			continue
+		}
 
 		// Upload chunk concurrently with retry
 		wg.Add(1)
@@ -115,9 +234,9 @@ func UploadChunks(filePath string, plan *UploadPlan) error {
 	wg.Wait()
 
 	if len(failedChunks) > 0 {
-		return fmt.Errorf("failed to upload %d chunks: %v", len(failedChunks), failedChunks)
+		return nil, nil, fmt.Errorf("failed to upload %d chunks: %v", len(failedChunks), failedChunks)
 	}
-	return nil
+	return checksums, shardChecksums, nil
 }
 
 func uploadChunkWithRetry(url string, chunkData []byte, chunkIndex int, checksum string) error {
@@ -167,8 +286,14 @@ func uploadChunk(url string, chunkData []byte, checksum string) error {
 	return nil
 }
 
-func FinalizeUpload(apiURL, fileID string) error {
-	reqBody := map[string]string{"file_id": fileID}
+func FinalizeUpload(apiURL, fileID string, checksums []string, shardChecksums [][]string) error {
+	reqBody := map[string]interface{}{
+		"file_id":         fileID,
+		"chunk_checksums": checksums,
+	}
+	if shardChecksums != nil {
+		reqBody["shard_checksums"] = shardChecksums
+	}
 	body, _ := json.Marshal(reqBody)
 
 	resp, err := http.Post(apiURL+"/finalize-upload", "application/json", bytes.NewReader(body))
@@ -187,9 +312,15 @@ func FinalizeUpload(apiURL, fileID string) error {
 }
 
 type DownloadTarget struct {
-	ChunkIndex int    `json:"chunk_index"`
-	URL        string `json:"url"`
-	Checksum   string `json:"checksum"`
+	ChunkIndex   int           `json:"chunk_index"`
+	URL          string        `json:"url,omitempty"`
+	URLs         []string      `json:"urls,omitempty"`
+	HedgeAfterMS int           `json:"hedge_after_ms,omitempty"`
+	Checksum     string        `json:"checksum"`
+	Size         int           `json:"size,omitempty"`
+	DataShards   int           `json:"data_shards,omitempty"`
+	ParityShards int           `json:"parity_shards,omitempty"`
+	Shards       []ShardTarget `json:"shards,omitempty"`
 }
 
 func DownloadFile(apiURL, fileID string, outputPath string) error {
@@ -237,22 +368,15 @@ func DownloadFile(apiURL, fileID string, outputPath string) error {
 		wg.Add(1)
 		go func(t DownloadTarget) {
 			defer wg.Done()
-			resp, err := http.Get(t.URL)
-			if err != nil {
-				results <- chunkResult{index: t.ChunkIndex, err: fmt.Errorf("failed to download chunk: %v", err)}
-				return
-			}
-			defer resp.Body.Close()
-
-			if resp.StatusCode != http.StatusOK {
-				body, _ := io.ReadAll(resp.Body)
-				results <- chunkResult{index: t.ChunkIndex, err: fmt.Errorf("chunk download failed: %s", string(body))}
-				return
+			var data []byte
+			var err error
+			if len(t.Shards) > 0 {
+				data, err = downloadStripe(t)
+			} else {
+				data, err = downloadReplicas(t)
 			}
-
-			data, err := io.ReadAll(resp.Body)
 			if err != nil {
-				results <- chunkResult{index: t.ChunkIndex, err: fmt.Errorf("failed to read chunk data: %v", err)}
+				results <- chunkResult{index: t.ChunkIndex, err: err}
 				return
 			}
 
@@ -317,3 +441,231 @@ func DownloadFile(apiURL, fileID string, outputPath string) error {
 	fmt.Printf("✅ File downloaded to %s\n", outputPath)
 	return nil
 }
+
+func downloadChunk(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download chunk: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("chunk download failed: %s", string(body))
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk data: %v", err)
+	}
+	return data, nil
+}
+
+// downloadReplicas reads a replicated chunk, moving on to the next replica on a connection
+// error, a non-200 response or a checksum mismatch until one succeeds. If a replica has not
+// answered after HedgeAfterMS, the next one is asked too and whichever answers first wins.
+func downloadReplicas(t DownloadTarget) ([]byte, error) {
+	urls := t.URLs
+	if len(urls) == 0 {
+		urls = []string{t.URL}
+	}
+
+	type replicaResult struct {
+		index int
+		data  []byte
+		err   error
+	}
+
+	// Losing requests are cancelled once one replica answers
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := make(chan replicaResult, len(urls))
+	next, inFlight := 0, 0
+	launch := func() {
+		i := next
+		next++
+		inFlight++
+		go func() {
+			data, err := downloadChunk(ctx, urls[i])
+			if err == nil && t.Checksum != "" {
+				hash := sha256.Sum256(data)
+				if checksum := hex.EncodeToString(hash[:]); checksum != t.Checksum {
+					err = fmt.Errorf("checksum mismatch: expected %s, got %s", t.Checksum, checksum)
+				}
+			}
+			results <- replicaResult{i, data, err}
+		}()
+	}
+
+	var hedge <-chan time.Time
+	armHedge := func() {
+		hedge = nil
+		if t.HedgeAfterMS > 0 && next < len(urls) {
+			hedge = time.After(time.Duration(t.HedgeAfterMS) * time.Millisecond)
+		}
+	}
+
+	launch()
+	armHedge()
+
+	var errs []string
+	for inFlight > 0 {
+		select {
+		case <-hedge:
+			hedge = nil
+			fmt.Printf("🐢 Chunk %d replica %d of %d is slow, also trying the next one\n", t.ChunkIndex, next, len(urls))
+			launch()
+			armHedge()
+		case result := <-results:
+			inFlight--
+			if result.err == nil {
+				return result.data, nil
+			}
+
+			errs = append(errs, result.err.Error())
+			if next < len(urls) {
+				fmt.Printf("⚠️  Chunk %d replica %d of %d failed, trying the next one: %v\n", t.ChunkIndex, result.index+1, len(urls), result.err)
+				launch()
+			}
+			// Rearmed even when no replica is left, so a pending hedge cannot fire
+			armHedge()
+		}
+	}
+	return nil, fmt.Errorf("all %d replicas failed: %s", len(urls), strings.Join(errs, "; "))
+}
+
+// downloadStripe reads an erasure-coded chunk. It fetches DataShards shards at a time,
+// data shards first, until enough valid shards are in hand, then rebuilds the stripe.
+func downloadStripe(t DownloadTarget) ([]byte, error) {
+	codec, err := erasure.New(t.DataShards, t.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	type shardResult struct {
+		index int
+		data  []byte
+		err   error
+	}
+
+	shards := make([][]byte, codec.Shards())
+	have := 0
+	pending := t.Shards
+	for have < t.DataShards && len(pending) > 0 {
+		batch := pending[:min(t.DataShards-have, len(pending))]
+		pending = pending[len(batch):]
+
+		results := make(chan shardResult, len(batch))
+		for _, shard := range batch {
+			go func(shard ShardTarget) {
+				data, err := downloadChunk(context.Background(), shard.URL)
+				if err == nil && shard.Checksum != "" {
+					hash := sha256.Sum256(data)
+					if checksum := hex.EncodeToString(hash[:]); checksum != shard.Checksum {
+						err = fmt.Errorf("checksum mismatch: expected %s, got %s", shard.Checksum, checksum)
+					}
+				}
+				results <- shardResult{shard.ShardIndex, data, err}
+			}(shard)
+		}
+
+		for range batch {
+			result := <-results
+			if result.err != nil {
+				fmt.Printf("⚠️  Shard %d of chunk %d unavailable: %v\n", result.index, t.ChunkIndex, result.err)
+				continue
+			}
+			if result.index >= 0 && result.index < len(shards) && shards[result.index] == nil {
+				shards[result.index] = result.data
+				have++
+			}
+		}
+	}
+
+	if have < t.DataShards {
+		return nil, fmt.Errorf("only %d of the %d shards needed for chunk %d could be read", have, t.DataShards, t.ChunkIndex)
+	}
+	if rebuilt := t.DataShards - countPresent(shards[:t.DataShards]); rebuilt > 0 {
+		fmt.Printf("🔧 Rebuilding %d missing data shards of chunk %d\n", rebuilt, t.ChunkIndex)
+	}
+	return codec.Decode(shards, t.Size)
+}
+
+func countPresent(shards [][]byte) int {
+	n := 0
+	for _, shard := range shards {
+		if shard != nil {
+			n++
+		}
+	}
+	return n
+}
+
+type DrainStatus struct {
+	NodeID          string `json:"node_id"`
+	State           string `json:"state"`
+	Running         bool   `json:"running"`
+	ChunksTotal     int    `json:"chunks_total"`
+	ChunksMoved     int    `json:"chunks_moved"`
+	ChunksFailed    int    `json:"chunks_failed"`
+	ChunksRemaining int    `json:"chunks_remaining"`
+	BytesMoved      int64  `json:"bytes_moved"`
+	LastError       string `json:"last_error,omitempty"`
+}
+
+// DrainNode starts draining a node and reports progress until its chunks have moved away
+func DrainNode(apiURL, nodeID string) error {
+	resp, err := http.Post(fmt.Sprintf("%s/drain?node_id=%s", apiURL, nodeID), "application/json", nil)
+	if err != nil {
+		return fmt.Errorf("failed to start drain: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("failed to start drain: %s", string(body))
+	}
+	fmt.Printf("Draining node %s...\n", nodeID)
+
+	for {
+		time.Sleep(time.Second)
+
+		status, err := getDrainStatus(apiURL, nodeID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Moved %d/%d chunks (%d failed, %d bytes)\n", status.ChunksMoved, status.ChunksTotal, status.ChunksFailed, status.BytesMoved)
+		if status.Running {
+			continue
+		}
+
+		if status.State != "decommissioned" {
+			return fmt.Errorf("node %s is still draining: %s", nodeID, status.LastError)
+		}
+		fmt.Printf("Node %s decommissioned\n", nodeID)
+		return nil
+	}
+}
+
+func getDrainStatus(apiURL, nodeID string) (*DrainStatus, error) {
+	resp, err := http.Get(fmt.Sprintf("%s/drain-status?node_id=%s", apiURL, nodeID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get drain status: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to get drain status: %s", string(body))
+	}
+
+	var status DrainStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to decode drain status: %v", err)
+	}
+	return &status, nil
+}
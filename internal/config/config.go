@@ -4,29 +4,102 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 )
 
 type Config struct {
-	AWSRegion              string
-	ChunkMetadataTable     string
-	NodeRegistryTable      string
-	ReplicationFactor      int
-	ReplicationStrategy    string // "sync" or "async"
-	ReplicationTimeout     int    // seconds
-	NodeHeartbeatInterval  int    // seconds
-	NodeHeartbeatTimeout   int    // seconds (nodes considered dead after this)
+	MetadataBackend         string // "dynamodb", "memory", "file" or "remote"
+	MetadataURL             string // dfs-api base URL for the "remote" backend
+	MetadataToken           string // shared secret authenticating "remote" backend calls
+	MetadataDir             string // data directory for the "file" backend
+	MetadataSnapshotEvery   int    // log records between snapshots for the "file" backend
+	AWSRegion               string
+	DynamoDBEndpoint        string // custom endpoint, e.g. DynamoDB Local
+	DynamoDBAccessKeyID     string // static credentials (optional)
+	DynamoDBSecretAccessKey string
+	DynamoDBCreateTables    bool // create missing tables on startup
+	ChunkMetadataTable      string
+	NodeRegistryTable       string
+	FileMetadataTable       string
+	ChunkRefsTable          string
+	ReplicationFactor       int
+	ReplicationStrategy     string   // "sync" or "async"
+	ReplicationTimeout      int      // seconds
+	WriteQuorum             int      // replicas stored before an upload is acknowledged
+	ReadQuorum              int      // replicas whose checksums a download compares
+	HedgePercentile         int      // read latency percentile after which a download asks another replica (0 disables)
+	NodeHeartbeatInterval   int      // seconds
+	NodeHeartbeatTimeout    int      // seconds (nodes considered dead after this)
+	RepairInterval          int      // seconds between re-replication passes (0 disables)
+	RepairRate              int      // chunks re-replicated per second (0 is unlimited)
+	NodeDirectoryRefresh    int      // seconds between API node directory reloads
+	PlacementReserveMB      int      // nodes with less free space receive no new chunks
+	PlacementPolicy         string   // "weighted" or "rendezvous"
+	RebalanceBandwidthKB    int      // KB/s copied by the rebalancer (0 is unlimited)
+	RebalanceThreshold      int      // percent a node may sit above the mean stored bytes
+	MaxChunkSize            int      // bytes; largest chunk size an upload plan may use
+	DedupTrustedClients     bool     // link chunks by client-supplied checksum, which proves no ownership of the data
+	DedupMinChunkSize       int      // bytes; uploads with smaller chunks skip deduplication
+	NodeDataDir             string   // storage node state: replication queue, quarantine and default chunk directory (default ./<node_id>)
+	ChunkStore              string   // "filesystem", "segment" or "memory"
+	ChunkDirs               []string // data directories of the filesystem and segment chunk stores, one per disk (default <NodeDataDir>/chunks)
+	SegmentSizeMB           int      // segment chunk store: size at which a segment file is sealed
+	SegmentGarbagePercent   int      // segment chunk store: share of deleted bytes that triggers compaction of a segment
+	ScrubInterval           int      // seconds between node checksum scrubs (0 disables)
+	ScrubRateKB             int      // KB/s read by the scrubber (0 is unlimited)
 }
 
 func Load() (*Config, error) {
 	cfg := &Config{
-		AWSRegion:              getEnv("AWS_REGION", "us-east-1"),
-		ChunkMetadataTable:     getEnv("CHUNK_METADATA_TABLE", "dfs-chunk-metadata"),
-		NodeRegistryTable:      getEnv("NODE_REGISTRY_TABLE", "dfs-node-registry"),
-		ReplicationFactor:      getEnvInt("REPLICATION_FACTOR", 2),
-		ReplicationStrategy:    getEnv("REPLICATION_STRATEGY", "sync"),
-		ReplicationTimeout:     getEnvInt("REPLICATION_TIMEOUT", 30),
-		NodeHeartbeatInterval:  getEnvInt("NODE_HEARTBEAT_INTERVAL", 30),
-		NodeHeartbeatTimeout:   getEnvInt("NODE_HEARTBEAT_TIMEOUT", 60),
+		MetadataBackend:         getEnv("METADATA_BACKEND", "dynamodb"),
+		MetadataURL:             getEnv("METADATA_URL", ""),
+		MetadataToken:           getEnv("METADATA_TOKEN", ""),
+		MetadataDir:             getEnv("METADATA_DIR", "./metadata"),
+		MetadataSnapshotEvery:   getEnvInt("METADATA_SNAPSHOT_EVERY", 1000),
+		AWSRegion:               getEnv("AWS_REGION", "us-east-1"),
+		DynamoDBEndpoint:        getEnv("DYNAMODB_ENDPOINT", ""),
+		DynamoDBAccessKeyID:     getEnv("DYNAMODB_ACCESS_KEY_ID", ""),
+		DynamoDBSecretAccessKey: getEnv("DYNAMODB_SECRET_ACCESS_KEY", ""),
+		DynamoDBCreateTables:    getEnvBool("DYNAMODB_CREATE_TABLES", false),
+		ChunkMetadataTable:      getEnv("CHUNK_METADATA_TABLE", "dfs-chunk-metadata"),
+		NodeRegistryTable:       getEnv("NODE_REGISTRY_TABLE", "dfs-node-registry"),
+		FileMetadataTable:       getEnv("FILE_METADATA_TABLE", "dfs-file-metadata"),
+		ChunkRefsTable:          getEnv("CHUNK_REFS_TABLE", "dfs-chunk-refs"),
+		ReplicationFactor:       getEnvInt("REPLICATION_FACTOR", 2),
+		ReplicationStrategy:     getEnv("REPLICATION_STRATEGY", "sync"),
+		ReplicationTimeout:      getEnvInt("REPLICATION_TIMEOUT", 30),
+		WriteQuorum:             getEnvInt("WRITE_QUORUM", 0),
+		ReadQuorum:              getEnvInt("READ_QUORUM", 1),
+		HedgePercentile:         getEnvInt("HEDGE_PERCENTILE", 95),
+		NodeHeartbeatInterval:   getEnvInt("NODE_HEARTBEAT_INTERVAL", 30),
+		NodeHeartbeatTimeout:    getEnvInt("NODE_HEARTBEAT_TIMEOUT", 60),
+		RepairInterval:          getEnvInt("REPAIR_INTERVAL", 60),
+		RepairRate:              getEnvInt("REPAIR_RATE", 10),
+		NodeDirectoryRefresh:    getEnvInt("NODE_DIRECTORY_REFRESH", 15),
+		PlacementReserveMB:      getEnvInt("PLACEMENT_RESERVE_MB", 1024),
+		PlacementPolicy:         getEnv("PLACEMENT_POLICY", "weighted"),
+		RebalanceBandwidthKB:    getEnvInt("REBALANCE_BANDWIDTH_KB", 1024),
+		RebalanceThreshold:      getEnvInt("REBALANCE_THRESHOLD", 10),
+		MaxChunkSize:            getEnvInt("MAX_CHUNK_SIZE", 64<<20),
+		DedupTrustedClients:     getEnvBool("DEDUP_TRUSTED_CLIENTS", false),
+		DedupMinChunkSize:       getEnvInt("DEDUP_MIN_CHUNK_SIZE", 64<<10),
+		NodeDataDir:             getEnv("NODE_DATA_DIR", ""),
+		ChunkStore:              getEnv("CHUNK_STORE", "filesystem"),
+		ChunkDirs:               getEnvList("CHUNK_DIRS"),
+		SegmentSizeMB:           getEnvInt("SEGMENT_SIZE_MB", 64),
+		SegmentGarbagePercent:   getEnvInt("SEGMENT_GARBAGE_PERCENT", 50),
+		ScrubInterval:           getEnvInt("SCRUB_INTERVAL", 86400),
+		ScrubRateKB:             getEnvInt("SCRUB_RATE_KB", 1024),
+	}
+
+	if cfg.WriteQuorum == 0 {
+		cfg.WriteQuorum = DefaultWriteQuorum(cfg.ReplicationStrategy, cfg.ReplicationFactor)
+	}
+
+	// CHUNK_DIR is the single-directory setting CHUNK_DIRS replaced
+	if dir := strings.TrimSpace(os.Getenv("CHUNK_DIR")); dir != "" && len(cfg.ChunkDirs) == 0 {
+		fmt.Printf("Warning: CHUNK_DIR is deprecated, use CHUNK_DIRS\n")
+		cfg.ChunkDirs = []string{dir}
 	}
 
 	if err := cfg.Validate(); err != nil {
@@ -37,6 +110,22 @@ func Load() (*Config, error) {
 }
 
 func (c *Config) Validate() error {
+	switch c.MetadataBackend {
+	case "dynamodb", "memory":
+	case "file":
+		if c.MetadataDir == "" {
+			return fmt.Errorf("METADATA_DIR is required for the file metadata backend")
+		}
+	case "remote":
+		if c.MetadataURL == "" {
+			return fmt.Errorf("METADATA_URL is required for the remote metadata backend")
+		}
+		if c.MetadataToken == "" {
+			return fmt.Errorf("METADATA_TOKEN is required for the remote metadata backend")
+		}
+	default:
+		return fmt.Errorf("METADATA_BACKEND must be 'dynamodb', 'memory', 'file' or 'remote'")
+	}
 	if c.AWSRegion == "" {
 		return fmt.Errorf("AWS_REGION is required")
 	}
@@ -46,15 +135,87 @@ func (c *Config) Validate() error {
 	if c.NodeRegistryTable == "" {
 		return fmt.Errorf("NODE_REGISTRY_TABLE is required")
 	}
+	if c.FileMetadataTable == "" {
+		return fmt.Errorf("FILE_METADATA_TABLE is required")
+	}
+	if c.ChunkRefsTable == "" {
+		return fmt.Errorf("CHUNK_REFS_TABLE is required")
+	}
+	if (c.DynamoDBAccessKeyID == "") != (c.DynamoDBSecretAccessKey == "") {
+		return fmt.Errorf("DYNAMODB_ACCESS_KEY_ID and DYNAMODB_SECRET_ACCESS_KEY must be set together")
+	}
 	if c.ReplicationFactor < 1 {
 		return fmt.Errorf("REPLICATION_FACTOR must be at least 1")
 	}
 	if c.ReplicationStrategy != "sync" && c.ReplicationStrategy != "async" {
 		return fmt.Errorf("REPLICATION_STRATEGY must be 'sync' or 'async'")
 	}
+	if c.WriteQuorum < 1 || c.WriteQuorum > c.ReplicationFactor {
+		return fmt.Errorf("WRITE_QUORUM must be between 1 and REPLICATION_FACTOR")
+	}
+	if c.ReadQuorum < 1 || c.ReadQuorum > c.ReplicationFactor {
+		return fmt.Errorf("READ_QUORUM must be between 1 and REPLICATION_FACTOR")
+	}
+	if c.HedgePercentile < 0 || c.HedgePercentile > 100 {
+		return fmt.Errorf("HEDGE_PERCENTILE must be between 0 and 100")
+	}
+	if c.RepairInterval < 0 {
+		return fmt.Errorf("REPAIR_INTERVAL must not be negative")
+	}
+	if c.RepairRate < 0 {
+		return fmt.Errorf("REPAIR_RATE must not be negative")
+	}
+	if c.NodeDirectoryRefresh < 1 {
+		return fmt.Errorf("NODE_DIRECTORY_REFRESH must be at least 1")
+	}
+	if c.PlacementReserveMB < 0 {
+		return fmt.Errorf("PLACEMENT_RESERVE_MB must not be negative")
+	}
+	if c.PlacementPolicy != "weighted" && c.PlacementPolicy != "rendezvous" {
+		return fmt.Errorf("PLACEMENT_POLICY must be 'weighted' or 'rendezvous'")
+	}
+	if c.RebalanceBandwidthKB < 0 {
+		return fmt.Errorf("REBALANCE_BANDWIDTH_KB must not be negative")
+	}
+	if c.RebalanceThreshold < 0 {
+		return fmt.Errorf("REBALANCE_THRESHOLD must not be negative")
+	}
+	if c.MaxChunkSize < 1 {
+		return fmt.Errorf("MAX_CHUNK_SIZE must be at least 1")
+	}
+	if c.DedupMinChunkSize < 0 {
+		return fmt.Errorf("DEDUP_MIN_CHUNK_SIZE must not be negative")
+	}
+	switch c.ChunkStore {
+	case "filesystem", "memory":
+	case "segment":
+		if c.SegmentSizeMB < 1 {
+			return fmt.Errorf("SEGMENT_SIZE_MB must be at least 1")
+		}
+		if c.SegmentGarbagePercent < 1 || c.SegmentGarbagePercent > 100 {
+			return fmt.Errorf("SEGMENT_GARBAGE_PERCENT must be between 1 and 100")
+		}
+	default:
+		return fmt.Errorf("CHUNK_STORE must be 'filesystem', 'segment' or 'memory'")
+	}
+	if c.ScrubInterval < 0 {
+		return fmt.Errorf("SCRUB_INTERVAL must not be negative")
+	}
+	if c.ScrubRateKB < 0 {
+		return fmt.Errorf("SCRUB_RATE_KB must not be negative")
+	}
 	return nil
 }
 
+// DefaultWriteQuorum is the write quorum used when WRITE_QUORUM is unset: every
+// replica for sync replication, and only the primary for async replication
+func DefaultWriteQuorum(strategy string, replicas int) int {
+	if strategy == "async" {
+		return 1
+	}
+	return replicas
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -71,3 +232,22 @@ func getEnvInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+// getEnvList splits a comma-separated variable, dropping empty entries
+func getEnvList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return boolValue
+		}
+	}
+	return defaultValue
+}
@@ -2,7 +2,9 @@ package dynamodb
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"iter"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
@@ -17,7 +19,9 @@ type ChunkMetadata struct {
 	NodeID          string `dynamodbav:"node_id"`
 	Path            string `dynamodbav:"path"`
 	Checksum        string `dynamodbav:"checksum"`
-	ReplicaType     string `dynamodbav:"replica_type"` // "primary" or "secondary"
+	ReplicaType     string `dynamodbav:"replica_type"`          // "primary", "secondary" or "shard"
+	ShardIndex      int    `dynamodbav:"shard_index,omitempty"` // Position in the stripe of an erasure-coded chunk
+	Size            int64  `dynamodbav:"size,omitempty"`
 	CreatedAt       int64  `dynamodbav:"created_at"`
 }
 
@@ -44,87 +48,102 @@ func (c *Client) PutChunkMetadata(ctx context.Context, tableName string, metadat
 }
 
 // GetChunkReplicas returns all replicas for a specific chunk
-func (c *Client) GetChunkReplicas(ctx context.Context, tableName string, fileID string, chunkIndex int) ([]*ChunkMetadata, error) {
-	// Query by file_id (hash key) - all chunks for this file
-	// Filter by chunk_index in application code since range key is composite
-	result, err := c.svc.Query(ctx, &dynamodb.QueryInput{
+func (c *Client) GetChunkReplicas(ctx context.Context, tableName string, fileID string, chunkIndex int, opts ...QueryOption) ([]*ChunkMetadata, error) {
+	// chunk_replica_key is "chunk_index#node_id", so a prefix match selects one chunk
+	return Collect(c.queryChunks(ctx, &dynamodb.QueryInput{
 		TableName:              aws.String(tableName),
-		KeyConditionExpression: aws.String("file_id = :file_id"),
+		KeyConditionExpression: aws.String("file_id = :file_id AND begins_with(chunk_replica_key, :prefix)"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
 			":file_id": &types.AttributeValueMemberS{Value: fileID},
+			":prefix":  &types.AttributeValueMemberS{Value: fmt.Sprintf("%d#", chunkIndex)},
 		},
-	})
-
-	if err != nil {
-		return nil, fmt.Errorf("failed to query chunk replicas: %w", err)
-	}
-
-	var replicas []*ChunkMetadata
-	for _, item := range result.Items {
-		var metadata ChunkMetadata
-		if err := attributevalue.UnmarshalMap(item, &metadata); err != nil {
-			continue
-		}
-		// Filter by chunk_index
-		if metadata.ChunkIndex == chunkIndex {
-			replicas = append(replicas, &metadata)
-		}
-	}
-
-	return replicas, nil
+	}, "failed to query chunk replicas"), opts...)
 }
 
 // GetChunksByFileID returns all chunks (with all replicas) for a file
-func (c *Client) GetChunksByFileID(ctx context.Context, tableName string, fileID string) ([]*ChunkMetadata, error) {
-	result, err := c.svc.Query(ctx, &dynamodb.QueryInput{
+func (c *Client) GetChunksByFileID(ctx context.Context, tableName string, fileID string, opts ...QueryOption) ([]*ChunkMetadata, error) {
+	return Collect(c.IterChunksByFileID(ctx, tableName, fileID), opts...)
+}
+
+// IterChunksByFileID streams every chunk replica of a file, one page at a time
+func (c *Client) IterChunksByFileID(ctx context.Context, tableName string, fileID string) iter.Seq2[*ChunkMetadata, error] {
+	return c.queryChunks(ctx, &dynamodb.QueryInput{
 		TableName:              aws.String(tableName),
 		KeyConditionExpression: aws.String("file_id = :file_id"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
 			":file_id": &types.AttributeValueMemberS{Value: fileID},
 		},
-	})
-
-	if err != nil {
-		return nil, fmt.Errorf("failed to query chunks: %w", err)
-	}
-
-	var chunks []*ChunkMetadata
-	for _, item := range result.Items {
-		var metadata ChunkMetadata
-		if err := attributevalue.UnmarshalMap(item, &metadata); err != nil {
-			continue
-		}
-		chunks = append(chunks, &metadata)
-	}
-
-	return chunks, nil
+	}, "failed to query chunks")
 }
 
 // GetChunksByNodeID returns all chunks stored on a specific node (using GSI)
-func (c *Client) GetChunksByNodeID(ctx context.Context, tableName string, nodeID string) ([]*ChunkMetadata, error) {
-	result, err := c.svc.Query(ctx, &dynamodb.QueryInput{
+func (c *Client) GetChunksByNodeID(ctx context.Context, tableName string, nodeID string, opts ...QueryOption) ([]*ChunkMetadata, error) {
+	return Collect(c.IterChunksByNodeID(ctx, tableName, nodeID), opts...)
+}
+
+// IterChunksByNodeID streams every chunk replica stored on a node, one page at a time
+func (c *Client) IterChunksByNodeID(ctx context.Context, tableName string, nodeID string) iter.Seq2[*ChunkMetadata, error] {
+	return c.queryChunks(ctx, &dynamodb.QueryInput{
 		TableName:              aws.String(tableName),
 		IndexName:              aws.String("node-id-index"),
 		KeyConditionExpression: aws.String("node_id = :node_id"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
 			":node_id": &types.AttributeValueMemberS{Value: nodeID},
 		},
+	}, "failed to query chunks by node")
+}
+
+func (c *Client) queryChunks(ctx context.Context, input *dynamodb.QueryInput, errMsg string) iter.Seq2[*ChunkMetadata, error] {
+	return unmarshalItems[ChunkMetadata](c.queryItems(ctx, input), func(err error) error {
+		return fmt.Errorf("%s: %w", errMsg, err)
 	})
+}
 
+// MoveChunkReplica records a replica that moved to metadata.NodeID from fromNodeID:
+// the new record is written and the old one deleted in a single transaction. It fails
+// with ErrConditionFailed if the source replica no longer exists.
+func (c *Client) MoveChunkReplica(ctx context.Context, tableName string, metadata *ChunkMetadata, fromNodeID string) error {
+	metadata.ChunkReplicaKey = fmt.Sprintf("%d#%s", metadata.ChunkIndex, metadata.NodeID)
+
+	item, err := attributevalue.MarshalMap(metadata)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query chunks by node: %w", err)
+		return fmt.Errorf("failed to marshal chunk metadata: %w", err)
 	}
 
-	var chunks []*ChunkMetadata
-	for _, item := range result.Items {
-		var metadata ChunkMetadata
-		if err := attributevalue.UnmarshalMap(item, &metadata); err != nil {
-			continue
+	_, err = c.svc.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Put: &types.Put{
+					TableName: aws.String(tableName),
+					Item:      item,
+				},
+			},
+			{
+				Delete: &types.Delete{
+					TableName: aws.String(tableName),
+					Key: map[string]types.AttributeValue{
+						"file_id":           &types.AttributeValueMemberS{Value: metadata.FileID},
+						"chunk_replica_key": &types.AttributeValueMemberS{Value: fmt.Sprintf("%d#%s", metadata.ChunkIndex, fromNodeID)},
+					},
+					ConditionExpression: aws.String("attribute_exists(file_id)"),
+				},
+			},
+		},
+	})
+
+	if err != nil {
+		var canceled *types.TransactionCanceledException
+		if errors.As(err, &canceled) {
+			for _, reason := range canceled.CancellationReasons {
+				if aws.ToString(reason.Code) == "ConditionalCheckFailed" {
+					return fmt.Errorf("%w: replica of chunk %d on %s no longer exists", ErrConditionFailed, metadata.ChunkIndex, fromNodeID)
+				}
+			}
 		}
-		chunks = append(chunks, &metadata)
+		return fmt.Errorf("failed to move chunk metadata: %w", err)
 	}
 
-	return chunks, nil
+	return nil
 }
 
 // DeleteChunkMetadata deletes a specific chunk replica
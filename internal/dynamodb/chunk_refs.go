@@ -0,0 +1,111 @@
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ChunkRef counts the chunk replicas on a node that share one stored chunk body.
+// Bodies are keyed by checksum, so a node keeps a single copy of identical chunks.
+type ChunkRef struct {
+	Checksum string `dynamodbav:"checksum"`
+	NodeID   string `dynamodbav:"node_id"`
+	Refs     int64  `dynamodbav:"refs"`
+}
+
+// AdjustChunkRef atomically adds delta to a node's reference count for a chunk body
+// and returns the new count. A count that drops to zero or below removes the record.
+func (c *Client) AdjustChunkRef(ctx context.Context, tableName string, checksum string, nodeID string, delta int64) (int64, error) {
+	out, err := c.svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(tableName),
+		Key:              chunkRefKey(checksum, nodeID),
+		UpdateExpression: aws.String("ADD refs :delta"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":delta": &types.AttributeValueMemberN{Value: strconv.FormatInt(delta, 10)},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to update chunk ref: %w", err)
+	}
+
+	var updated struct {
+		Refs int64 `dynamodbav:"refs"`
+	}
+	if err := attributevalue.UnmarshalMap(out.Attributes, &updated); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal chunk ref: %w", err)
+	}
+
+	if updated.Refs <= 0 {
+		// Only remove the record if no reference was added in the meantime
+		_, err := c.svc.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName:           aws.String(tableName),
+			Key:                 chunkRefKey(checksum, nodeID),
+			ConditionExpression: aws.String("refs <= :zero"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":zero": &types.AttributeValueMemberN{Value: "0"},
+			},
+		})
+		var condErr *types.ConditionalCheckFailedException
+		if err != nil && !errors.As(err, &condErr) {
+			return 0, fmt.Errorf("failed to delete chunk ref: %w", err)
+		}
+		return 0, nil
+	}
+	return updated.Refs, nil
+}
+
+// SetChunkRef overwrites a node's reference count for a chunk body, removing the
+// record if refs is zero. Nodes use it to rebuild their counts from chunk metadata.
+func (c *Client) SetChunkRef(ctx context.Context, tableName string, checksum string, nodeID string, refs int64) error {
+	if refs <= 0 {
+		_, err := c.svc.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(tableName),
+			Key:       chunkRefKey(checksum, nodeID),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete chunk ref: %w", err)
+		}
+		return nil
+	}
+
+	item, err := attributevalue.MarshalMap(&ChunkRef{Checksum: checksum, NodeID: nodeID, Refs: refs})
+	if err != nil {
+		return fmt.Errorf("failed to marshal chunk ref: %w", err)
+	}
+	_, err = c.svc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put chunk ref: %w", err)
+	}
+	return nil
+}
+
+// GetChunkRefs returns the reference count of every node holding a chunk body
+func (c *Client) GetChunkRefs(ctx context.Context, tableName string, checksum string) ([]*ChunkRef, error) {
+	return Collect(unmarshalItems[ChunkRef](c.queryItems(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		KeyConditionExpression: aws.String("checksum = :checksum"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":checksum": &types.AttributeValueMemberS{Value: checksum},
+		},
+	}), func(err error) error {
+		return fmt.Errorf("failed to query chunk refs: %w", err)
+	}))
+}
+
+func chunkRefKey(checksum string, nodeID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"checksum": &types.AttributeValueMemberS{Value: checksum},
+		"node_id":  &types.AttributeValueMemberS{Value: nodeID},
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 )
 
@@ -13,17 +15,38 @@ type Client struct {
 	region string
 }
 
-func NewClient(ctx context.Context, region string) (*Client, error) {
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+// ClientOptions configures how the client reaches DynamoDB. Endpoint and static
+// credentials are optional and let the client target DynamoDB Local or another
+// DynamoDB-compatible service instead of the regional AWS endpoint.
+type ClientOptions struct {
+	Region          string
+	Endpoint        string
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+func NewClient(ctx context.Context, opts ClientOptions) (*Client, error) {
+	loadOpts := []func(*config.LoadOptions) error{config.WithRegion(opts.Region)}
+	if opts.AccessKeyID != "" {
+		loadOpts = append(loadOpts, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(opts.AccessKeyID, opts.SecretAccessKey, ""),
+		))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, loadOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load AWS config: %w", err)
 	}
 
-	svc := dynamodb.NewFromConfig(cfg)
+	svc := dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		if opts.Endpoint != "" {
+			o.BaseEndpoint = aws.String(opts.Endpoint)
+		}
+	})
 
 	return &Client{
 		svc:    svc,
-		region: region,
+		region: opts.Region,
 	}, nil
 }
 
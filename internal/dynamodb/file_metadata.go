@@ -0,0 +1,159 @@
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	FileStateUploading = "uploading"
+	FileStateComplete  = "complete"
+)
+
+var (
+	// ErrNotFound is returned when a requested record does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrConditionFailed is returned when a conditional write loses to a concurrent change
+	ErrConditionFailed = errors.New("condition failed")
+)
+
+type FileMetadata struct {
+	FileID         string   `dynamodbav:"file_id"`
+	Filename       string   `dynamodbav:"filename"`
+	Size           int64    `dynamodbav:"size"`
+	ChunkSize      int      `dynamodbav:"chunk_size"`
+	ChunkCount     int      `dynamodbav:"chunk_count"`
+	State          string   `dynamodbav:"state"` // "uploading" or "complete"
+	ChunkChecksums []string `dynamodbav:"chunk_checksums,omitempty"`
+	DataShards     int      `dynamodbav:"data_shards,omitempty"`   // Set for erasure-coded files
+	ParityShards   int      `dynamodbav:"parity_shards,omitempty"` // Set for erasure-coded files
+	CreatedAt      int64    `dynamodbav:"created_at"`
+	CompletedAt    int64    `dynamodbav:"completed_at,omitempty"`
+}
+
+// ErasureCoded reports whether each chunk of the file is stored as Reed-Solomon
+// shards on distinct nodes rather than as full replicas
+func (f *FileMetadata) ErasureCoded() bool {
+	return f.DataShards > 0
+}
+
+// StripeSize returns the number of file bytes in a chunk, which is ChunkSize for
+// every chunk but the last
+func (f *FileMetadata) StripeSize(chunkIndex int) int {
+	return int(min(int64(f.ChunkSize), f.Size-int64(chunkIndex)*int64(f.ChunkSize)))
+}
+
+// MaxStoredSize returns the largest body a node stores for one chunk of the file:
+// ChunkSize, or one shard of a ChunkSize stripe when erasure-coded
+func (f *FileMetadata) MaxStoredSize() int64 {
+	if f.ErasureCoded() {
+		return (int64(f.ChunkSize) + int64(f.DataShards) - 1) / int64(f.DataShards)
+	}
+	return int64(f.ChunkSize)
+}
+
+// ChunkSizeLimit returns the largest chunk body accepted for the file: MaxStoredSize,
+// or fallback (MAX_CHUNK_SIZE) when the file's manifest is nil or has no chunk size
+func (f *FileMetadata) ChunkSizeLimit(fallback int64) int64 {
+	if f == nil || f.ChunkSize <= 0 {
+		return fallback
+	}
+	return f.MaxStoredSize()
+}
+
+// CreateFileMetadata records a new file in the "uploading" state
+func (c *Client) CreateFileMetadata(ctx context.Context, tableName string, file *FileMetadata) error {
+	file.State = FileStateUploading
+	file.CreatedAt = time.Now().Unix()
+
+	item, err := attributevalue.MarshalMap(file)
+	if err != nil {
+		return fmt.Errorf("failed to marshal file metadata: %w", err)
+	}
+
+	_, err = c.svc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(file_id)"),
+	})
+
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			return fmt.Errorf("%w: file %s already exists", ErrConditionFailed, file.FileID)
+		}
+		return fmt.Errorf("failed to put file metadata: %w", err)
+	}
+
+	return nil
+}
+
+// GetFileMetadata returns the manifest record for a file
+func (c *Client) GetFileMetadata(ctx context.Context, tableName string, fileID string) (*FileMetadata, error) {
+	result, err := c.svc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"file_id": &types.AttributeValueMemberS{Value: fileID},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file metadata: %w", err)
+	}
+
+	if result.Item == nil {
+		return nil, fmt.Errorf("%w: file %s", ErrNotFound, fileID)
+	}
+
+	var file FileMetadata
+	if err := attributevalue.UnmarshalMap(result.Item, &file); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal file metadata: %w", err)
+	}
+
+	return &file, nil
+}
+
+// CompleteFile atomically moves a file from "uploading" to "complete" and stores its chunk checksums.
+// It fails with ErrConditionFailed if the file is not currently uploading.
+func (c *Client) CompleteFile(ctx context.Context, tableName string, fileID string, chunkChecksums []string) error {
+	checksums, err := attributevalue.Marshal(chunkChecksums)
+	if err != nil {
+		return fmt.Errorf("failed to marshal chunk checksums: %w", err)
+	}
+
+	_, err = c.svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"file_id": &types.AttributeValueMemberS{Value: fileID},
+		},
+		UpdateExpression:    aws.String("SET #state = :complete, chunk_checksums = :checksums, completed_at = :ts"),
+		ConditionExpression: aws.String("#state = :uploading"),
+		ExpressionAttributeNames: map[string]string{
+			"#state": "state",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":complete":  &types.AttributeValueMemberS{Value: FileStateComplete},
+			":uploading": &types.AttributeValueMemberS{Value: FileStateUploading},
+			":checksums": checksums,
+			":ts":        &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", time.Now().Unix())},
+		},
+	})
+
+	if err != nil {
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			return fmt.Errorf("%w: file %s is not uploading", ErrConditionFailed, fileID)
+		}
+		return fmt.Errorf("failed to complete file: %w", err)
+	}
+
+	return nil
+}
@@ -2,28 +2,55 @@ package dynamodb
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"iter"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+)
+
+// Node lifecycle states. Draining nodes serve reads but take no new chunks while
+// their replicas are moved away; decommissioned nodes hold nothing and can be removed.
+const (
+	NodeStatusActive         = "active"
+	NodeStatusDraining       = "draining"
+	NodeStatusDecommissioned = "decommissioned"
 )
 
 type NodeInfo struct {
-	NodeID         string `dynamodbav:"node_id"`
-	PrivateIP      string `dynamodbav:"private_ip"`
-	Port           int    `dynamodbav:"port"`
-	HeartbeatTS    int64  `dynamodbav:"heartbeat_ts"`
-	Status         string `dynamodbav:"status"`
-	InstanceID     string `dynamodbav:"instance_id,omitempty"`
-	AvailableSpace int64  `dynamodbav:"available_space,omitempty"`
+	NodeID         string     `dynamodbav:"node_id"`
+	PrivateIP      string     `dynamodbav:"private_ip"`
+	Port           int        `dynamodbav:"port"`
+	HeartbeatTS    int64      `dynamodbav:"heartbeat_ts"`
+	Status         string     `dynamodbav:"status"`
+	InstanceID     string     `dynamodbav:"instance_id,omitempty"`
+	AvailableSpace int64      `dynamodbav:"available_space"`          // bytes free, -1 if unknown
+	FailureDomain  string     `dynamodbav:"failure_domain,omitempty"` // availability zone or rack
+	Disks          []DiskInfo `dynamodbav:"disks,omitempty"`          // per data directory on multi-disk nodes
+}
+
+// DiskInfo reports the capacity and health of one of a node's data directories.
+// AvailableSpace on the node is the sum over its healthy disks.
+type DiskInfo struct {
+	Dir            string `dynamodbav:"dir"`
+	Healthy        bool   `dynamodbav:"healthy"`
+	AvailableSpace int64  `dynamodbav:"available_space"`
+	TotalSpace     int64  `dynamodbav:"total_space"`
+	LastError      string `dynamodbav:"last_error,omitempty"`
 }
 
+// RegisterNode writes the node's record, defaulting its status to active
 func (c *Client) RegisterNode(ctx context.Context, tableName string, node *NodeInfo) error {
 	node.HeartbeatTS = time.Now().Unix()
-	node.Status = "active"
+	if node.Status == "" {
+		node.Status = NodeStatusActive
+	}
 
 	item, err := attributevalue.MarshalMap(node)
 	if err != nil {
@@ -42,22 +69,41 @@ func (c *Client) RegisterNode(ctx context.Context, tableName string, node *NodeI
 	return nil
 }
 
-func (c *Client) UpdateHeartbeat(ctx context.Context, tableName string, nodeID string) error {
+// UpdateHeartbeat refreshes a node's heartbeat and, unless availableSpace is
+// negative (unknown), its reported free disk space. Per-disk reports replace the
+// stored ones unless disks is nil. A status set by an operator (draining or
+// decommissioned) is left in place.
+func (c *Client) UpdateHeartbeat(ctx context.Context, tableName string, nodeID string, availableSpace int64, disks []DiskInfo) error {
 	heartbeatTS := time.Now().Unix()
 
+	updateExpr := "SET heartbeat_ts = :ts, #status = if_not_exists(#status, :status)"
+	values := map[string]types.AttributeValue{
+		":ts":     &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", heartbeatTS)},
+		":status": &types.AttributeValueMemberS{Value: NodeStatusActive},
+	}
+	if availableSpace >= 0 {
+		updateExpr += ", available_space = :space"
+		values[":space"] = &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", availableSpace)}
+	}
+	if disks != nil {
+		av, err := attributevalue.Marshal(disks)
+		if err != nil {
+			return fmt.Errorf("failed to marshal disks: %w", err)
+		}
+		updateExpr += ", disks = :disks"
+		values[":disks"] = av
+	}
+
 	_, err := c.svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
 		TableName: aws.String(tableName),
 		Key: map[string]types.AttributeValue{
 			"node_id": &types.AttributeValueMemberS{Value: nodeID},
 		},
-		UpdateExpression: aws.String("SET heartbeat_ts = :ts, #status = :status"),
+		UpdateExpression: aws.String(updateExpr),
 		ExpressionAttributeNames: map[string]string{
 			"#status": "status",
 		},
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":ts":     &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", heartbeatTS)},
-			":status": &types.AttributeValueMemberS{Value: "active"},
-		},
+		ExpressionAttributeValues: values,
 	})
 
 	if err != nil {
@@ -67,33 +113,111 @@ func (c *Client) UpdateHeartbeat(ctx context.Context, tableName string, nodeID s
 	return nil
 }
 
-func (c *Client) ListActiveNodes(ctx context.Context, tableName string, heartbeatTimeout int64) ([]*NodeInfo, error) {
-	// Scan table and filter active nodes
-	// Note: For production, consider using GSI or query patterns
-	result, err := c.svc.Scan(ctx, &dynamodb.ScanInput{
+// StatusIndex is the registry GSI keyed by (status, heartbeat_ts), letting active
+// nodes be found with a Query instead of a full-table Scan
+const StatusIndex = "status-index"
+
+// SetNodeStatus moves an existing node to a lifecycle state. It fails with
+// ErrNotFound if the node is not registered.
+func (c *Client) SetNodeStatus(ctx context.Context, tableName string, nodeID string, status string) error {
+	_, err := c.svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
 		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"node_id": &types.AttributeValueMemberS{Value: nodeID},
+		},
+		UpdateExpression:    aws.String("SET #status = :status"),
+		ConditionExpression: aws.String("attribute_exists(node_id)"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status": &types.AttributeValueMemberS{Value: status},
+		},
 	})
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to scan nodes: %w", err)
+		var condErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condErr) {
+			return fmt.Errorf("%w: node %s", ErrNotFound, nodeID)
+		}
+		return fmt.Errorf("failed to set node status: %w", err)
 	}
 
-	var nodes []*NodeInfo
-	now := time.Now().Unix()
+	return nil
+}
+
+func (c *Client) ListActiveNodes(ctx context.Context, tableName string, heartbeatTimeout int64, opts ...QueryOption) ([]*NodeInfo, error) {
+	return c.ListNodesByStatus(ctx, tableName, NodeStatusActive, heartbeatTimeout, opts...)
+}
 
-	for _, item := range result.Items {
-		var node NodeInfo
-		if err := attributevalue.UnmarshalMap(item, &node); err != nil {
-			continue
+// ListNodesByStatus returns nodes in the given state that heartbeated within the timeout
+func (c *Client) ListNodesByStatus(ctx context.Context, tableName string, status string, heartbeatTimeout int64, opts ...QueryOption) ([]*NodeInfo, error) {
+	cutoff := time.Now().Unix() - heartbeatTimeout
+	live := func(yield func(*NodeInfo, error) bool) {
+		started := false
+		for node, err := range c.queryNodesByStatus(ctx, tableName, status, cutoff) {
+			if err != nil {
+				if !started && isMissingIndex(err) {
+					// Registry created before the status index existed
+					for node, err := range c.scanNodesByStatus(ctx, tableName, status, cutoff) {
+						if !yield(node, err) {
+							return
+						}
+					}
+					return
+				}
+				yield(nil, err)
+				return
+			}
+			started = true
+			if !yield(node, nil) {
+				return
+			}
 		}
+	}
+	return Collect(live, opts...)
+}
+
+func (c *Client) queryNodesByStatus(ctx context.Context, tableName string, status string, cutoff int64) iter.Seq2[*NodeInfo, error] {
+	return unmarshalItems[NodeInfo](c.queryItems(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String(StatusIndex),
+		KeyConditionExpression: aws.String("#status = :status AND heartbeat_ts >= :cutoff"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status": &types.AttributeValueMemberS{Value: status},
+			":cutoff": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", cutoff)},
+		},
+	}), func(err error) error {
+		return fmt.Errorf("failed to query %s nodes: %w", status, err)
+	})
+}
 
-		// Filter by heartbeat timeout
-		if now-node.HeartbeatTS <= heartbeatTimeout && node.Status == "active" {
-			nodes = append(nodes, &node)
+func (c *Client) scanNodesByStatus(ctx context.Context, tableName string, status string, cutoff int64) iter.Seq2[*NodeInfo, error] {
+	return func(yield func(*NodeInfo, error) bool) {
+		for node, err := range c.iterNodes(ctx, tableName) {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			// Filter by heartbeat timeout
+			if node.HeartbeatTS >= cutoff && node.Status == status {
+				if !yield(node, nil) {
+					return
+				}
+			}
 		}
 	}
+}
 
-	return nodes, nil
+// isMissingIndex reports whether err is DynamoDB rejecting a query against an index
+// the table does not have
+func isMissingIndex(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "ValidationException" &&
+		strings.Contains(apiErr.ErrorMessage(), "index")
 }
 
 func (c *Client) GetNode(ctx context.Context, tableName string, nodeID string) (*NodeInfo, error) {
@@ -109,7 +233,7 @@ func (c *Client) GetNode(ctx context.Context, tableName string, nodeID string) (
 	}
 
 	if result.Item == nil {
-		return nil, fmt.Errorf("node not found: %s", nodeID)
+		return nil, fmt.Errorf("%w: node %s", ErrNotFound, nodeID)
 	}
 
 	var node NodeInfo
@@ -119,3 +243,16 @@ func (c *Client) GetNode(ctx context.Context, tableName string, nodeID string) (
 
 	return &node, nil
 }
+
+// ListNodes returns every node in the registry regardless of status or heartbeat age
+func (c *Client) ListNodes(ctx context.Context, tableName string, opts ...QueryOption) ([]*NodeInfo, error) {
+	return Collect(c.iterNodes(ctx, tableName), opts...)
+}
+
+func (c *Client) iterNodes(ctx context.Context, tableName string) iter.Seq2[*NodeInfo, error] {
+	return unmarshalItems[NodeInfo](c.scanItems(ctx, &dynamodb.ScanInput{
+		TableName: aws.String(tableName),
+	}), func(err error) error {
+		return fmt.Errorf("failed to scan nodes: %w", err)
+	})
+}
@@ -0,0 +1,106 @@
+package dynamodb
+
+import (
+	"context"
+	"iter"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// QueryOptions bounds list operations
+type QueryOptions struct {
+	MaxItems int // Stop after this many items (0 means no cap)
+}
+
+type QueryOption func(*QueryOptions)
+
+// WithMaxItems caps the number of items a list operation returns
+func WithMaxItems(n int) QueryOption {
+	return func(o *QueryOptions) {
+		o.MaxItems = n
+	}
+}
+
+// ApplyQueryOptions resolves a list of options into QueryOptions
+func ApplyQueryOptions(opts []QueryOption) QueryOptions {
+	var o QueryOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Collect drains seq into a slice, honoring MaxItems
+func Collect[T any](seq iter.Seq2[T, error], opts ...QueryOption) ([]T, error) {
+	o := ApplyQueryOptions(opts)
+	var items []T
+	for item, err := range seq {
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		if o.MaxItems > 0 && len(items) >= o.MaxItems {
+			break
+		}
+	}
+	return items, nil
+}
+
+// queryItems walks every page of a Query, following LastEvaluatedKey
+func (c *Client) queryItems(ctx context.Context, input *dynamodb.QueryInput) iter.Seq2[map[string]types.AttributeValue, error] {
+	return func(yield func(map[string]types.AttributeValue, error) bool) {
+		paginator := dynamodb.NewQueryPaginator(c.svc, input)
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			for _, item := range page.Items {
+				if !yield(item, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// scanItems walks every page of a Scan, following LastEvaluatedKey
+func (c *Client) scanItems(ctx context.Context, input *dynamodb.ScanInput) iter.Seq2[map[string]types.AttributeValue, error] {
+	return func(yield func(map[string]types.AttributeValue, error) bool) {
+		paginator := dynamodb.NewScanPaginator(c.svc, input)
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			for _, item := range page.Items {
+				if !yield(item, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// unmarshalItems decodes each item into T, skipping items that do not decode
+func unmarshalItems[T any](items iter.Seq2[map[string]types.AttributeValue, error], wrap func(error) error) iter.Seq2[*T, error] {
+	return func(yield func(*T, error) bool) {
+		for item, err := range items {
+			if err != nil {
+				yield(nil, wrap(err))
+				return
+			}
+			var value T
+			if err := attributevalue.UnmarshalMap(item, &value); err != nil {
+				continue
+			}
+			if !yield(&value, nil) {
+				return
+			}
+		}
+	}
+}
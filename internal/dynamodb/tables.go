@@ -0,0 +1,153 @@
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const tableCreateTimeout = 2 * time.Minute
+
+// TableNames identifies the tables EnsureTables creates
+type TableNames struct {
+	ChunkMetadata string
+	NodeRegistry  string
+	FileMetadata  string
+	ChunkRefs     string
+}
+
+// EnsureTables creates any missing table with the same keys and indexes as
+// infra/terraform/main.tf, then waits for them to become active
+func (c *Client) EnsureTables(ctx context.Context, tables TableNames) error {
+	chunkTable := &dynamodb.CreateTableInput{
+		TableName:   aws.String(tables.ChunkMetadata),
+		BillingMode: types.BillingModePayPerRequest,
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("file_id"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("chunk_replica_key"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("node_id"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("file_id"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("chunk_replica_key"), KeyType: types.KeyTypeRange},
+		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String("node-id-index"),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String("node_id"), KeyType: types.KeyTypeHash},
+				},
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+			},
+		},
+	}
+
+	nodeTable := &dynamodb.CreateTableInput{
+		TableName:   aws.String(tables.NodeRegistry),
+		BillingMode: types.BillingModePayPerRequest,
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("node_id"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("status"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("heartbeat_ts"), AttributeType: types.ScalarAttributeTypeN},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("node_id"), KeyType: types.KeyTypeHash},
+		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String(StatusIndex),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String("status"), KeyType: types.KeyTypeHash},
+					{AttributeName: aws.String("heartbeat_ts"), KeyType: types.KeyTypeRange},
+				},
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+			},
+		},
+	}
+
+	fileTable := &dynamodb.CreateTableInput{
+		TableName:   aws.String(tables.FileMetadata),
+		BillingMode: types.BillingModePayPerRequest,
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("file_id"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("file_id"), KeyType: types.KeyTypeHash},
+		},
+	}
+
+	refsTable := &dynamodb.CreateTableInput{
+		TableName:   aws.String(tables.ChunkRefs),
+		BillingMode: types.BillingModePayPerRequest,
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("checksum"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("node_id"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("checksum"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("node_id"), KeyType: types.KeyTypeRange},
+		},
+	}
+
+	for _, input := range []*dynamodb.CreateTableInput{chunkTable, nodeTable, fileTable, refsTable} {
+		created, err := c.createTableIfMissing(ctx, input)
+		if err != nil {
+			return err
+		}
+
+		// Stale node cleanup, matching the ttl block on the registry in Terraform
+		if created && aws.ToString(input.TableName) == tables.NodeRegistry {
+			_, err := c.svc.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+				TableName: input.TableName,
+				TimeToLiveSpecification: &types.TimeToLiveSpecification{
+					AttributeName: aws.String("heartbeat_ts"),
+					Enabled:       aws.Bool(true),
+				},
+			})
+			if err != nil {
+				fmt.Printf("Warning: Failed to enable TTL on %s: %v\n", tables.NodeRegistry, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// createTableIfMissing reports whether it created the table
+func (c *Client) createTableIfMissing(ctx context.Context, input *dynamodb.CreateTableInput) (bool, error) {
+	tableName := aws.ToString(input.TableName)
+
+	_, err := c.svc.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: input.TableName})
+	if err == nil {
+		return false, nil
+	}
+	var notFound *types.ResourceNotFoundException
+	if !errors.As(err, &notFound) {
+		return false, fmt.Errorf("failed to describe table %s: %w", tableName, err)
+	}
+
+	created := true
+	if _, err := c.svc.CreateTable(ctx, input); err != nil {
+		// Another process may have created it between Describe and Create
+		var inUse *types.ResourceInUseException
+		if !errors.As(err, &inUse) {
+			return false, fmt.Errorf("failed to create table %s: %w", tableName, err)
+		}
+		created = false
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(c.svc)
+	if err := waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: input.TableName}, tableCreateTimeout); err != nil {
+		return false, fmt.Errorf("table %s did not become active: %w", tableName, err)
+	}
+
+	if created {
+		fmt.Printf("Created DynamoDB table %s\n", tableName)
+	}
+	return created, nil
+}
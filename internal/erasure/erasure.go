@@ -0,0 +1,106 @@
+package erasure
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// MaxShards is the largest number of data plus parity shards a stripe can have
+const MaxShards = 256
+
+// Codec splits a stripe into data shards plus parity shards with Reed-Solomon
+// coding. Any DataShards of the resulting shards are enough to rebuild the rest.
+type Codec struct {
+	enc          reedsolomon.Encoder
+	dataShards   int
+	parityShards int
+}
+
+// Validate checks that a data and parity shard count can be used for a stripe
+func Validate(dataShards, parityShards int) error {
+	if dataShards < 1 || parityShards < 1 {
+		return fmt.Errorf("erasure coding needs at least 1 data and 1 parity shard, got %d+%d", dataShards, parityShards)
+	}
+	if dataShards+parityShards > MaxShards {
+		return fmt.Errorf("erasure coding supports at most %d shards, got %d", MaxShards, dataShards+parityShards)
+	}
+	return nil
+}
+
+func New(dataShards, parityShards int) (*Codec, error) {
+	if err := Validate(dataShards, parityShards); err != nil {
+		return nil, err
+	}
+	enc, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create erasure coder: %w", err)
+	}
+	return &Codec{enc: enc, dataShards: dataShards, parityShards: parityShards}, nil
+}
+
+// Shards returns the total number of shards per stripe
+func (c *Codec) Shards() int {
+	return c.dataShards + c.parityShards
+}
+
+// Encode splits a stripe into equally sized data shards, zero-padding the last
+// one, and computes the parity shards. The stripe itself is not modified.
+func (c *Codec) Encode(stripe []byte) ([][]byte, error) {
+	if len(stripe) == 0 {
+		return nil, fmt.Errorf("cannot encode an empty stripe")
+	}
+	shards, err := c.enc.Split(append([]byte(nil), stripe...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to split stripe: %w", err)
+	}
+	if err := c.enc.Encode(shards); err != nil {
+		return nil, fmt.Errorf("failed to compute parity: %w", err)
+	}
+	return shards, nil
+}
+
+// Reconstruct fills in every missing (nil) shard from the shards present
+func (c *Codec) Reconstruct(shards [][]byte) error {
+	if err := c.check(shards); err != nil {
+		return err
+	}
+	if err := c.enc.Reconstruct(shards); err != nil {
+		return fmt.Errorf("failed to reconstruct shards: %w", err)
+	}
+	return nil
+}
+
+// Decode rebuilds any missing data shards and returns the original stripe of the given size
+func (c *Codec) Decode(shards [][]byte, size int) ([]byte, error) {
+	if err := c.check(shards); err != nil {
+		return nil, err
+	}
+	if err := c.enc.ReconstructData(shards); err != nil {
+		return nil, fmt.Errorf("failed to reconstruct data: %w", err)
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(size)
+	if err := c.enc.Join(&buf, shards, size); err != nil {
+		return nil, fmt.Errorf("failed to join shards: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *Codec) check(shards [][]byte) error {
+	if len(shards) != c.Shards() {
+		return fmt.Errorf("expected %d shards, got %d", c.Shards(), len(shards))
+	}
+	present := 0
+	for _, shard := range shards {
+		if shard != nil {
+			present++
+		}
+	}
+	if present < c.dataShards {
+		return fmt.Errorf("only %d of the %d shards needed are available", present, c.dataShards)
+	}
+	return nil
+}
@@ -0,0 +1,407 @@
+package metadata
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/timskillet/distributed-filestore/internal/dynamodb"
+)
+
+const (
+	walFileName      = "metadata.wal"
+	snapshotFileName = "metadata.snapshot"
+)
+
+// walRecord is one durable mutation. Records hold the resulting row rather than the
+// operation, so replaying a record twice (e.g. after a crash mid-snapshot) is harmless.
+type walRecord struct {
+	Op         string                  `json:"op"` // "put_chunk", "delete_chunk", "move_chunk", "put_ref", "put_node" or "put_file"
+	Table      string                  `json:"table"`
+	Chunk      *dynamodb.ChunkMetadata `json:"chunk,omitempty"`
+	Ref        *dynamodb.ChunkRef      `json:"ref,omitempty"`
+	Node       *dynamodb.NodeInfo      `json:"node,omitempty"`
+	File       *dynamodb.FileMetadata  `json:"file,omitempty"`
+	FileID     string                  `json:"file_id,omitempty"`
+	ChunkIndex int                     `json:"chunk_index,omitempty"`
+	NodeID     string                  `json:"node_id,omitempty"`
+}
+
+// FileStore is a durable MetadataStore for single-host deployments. State is served
+// from an in-memory copy; every mutation is appended and fsynced to a write-ahead log
+// before it is applied, and the log is folded into a snapshot every snapshotEvery records.
+type FileStore struct {
+	mem           *MemoryStore
+	dir           string
+	wal           *os.File
+	walSize       int64
+	walRecords    int
+	snapshotEvery int
+}
+
+// NewFileStore opens (or creates) the metadata directory and recovers its state
+func NewFileStore(dir string, snapshotEvery int) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create metadata directory: %w", err)
+	}
+
+	s := &FileStore{
+		mem:           NewMemoryStore(),
+		dir:           dir,
+		snapshotEvery: snapshotEvery,
+	}
+
+	if err := s.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := s.replayWAL(); err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open metadata log: %w", err)
+	}
+	info, err := wal.Stat()
+	if err != nil {
+		wal.Close()
+		return nil, fmt.Errorf("failed to stat metadata log: %w", err)
+	}
+	s.wal = wal
+	s.walSize = info.Size()
+
+	return s, nil
+}
+
+func (s *FileStore) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, snapshotFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read metadata snapshot: %w", err)
+	}
+
+	var snap memorySnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("failed to decode metadata snapshot: %w", err)
+	}
+	s.mem.restore(&snap)
+	return nil
+}
+
+// replayWAL applies every complete log record. A torn final record (from a crash
+// mid-append) was never acknowledged, so it is truncated away; a corrupt record
+// anywhere else fails the open rather than dropping the records after it.
+func (s *FileStore) replayWAL() error {
+	path := filepath.Join(s.dir, walFileName)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open metadata log: %w", err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				fmt.Printf("Warning: Discarding torn metadata log record at offset %d\n", offset)
+				return os.Truncate(path, offset)
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read metadata log: %w", err)
+		}
+
+		var record walRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			// Only the last record can be torn by a crash; anything after it was
+			// acknowledged, so corruption earlier in the log is not cut away
+			if _, peekErr := reader.Peek(1); peekErr != io.EOF {
+				return fmt.Errorf("corrupt metadata log record at offset %d: %w", offset, err)
+			}
+			fmt.Printf("Warning: Discarding corrupt metadata log tail at offset %d: %v\n", offset, err)
+			return os.Truncate(path, offset)
+		}
+		s.apply(&record)
+		s.walRecords++
+		offset += int64(len(line))
+	}
+}
+
+// apply performs a record against the in-memory state; mem.mu must be held or unshared
+func (s *FileStore) apply(record *walRecord) {
+	switch record.Op {
+	case "put_chunk":
+		s.mem.putChunk(record.Table, record.Chunk)
+	case "delete_chunk":
+		s.mem.deleteChunk(record.Table, record.FileID, record.ChunkIndex, record.NodeID)
+	case "move_chunk":
+		// Chunk is the replica's new record, NodeID the node it moved from
+		s.mem.putChunk(record.Table, record.Chunk)
+		s.mem.deleteChunk(record.Table, record.FileID, record.ChunkIndex, record.NodeID)
+	case "put_ref":
+		s.mem.putRef(record.Table, record.Ref)
+	case "put_node":
+		s.mem.putNode(record.Table, record.Node)
+	case "put_file":
+		s.mem.putFile(record.Table, record.File)
+	}
+}
+
+// commit durably logs a record and then applies it; mem.mu must be held
+func (s *FileStore) commit(record *walRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata record: %w", err)
+	}
+	data = append(data, '\n')
+
+	if _, err := s.wal.Write(data); err != nil {
+		// Drop any partial record so later appends stay parseable
+		s.wal.Truncate(s.walSize)
+		return fmt.Errorf("failed to append metadata record: %w", err)
+	}
+	if err := s.wal.Sync(); err != nil {
+		s.wal.Truncate(s.walSize)
+		return fmt.Errorf("failed to sync metadata log: %w", err)
+	}
+
+	s.apply(record)
+	s.walSize += int64(len(data))
+	s.walRecords++
+
+	if s.snapshotEvery > 0 && s.walRecords >= s.snapshotEvery {
+		if err := s.snapshot(); err != nil {
+			// The record is already durable in the log; retry the snapshot next time
+			fmt.Printf("Warning: Failed to snapshot metadata: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// snapshot writes the full state atomically and then truncates the log; mem.mu must be held
+func (s *FileStore) snapshot() error {
+	data, err := json.Marshal(s.mem.snapshot())
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+
+	path := filepath.Join(s.dir, snapshotFileName)
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close snapshot: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to install snapshot: %w", err)
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+
+	// Records up to here are in the snapshot. A crash before the truncate only
+	// means they are replayed again on top of it, which is idempotent.
+	if err := s.wal.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate metadata log: %w", err)
+	}
+	if err := s.wal.Sync(); err != nil {
+		return fmt.Errorf("failed to sync metadata log: %w", err)
+	}
+	s.walSize = 0
+	s.walRecords = 0
+	return nil
+}
+
+// Close writes a final snapshot and releases the log
+func (s *FileStore) Close() error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+
+	if err := s.snapshot(); err != nil {
+		return err
+	}
+	return s.wal.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory for sync: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
+
+func (s *FileStore) PutChunkMetadata(ctx context.Context, tableName string, metadata *dynamodb.ChunkMetadata) error {
+	metadata.ChunkReplicaKey = fmt.Sprintf("%d#%s", metadata.ChunkIndex, metadata.NodeID)
+
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	stored := *metadata
+	return s.commit(&walRecord{Op: "put_chunk", Table: tableName, Chunk: &stored})
+}
+
+func (s *FileStore) GetChunkReplicas(ctx context.Context, tableName string, fileID string, chunkIndex int, opts ...dynamodb.QueryOption) ([]*dynamodb.ChunkMetadata, error) {
+	return s.mem.GetChunkReplicas(ctx, tableName, fileID, chunkIndex, opts...)
+}
+
+func (s *FileStore) GetChunksByFileID(ctx context.Context, tableName string, fileID string, opts ...dynamodb.QueryOption) ([]*dynamodb.ChunkMetadata, error) {
+	return s.mem.GetChunksByFileID(ctx, tableName, fileID, opts...)
+}
+
+func (s *FileStore) IterChunksByFileID(ctx context.Context, tableName string, fileID string) iter.Seq2[*dynamodb.ChunkMetadata, error] {
+	return s.mem.IterChunksByFileID(ctx, tableName, fileID)
+}
+
+func (s *FileStore) GetChunksByNodeID(ctx context.Context, tableName string, nodeID string, opts ...dynamodb.QueryOption) ([]*dynamodb.ChunkMetadata, error) {
+	return s.mem.GetChunksByNodeID(ctx, tableName, nodeID, opts...)
+}
+
+func (s *FileStore) IterChunksByNodeID(ctx context.Context, tableName string, nodeID string) iter.Seq2[*dynamodb.ChunkMetadata, error] {
+	return s.mem.IterChunksByNodeID(ctx, tableName, nodeID)
+}
+
+func (s *FileStore) MoveChunkReplica(ctx context.Context, tableName string, metadata *dynamodb.ChunkMetadata, fromNodeID string) error {
+	metadata.ChunkReplicaKey = fmt.Sprintf("%d#%s", metadata.ChunkIndex, metadata.NodeID)
+
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	if err := s.mem.checkReplica(tableName, metadata.FileID, metadata.ChunkIndex, fromNodeID); err != nil {
+		return err
+	}
+	stored := *metadata
+	return s.commit(&walRecord{
+		Op:         "move_chunk",
+		Table:      tableName,
+		Chunk:      &stored,
+		FileID:     metadata.FileID,
+		ChunkIndex: metadata.ChunkIndex,
+		NodeID:     fromNodeID,
+	})
+}
+
+func (s *FileStore) DeleteChunkMetadata(ctx context.Context, tableName string, fileID string, chunkIndex int, nodeID string) error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	return s.commit(&walRecord{Op: "delete_chunk", Table: tableName, FileID: fileID, ChunkIndex: chunkIndex, NodeID: nodeID})
+}
+
+func (s *FileStore) AdjustChunkRef(ctx context.Context, tableName string, checksum string, nodeID string, delta int64) (int64, error) {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	ref := s.mem.adjustedRef(tableName, checksum, nodeID, delta)
+	if err := s.commit(&walRecord{Op: "put_ref", Table: tableName, Ref: ref}); err != nil {
+		return 0, err
+	}
+	return ref.Refs, nil
+}
+
+func (s *FileStore) SetChunkRef(ctx context.Context, tableName string, checksum string, nodeID string, refs int64) error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	return s.commit(&walRecord{Op: "put_ref", Table: tableName, Ref: &dynamodb.ChunkRef{Checksum: checksum, NodeID: nodeID, Refs: refs}})
+}
+
+func (s *FileStore) GetChunkRefs(ctx context.Context, tableName string, checksum string) ([]*dynamodb.ChunkRef, error) {
+	return s.mem.GetChunkRefs(ctx, tableName, checksum)
+}
+
+func (s *FileStore) RegisterNode(ctx context.Context, tableName string, node *dynamodb.NodeInfo) error {
+	node.HeartbeatTS = time.Now().Unix()
+	if node.Status == "" {
+		node.Status = dynamodb.NodeStatusActive
+	}
+
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	stored := *node
+	return s.commit(&walRecord{Op: "put_node", Table: tableName, Node: &stored})
+}
+
+func (s *FileStore) UpdateHeartbeat(ctx context.Context, tableName string, nodeID string, availableSpace int64, disks []dynamodb.DiskInfo) error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	return s.commit(&walRecord{Op: "put_node", Table: tableName, Node: s.mem.heartbeatNode(tableName, nodeID, availableSpace, disks)})
+}
+
+func (s *FileStore) SetNodeStatus(ctx context.Context, tableName string, nodeID string, status string) error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	node, err := s.mem.statusNode(tableName, nodeID, status)
+	if err != nil {
+		return err
+	}
+	return s.commit(&walRecord{Op: "put_node", Table: tableName, Node: node})
+}
+
+func (s *FileStore) ListActiveNodes(ctx context.Context, tableName string, heartbeatTimeout int64, opts ...dynamodb.QueryOption) ([]*dynamodb.NodeInfo, error) {
+	return s.mem.ListActiveNodes(ctx, tableName, heartbeatTimeout, opts...)
+}
+
+func (s *FileStore) ListNodesByStatus(ctx context.Context, tableName string, status string, heartbeatTimeout int64, opts ...dynamodb.QueryOption) ([]*dynamodb.NodeInfo, error) {
+	return s.mem.ListNodesByStatus(ctx, tableName, status, heartbeatTimeout, opts...)
+}
+
+func (s *FileStore) ListNodes(ctx context.Context, tableName string, opts ...dynamodb.QueryOption) ([]*dynamodb.NodeInfo, error) {
+	return s.mem.ListNodes(ctx, tableName, opts...)
+}
+
+func (s *FileStore) GetNode(ctx context.Context, tableName string, nodeID string) (*dynamodb.NodeInfo, error) {
+	return s.mem.GetNode(ctx, tableName, nodeID)
+}
+
+func (s *FileStore) CreateFileMetadata(ctx context.Context, tableName string, file *dynamodb.FileMetadata) error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+
+	if _, exists := s.mem.files[tableName][file.FileID]; exists {
+		return fmt.Errorf("%w: file %s already exists", dynamodb.ErrConditionFailed, file.FileID)
+	}
+
+	file.State = dynamodb.FileStateUploading
+	file.CreatedAt = time.Now().Unix()
+	stored := *file
+	return s.commit(&walRecord{Op: "put_file", Table: tableName, File: &stored})
+}
+
+func (s *FileStore) GetFileMetadata(ctx context.Context, tableName string, fileID string) (*dynamodb.FileMetadata, error) {
+	return s.mem.GetFileMetadata(ctx, tableName, fileID)
+}
+
+func (s *FileStore) CompleteFile(ctx context.Context, tableName string, fileID string, chunkChecksums []string) error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+
+	file, err := s.mem.completedFile(tableName, fileID, chunkChecksums)
+	if err != nil {
+		return err
+	}
+	return s.commit(&walRecord{Op: "put_file", Table: tableName, File: file})
+}
@@ -0,0 +1,515 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/timskillet/distributed-filestore/internal/dynamodb"
+)
+
+// MemoryStore is a thread-safe, non-durable MetadataStore for offline runs and tests.
+// It mirrors the DynamoDB semantics: records are keyed per table, and returned values
+// are copies so callers can never mutate stored state.
+type MemoryStore struct {
+	mu     sync.RWMutex
+	chunks map[string]map[string]map[string]*dynamodb.ChunkMetadata // table -> file_id -> chunk_replica_key
+	nodes  map[string]map[string]*dynamodb.NodeInfo                 // table -> node_id
+	files  map[string]map[string]*dynamodb.FileMetadata             // table -> file_id
+	refs   map[string]map[string]map[string]int64                   // table -> checksum -> node_id
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		chunks: make(map[string]map[string]map[string]*dynamodb.ChunkMetadata),
+		nodes:  make(map[string]map[string]*dynamodb.NodeInfo),
+		files:  make(map[string]map[string]*dynamodb.FileMetadata),
+		refs:   make(map[string]map[string]map[string]int64),
+	}
+}
+
+func (m *MemoryStore) PutChunkMetadata(ctx context.Context, tableName string, metadata *dynamodb.ChunkMetadata) error {
+	metadata.ChunkReplicaKey = fmt.Sprintf("%d#%s", metadata.ChunkIndex, metadata.NodeID)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.putChunk(tableName, metadata)
+	return nil
+}
+
+func (m *MemoryStore) GetChunkReplicas(ctx context.Context, tableName string, fileID string, chunkIndex int, opts ...dynamodb.QueryOption) ([]*dynamodb.ChunkMetadata, error) {
+	chunks, err := m.GetChunksByFileID(ctx, tableName, fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	var replicas []*dynamodb.ChunkMetadata
+	for _, chunk := range chunks {
+		if chunk.ChunkIndex == chunkIndex {
+			replicas = append(replicas, chunk)
+		}
+	}
+	return capItems(replicas, opts), nil
+}
+
+func (m *MemoryStore) GetChunksByFileID(ctx context.Context, tableName string, fileID string, opts ...dynamodb.QueryOption) ([]*dynamodb.ChunkMetadata, error) {
+	return m.chunksByFileID(tableName, fileID, nil, maxItems(opts)), nil
+}
+
+func (m *MemoryStore) IterChunksByFileID(ctx context.Context, tableName string, fileID string) iter.Seq2[*dynamodb.ChunkMetadata, error] {
+	return pageSeq(func(after *dynamodb.ChunkMetadata) ([]*dynamodb.ChunkMetadata, error) {
+		return m.chunksByFileID(tableName, fileID, after, chunkPageSize), nil
+	})
+}
+
+// chunksByFileID copies up to limit of a file's replicas that follow after in
+// fileChunkOrder (all of them when limit is 0)
+func (m *MemoryStore) chunksByFileID(tableName string, fileID string, after *dynamodb.ChunkMetadata, limit int) []*dynamodb.ChunkMetadata {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var chunks []*dynamodb.ChunkMetadata
+	for _, chunk := range m.chunks[tableName][fileID] {
+		chunks = append(chunks, chunk)
+	}
+	return copyChunks(pageAfter(chunks, after, fileChunkOrder, limit))
+}
+
+func (m *MemoryStore) GetChunksByNodeID(ctx context.Context, tableName string, nodeID string, opts ...dynamodb.QueryOption) ([]*dynamodb.ChunkMetadata, error) {
+	return m.chunksByNodeID(tableName, nodeID, nil, maxItems(opts)), nil
+}
+
+func (m *MemoryStore) IterChunksByNodeID(ctx context.Context, tableName string, nodeID string) iter.Seq2[*dynamodb.ChunkMetadata, error] {
+	return pageSeq(func(after *dynamodb.ChunkMetadata) ([]*dynamodb.ChunkMetadata, error) {
+		return m.chunksByNodeID(tableName, nodeID, after, chunkPageSize), nil
+	})
+}
+
+// chunksByNodeID copies up to limit of a node's replicas that follow after in
+// nodeChunkOrder (all of them when limit is 0)
+func (m *MemoryStore) chunksByNodeID(tableName string, nodeID string, after *dynamodb.ChunkMetadata, limit int) []*dynamodb.ChunkMetadata {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var chunks []*dynamodb.ChunkMetadata
+	for _, file := range m.chunks[tableName] {
+		for _, chunk := range file {
+			if chunk.NodeID == nodeID {
+				chunks = append(chunks, chunk)
+			}
+		}
+	}
+	return copyChunks(pageAfter(chunks, after, nodeChunkOrder, limit))
+}
+
+// fileChunkOrder matches DynamoDB's range key ordering of a file's replicas
+func fileChunkOrder(a, b *dynamodb.ChunkMetadata) bool {
+	return a.ChunkReplicaKey < b.ChunkReplicaKey
+}
+
+// nodeChunkOrder orders a node's replicas by file and chunk index; a node holds at
+// most one replica of each chunk
+func nodeChunkOrder(a, b *dynamodb.ChunkMetadata) bool {
+	if a.FileID != b.FileID {
+		return a.FileID < b.FileID
+	}
+	return a.ChunkIndex < b.ChunkIndex
+}
+
+// pageAfter sorts chunks by less and returns up to limit of those that follow after
+// (from the start when after is nil, without a cap when limit is 0)
+func pageAfter(chunks []*dynamodb.ChunkMetadata, after *dynamodb.ChunkMetadata, less func(a, b *dynamodb.ChunkMetadata) bool, limit int) []*dynamodb.ChunkMetadata {
+	if after != nil {
+		kept := chunks[:0]
+		for _, chunk := range chunks {
+			if less(after, chunk) {
+				kept = append(kept, chunk)
+			}
+		}
+		chunks = kept
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return less(chunks[i], chunks[j])
+	})
+	if limit > 0 && len(chunks) > limit {
+		chunks = chunks[:limit]
+	}
+	return chunks
+}
+
+// copyChunks returns copies of stored records, so callers never share them
+func copyChunks(chunks []*dynamodb.ChunkMetadata) []*dynamodb.ChunkMetadata {
+	copies := make([]*dynamodb.ChunkMetadata, len(chunks))
+	for i, chunk := range chunks {
+		copied := *chunk
+		copies[i] = &copied
+	}
+	return copies
+}
+
+func (m *MemoryStore) MoveChunkReplica(ctx context.Context, tableName string, metadata *dynamodb.ChunkMetadata, fromNodeID string) error {
+	metadata.ChunkReplicaKey = fmt.Sprintf("%d#%s", metadata.ChunkIndex, metadata.NodeID)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkReplica(tableName, metadata.FileID, metadata.ChunkIndex, fromNodeID); err != nil {
+		return err
+	}
+	m.putChunk(tableName, metadata)
+	m.deleteChunk(tableName, metadata.FileID, metadata.ChunkIndex, fromNodeID)
+	return nil
+}
+
+// checkReplica fails with ErrConditionFailed unless the replica exists; mu must be held
+func (m *MemoryStore) checkReplica(tableName string, fileID string, chunkIndex int, nodeID string) error {
+	if _, ok := m.chunks[tableName][fileID][fmt.Sprintf("%d#%s", chunkIndex, nodeID)]; !ok {
+		return fmt.Errorf("%w: replica of chunk %d on %s no longer exists", dynamodb.ErrConditionFailed, chunkIndex, nodeID)
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteChunkMetadata(ctx context.Context, tableName string, fileID string, chunkIndex int, nodeID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteChunk(tableName, fileID, chunkIndex, nodeID)
+	return nil
+}
+
+func (m *MemoryStore) AdjustChunkRef(ctx context.Context, tableName string, checksum string, nodeID string, delta int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ref := m.adjustedRef(tableName, checksum, nodeID, delta)
+	m.putRef(tableName, ref)
+	return ref.Refs, nil
+}
+
+// adjustedRef returns the ref record as it looks after adding delta; mu must be held
+func (m *MemoryStore) adjustedRef(tableName string, checksum string, nodeID string, delta int64) *dynamodb.ChunkRef {
+	refs := max(m.refs[tableName][checksum][nodeID]+delta, 0)
+	return &dynamodb.ChunkRef{Checksum: checksum, NodeID: nodeID, Refs: refs}
+}
+
+func (m *MemoryStore) SetChunkRef(ctx context.Context, tableName string, checksum string, nodeID string, refs int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.putRef(tableName, &dynamodb.ChunkRef{Checksum: checksum, NodeID: nodeID, Refs: refs})
+	return nil
+}
+
+func (m *MemoryStore) GetChunkRefs(ctx context.Context, tableName string, checksum string) ([]*dynamodb.ChunkRef, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var refs []*dynamodb.ChunkRef
+	for nodeID, count := range m.refs[tableName][checksum] {
+		refs = append(refs, &dynamodb.ChunkRef{Checksum: checksum, NodeID: nodeID, Refs: count})
+	}
+
+	// Match DynamoDB's range key ordering
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].NodeID < refs[j].NodeID
+	})
+	return refs, nil
+}
+
+func (m *MemoryStore) RegisterNode(ctx context.Context, tableName string, node *dynamodb.NodeInfo) error {
+	node.HeartbeatTS = time.Now().Unix()
+	if node.Status == "" {
+		node.Status = dynamodb.NodeStatusActive
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.putNode(tableName, node)
+	return nil
+}
+
+func (m *MemoryStore) UpdateHeartbeat(ctx context.Context, tableName string, nodeID string, availableSpace int64, disks []dynamodb.DiskInfo) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.putNode(tableName, m.heartbeatNode(tableName, nodeID, availableSpace, disks))
+	return nil
+}
+
+// heartbeatNode returns the node record as it looks after a heartbeat.
+// Like DynamoDB UpdateItem, a heartbeat for an unknown node creates the record.
+func (m *MemoryStore) heartbeatNode(tableName string, nodeID string, availableSpace int64, disks []dynamodb.DiskInfo) *dynamodb.NodeInfo {
+	node := &dynamodb.NodeInfo{NodeID: nodeID}
+	if existing, ok := m.nodes[tableName][nodeID]; ok {
+		copied := *existing
+		node = &copied
+	}
+	node.HeartbeatTS = time.Now().Unix()
+	if node.Status == "" {
+		node.Status = dynamodb.NodeStatusActive
+	}
+	if availableSpace >= 0 {
+		node.AvailableSpace = availableSpace
+	}
+	if disks != nil {
+		node.Disks = append([]dynamodb.DiskInfo(nil), disks...)
+	}
+	return node
+}
+
+func (m *MemoryStore) SetNodeStatus(ctx context.Context, tableName string, nodeID string, status string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, err := m.statusNode(tableName, nodeID, status)
+	if err != nil {
+		return err
+	}
+	m.putNode(tableName, node)
+	return nil
+}
+
+// statusNode returns the node record with its status changed; mu must be held
+func (m *MemoryStore) statusNode(tableName string, nodeID string, status string) (*dynamodb.NodeInfo, error) {
+	existing, ok := m.nodes[tableName][nodeID]
+	if !ok {
+		return nil, fmt.Errorf("%w: node %s", dynamodb.ErrNotFound, nodeID)
+	}
+	node := *existing
+	node.Status = status
+	return &node, nil
+}
+
+func (m *MemoryStore) ListActiveNodes(ctx context.Context, tableName string, heartbeatTimeout int64, opts ...dynamodb.QueryOption) ([]*dynamodb.NodeInfo, error) {
+	return m.ListNodesByStatus(ctx, tableName, dynamodb.NodeStatusActive, heartbeatTimeout, opts...)
+}
+
+func (m *MemoryStore) ListNodesByStatus(ctx context.Context, tableName string, status string, heartbeatTimeout int64, opts ...dynamodb.QueryOption) ([]*dynamodb.NodeInfo, error) {
+	nodes, err := m.ListNodes(ctx, tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	var matched []*dynamodb.NodeInfo
+	for _, node := range nodes {
+		if now-node.HeartbeatTS <= heartbeatTimeout && node.Status == status {
+			matched = append(matched, node)
+		}
+	}
+	return capItems(matched, opts), nil
+}
+
+func (m *MemoryStore) ListNodes(ctx context.Context, tableName string, opts ...dynamodb.QueryOption) ([]*dynamodb.NodeInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var nodes []*dynamodb.NodeInfo
+	for _, node := range m.nodes[tableName] {
+		copied := *node
+		nodes = append(nodes, &copied)
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].NodeID < nodes[j].NodeID
+	})
+	return capItems(nodes, opts), nil
+}
+
+func (m *MemoryStore) GetNode(ctx context.Context, tableName string, nodeID string) (*dynamodb.NodeInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	node, ok := m.nodes[tableName][nodeID]
+	if !ok {
+		return nil, fmt.Errorf("%w: node %s", dynamodb.ErrNotFound, nodeID)
+	}
+	copied := *node
+	return &copied, nil
+}
+
+func (m *MemoryStore) CreateFileMetadata(ctx context.Context, tableName string, file *dynamodb.FileMetadata) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.files[tableName][file.FileID]; exists {
+		return fmt.Errorf("%w: file %s already exists", dynamodb.ErrConditionFailed, file.FileID)
+	}
+
+	file.State = dynamodb.FileStateUploading
+	file.CreatedAt = time.Now().Unix()
+	m.putFile(tableName, file)
+	return nil
+}
+
+func (m *MemoryStore) GetFileMetadata(ctx context.Context, tableName string, fileID string) (*dynamodb.FileMetadata, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	file, ok := m.files[tableName][fileID]
+	if !ok {
+		return nil, fmt.Errorf("%w: file %s", dynamodb.ErrNotFound, fileID)
+	}
+	copied := *file
+	copied.ChunkChecksums = append([]string(nil), file.ChunkChecksums...)
+	return &copied, nil
+}
+
+func (m *MemoryStore) CompleteFile(ctx context.Context, tableName string, fileID string, chunkChecksums []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, err := m.completedFile(tableName, fileID, chunkChecksums)
+	if err != nil {
+		return err
+	}
+	m.putFile(tableName, file)
+	return nil
+}
+
+// completedFile returns the file record as it looks after CompleteFile, or ErrConditionFailed
+func (m *MemoryStore) completedFile(tableName string, fileID string, chunkChecksums []string) (*dynamodb.FileMetadata, error) {
+	existing, ok := m.files[tableName][fileID]
+	if !ok || existing.State != dynamodb.FileStateUploading {
+		return nil, fmt.Errorf("%w: file %s is not uploading", dynamodb.ErrConditionFailed, fileID)
+	}
+
+	file := *existing
+	file.State = dynamodb.FileStateComplete
+	file.ChunkChecksums = append([]string(nil), chunkChecksums...)
+	file.CompletedAt = time.Now().Unix()
+	return &file, nil
+}
+
+// The raw record setters below store copies and must be called with mu held.
+
+func (m *MemoryStore) putChunk(tableName string, metadata *dynamodb.ChunkMetadata) {
+	table, ok := m.chunks[tableName]
+	if !ok {
+		table = make(map[string]map[string]*dynamodb.ChunkMetadata)
+		m.chunks[tableName] = table
+	}
+	file, ok := table[metadata.FileID]
+	if !ok {
+		file = make(map[string]*dynamodb.ChunkMetadata)
+		table[metadata.FileID] = file
+	}
+	stored := *metadata
+	file[metadata.ChunkReplicaKey] = &stored
+}
+
+func (m *MemoryStore) deleteChunk(tableName string, fileID string, chunkIndex int, nodeID string) {
+	if file, ok := m.chunks[tableName][fileID]; ok {
+		delete(file, fmt.Sprintf("%d#%s", chunkIndex, nodeID))
+		if len(file) == 0 {
+			delete(m.chunks[tableName], fileID)
+		}
+	}
+}
+
+// putRef stores a ref count, removing the record once no replica uses the body
+func (m *MemoryStore) putRef(tableName string, ref *dynamodb.ChunkRef) {
+	table, ok := m.refs[tableName]
+	if !ok {
+		table = make(map[string]map[string]int64)
+		m.refs[tableName] = table
+	}
+	if ref.Refs <= 0 {
+		delete(table[ref.Checksum], ref.NodeID)
+		if len(table[ref.Checksum]) == 0 {
+			delete(table, ref.Checksum)
+		}
+		return
+	}
+	nodes, ok := table[ref.Checksum]
+	if !ok {
+		nodes = make(map[string]int64)
+		table[ref.Checksum] = nodes
+	}
+	nodes[ref.NodeID] = ref.Refs
+}
+
+func (m *MemoryStore) putNode(tableName string, node *dynamodb.NodeInfo) {
+	table, ok := m.nodes[tableName]
+	if !ok {
+		table = make(map[string]*dynamodb.NodeInfo)
+		m.nodes[tableName] = table
+	}
+	stored := *node
+	table[node.NodeID] = &stored
+}
+
+func (m *MemoryStore) putFile(tableName string, file *dynamodb.FileMetadata) {
+	table, ok := m.files[tableName]
+	if !ok {
+		table = make(map[string]*dynamodb.FileMetadata)
+		m.files[tableName] = table
+	}
+	stored := *file
+	stored.ChunkChecksums = append([]string(nil), file.ChunkChecksums...)
+	table[file.FileID] = &stored
+}
+
+// memorySnapshot is the serialized form of every table held by a MemoryStore
+type memorySnapshot struct {
+	Chunks map[string][]*dynamodb.ChunkMetadata `json:"chunks"`
+	Nodes  map[string][]*dynamodb.NodeInfo      `json:"nodes"`
+	Files  map[string][]*dynamodb.FileMetadata  `json:"files"`
+	Refs   map[string][]*dynamodb.ChunkRef      `json:"refs,omitempty"`
+}
+
+// snapshot copies the full store contents; mu must be held
+func (m *MemoryStore) snapshot() *memorySnapshot {
+	snap := &memorySnapshot{
+		Chunks: make(map[string][]*dynamodb.ChunkMetadata),
+		Nodes:  make(map[string][]*dynamodb.NodeInfo),
+		Files:  make(map[string][]*dynamodb.FileMetadata),
+		Refs:   make(map[string][]*dynamodb.ChunkRef),
+	}
+	for tableName, table := range m.chunks {
+		for _, file := range table {
+			for _, chunk := range file {
+				snap.Chunks[tableName] = append(snap.Chunks[tableName], chunk)
+			}
+		}
+	}
+	for tableName, table := range m.nodes {
+		for _, node := range table {
+			snap.Nodes[tableName] = append(snap.Nodes[tableName], node)
+		}
+	}
+	for tableName, table := range m.files {
+		for _, file := range table {
+			snap.Files[tableName] = append(snap.Files[tableName], file)
+		}
+	}
+	for tableName, table := range m.refs {
+		for checksum, nodes := range table {
+			for nodeID, refs := range nodes {
+				snap.Refs[tableName] = append(snap.Refs[tableName], &dynamodb.ChunkRef{Checksum: checksum, NodeID: nodeID, Refs: refs})
+			}
+		}
+	}
+	return snap
+}
+
+// restore loads a snapshot into the store; mu must be held
+func (m *MemoryStore) restore(snap *memorySnapshot) {
+	for tableName, chunks := range snap.Chunks {
+		for _, chunk := range chunks {
+			m.putChunk(tableName, chunk)
+		}
+	}
+	for tableName, nodes := range snap.Nodes {
+		for _, node := range nodes {
+			m.putNode(tableName, node)
+		}
+	}
+	for tableName, files := range snap.Files {
+		for _, file := range files {
+			m.putFile(tableName, file)
+		}
+	}
+	for tableName, refs := range snap.Refs {
+		for _, ref := range refs {
+			m.putRef(tableName, ref)
+		}
+	}
+}
@@ -0,0 +1,413 @@
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/timskillet/distributed-filestore/internal/dynamodb"
+)
+
+// rpcRequest carries the arguments of any MetadataStore call over HTTP
+type rpcRequest struct {
+	Table            string                  `json:"table"`
+	FileID           string                  `json:"file_id,omitempty"`
+	NodeID           string                  `json:"node_id,omitempty"`
+	ChunkIndex       int                     `json:"chunk_index,omitempty"`
+	HeartbeatTimeout int64                   `json:"heartbeat_timeout,omitempty"`
+	MaxItems         int                     `json:"max_items,omitempty"`
+	AvailableSpace   int64                   `json:"available_space"`
+	Disks            []dynamodb.DiskInfo     `json:"disks,omitempty"`
+	Status           string                  `json:"status,omitempty"`
+	Chunk            *dynamodb.ChunkMetadata `json:"chunk,omitempty"`
+	Ref              *dynamodb.ChunkRef      `json:"ref,omitempty"` // Refs holds the delta for AdjustChunkRef
+	Node             *dynamodb.NodeInfo      `json:"node,omitempty"`
+	File             *dynamodb.FileMetadata  `json:"file,omitempty"`
+	Checksums        []string                `json:"checksums,omitempty"`
+	After            *dynamodb.ChunkMetadata `json:"after,omitempty"` // Paged listings resume after this record
+}
+
+// rpcResponse carries the results of any MetadataStore call over HTTP
+type rpcResponse struct {
+	Chunk  *dynamodb.ChunkMetadata   `json:"chunk,omitempty"`
+	Chunks []*dynamodb.ChunkMetadata `json:"chunks,omitempty"`
+	Ref    *dynamodb.ChunkRef        `json:"ref,omitempty"`
+	Refs   []*dynamodb.ChunkRef      `json:"refs,omitempty"`
+	Node   *dynamodb.NodeInfo        `json:"node,omitempty"`
+	Nodes  []*dynamodb.NodeInfo      `json:"nodes,omitempty"`
+	File   *dynamodb.FileMetadata    `json:"file,omitempty"`
+}
+
+// RemoteStore is a MetadataStore that forwards every call to a metadata service
+// exposed by dfs-api, so storage nodes can share the API server's local backend
+type RemoteStore struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+func NewRemoteStore(baseURL string, token string) *RemoteStore {
+	return &RemoteStore{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+func (s *RemoteStore) call(ctx context.Context, method string, req *rpcRequest) (*rpcResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s request: %w", method, err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, s.baseURL+"/metadata/"+method, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s request: %w", method, err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+s.token)
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call metadata service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		text := strings.TrimSpace(string(msg))
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return nil, fmt.Errorf("%w: %s", dynamodb.ErrNotFound, text)
+		case http.StatusConflict:
+			return nil, fmt.Errorf("%w: %s", dynamodb.ErrConditionFailed, text)
+		case http.StatusUnauthorized:
+			return nil, fmt.Errorf("metadata service rejected METADATA_TOKEN: %s", text)
+		default:
+			return nil, fmt.Errorf("metadata service %s failed: %s", method, text)
+		}
+	}
+
+	var out rpcResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("failed to decode %s response: %w", method, err)
+	}
+	return &out, nil
+}
+
+func (s *RemoteStore) PutChunkMetadata(ctx context.Context, tableName string, metadata *dynamodb.ChunkMetadata) error {
+	out, err := s.call(ctx, "PutChunkMetadata", &rpcRequest{Table: tableName, Chunk: metadata})
+	if err != nil {
+		return err
+	}
+	if out.Chunk != nil {
+		*metadata = *out.Chunk
+	}
+	return nil
+}
+
+func (s *RemoteStore) MoveChunkReplica(ctx context.Context, tableName string, metadata *dynamodb.ChunkMetadata, fromNodeID string) error {
+	out, err := s.call(ctx, "MoveChunkReplica", &rpcRequest{Table: tableName, Chunk: metadata, NodeID: fromNodeID})
+	if err != nil {
+		return err
+	}
+	if out.Chunk != nil {
+		*metadata = *out.Chunk
+	}
+	return nil
+}
+
+func (s *RemoteStore) GetChunkReplicas(ctx context.Context, tableName string, fileID string, chunkIndex int, opts ...dynamodb.QueryOption) ([]*dynamodb.ChunkMetadata, error) {
+	out, err := s.call(ctx, "GetChunkReplicas", &rpcRequest{Table: tableName, FileID: fileID, ChunkIndex: chunkIndex, MaxItems: maxItems(opts)})
+	if err != nil {
+		return nil, err
+	}
+	return out.Chunks, nil
+}
+
+func (s *RemoteStore) GetChunksByFileID(ctx context.Context, tableName string, fileID string, opts ...dynamodb.QueryOption) ([]*dynamodb.ChunkMetadata, error) {
+	out, err := s.call(ctx, "GetChunksByFileID", &rpcRequest{Table: tableName, FileID: fileID, MaxItems: maxItems(opts)})
+	if err != nil {
+		return nil, err
+	}
+	return out.Chunks, nil
+}
+
+func (s *RemoteStore) IterChunksByFileID(ctx context.Context, tableName string, fileID string) iter.Seq2[*dynamodb.ChunkMetadata, error] {
+	return pageSeq(func(after *dynamodb.ChunkMetadata) ([]*dynamodb.ChunkMetadata, error) {
+		out, err := s.call(ctx, "PageChunksByFileID", &rpcRequest{Table: tableName, FileID: fileID, After: after, MaxItems: chunkPageSize})
+		if err != nil {
+			return nil, err
+		}
+		return out.Chunks, nil
+	})
+}
+
+func (s *RemoteStore) GetChunksByNodeID(ctx context.Context, tableName string, nodeID string, opts ...dynamodb.QueryOption) ([]*dynamodb.ChunkMetadata, error) {
+	out, err := s.call(ctx, "GetChunksByNodeID", &rpcRequest{Table: tableName, NodeID: nodeID, MaxItems: maxItems(opts)})
+	if err != nil {
+		return nil, err
+	}
+	return out.Chunks, nil
+}
+
+func (s *RemoteStore) IterChunksByNodeID(ctx context.Context, tableName string, nodeID string) iter.Seq2[*dynamodb.ChunkMetadata, error] {
+	return pageSeq(func(after *dynamodb.ChunkMetadata) ([]*dynamodb.ChunkMetadata, error) {
+		out, err := s.call(ctx, "PageChunksByNodeID", &rpcRequest{Table: tableName, NodeID: nodeID, After: after, MaxItems: chunkPageSize})
+		if err != nil {
+			return nil, err
+		}
+		return out.Chunks, nil
+	})
+}
+
+func (s *RemoteStore) DeleteChunkMetadata(ctx context.Context, tableName string, fileID string, chunkIndex int, nodeID string) error {
+	_, err := s.call(ctx, "DeleteChunkMetadata", &rpcRequest{Table: tableName, FileID: fileID, ChunkIndex: chunkIndex, NodeID: nodeID})
+	return err
+}
+
+func (s *RemoteStore) AdjustChunkRef(ctx context.Context, tableName string, checksum string, nodeID string, delta int64) (int64, error) {
+	out, err := s.call(ctx, "AdjustChunkRef", &rpcRequest{Table: tableName, Ref: &dynamodb.ChunkRef{Checksum: checksum, NodeID: nodeID, Refs: delta}})
+	if err != nil {
+		return 0, err
+	}
+	if out.Ref == nil {
+		return 0, nil
+	}
+	return out.Ref.Refs, nil
+}
+
+func (s *RemoteStore) SetChunkRef(ctx context.Context, tableName string, checksum string, nodeID string, refs int64) error {
+	_, err := s.call(ctx, "SetChunkRef", &rpcRequest{Table: tableName, Ref: &dynamodb.ChunkRef{Checksum: checksum, NodeID: nodeID, Refs: refs}})
+	return err
+}
+
+func (s *RemoteStore) GetChunkRefs(ctx context.Context, tableName string, checksum string) ([]*dynamodb.ChunkRef, error) {
+	out, err := s.call(ctx, "GetChunkRefs", &rpcRequest{Table: tableName, Ref: &dynamodb.ChunkRef{Checksum: checksum}})
+	if err != nil {
+		return nil, err
+	}
+	return out.Refs, nil
+}
+
+func (s *RemoteStore) RegisterNode(ctx context.Context, tableName string, node *dynamodb.NodeInfo) error {
+	out, err := s.call(ctx, "RegisterNode", &rpcRequest{Table: tableName, Node: node})
+	if err != nil {
+		return err
+	}
+	if out.Node != nil {
+		*node = *out.Node
+	}
+	return nil
+}
+
+func (s *RemoteStore) UpdateHeartbeat(ctx context.Context, tableName string, nodeID string, availableSpace int64, disks []dynamodb.DiskInfo) error {
+	_, err := s.call(ctx, "UpdateHeartbeat", &rpcRequest{Table: tableName, NodeID: nodeID, AvailableSpace: availableSpace, Disks: disks})
+	return err
+}
+
+func (s *RemoteStore) SetNodeStatus(ctx context.Context, tableName string, nodeID string, status string) error {
+	_, err := s.call(ctx, "SetNodeStatus", &rpcRequest{Table: tableName, NodeID: nodeID, Status: status})
+	return err
+}
+
+func (s *RemoteStore) ListNodesByStatus(ctx context.Context, tableName string, status string, heartbeatTimeout int64, opts ...dynamodb.QueryOption) ([]*dynamodb.NodeInfo, error) {
+	out, err := s.call(ctx, "ListNodesByStatus", &rpcRequest{Table: tableName, Status: status, HeartbeatTimeout: heartbeatTimeout, MaxItems: maxItems(opts)})
+	if err != nil {
+		return nil, err
+	}
+	return out.Nodes, nil
+}
+
+func (s *RemoteStore) ListActiveNodes(ctx context.Context, tableName string, heartbeatTimeout int64, opts ...dynamodb.QueryOption) ([]*dynamodb.NodeInfo, error) {
+	out, err := s.call(ctx, "ListActiveNodes", &rpcRequest{Table: tableName, HeartbeatTimeout: heartbeatTimeout, MaxItems: maxItems(opts)})
+	if err != nil {
+		return nil, err
+	}
+	return out.Nodes, nil
+}
+
+func (s *RemoteStore) ListNodes(ctx context.Context, tableName string, opts ...dynamodb.QueryOption) ([]*dynamodb.NodeInfo, error) {
+	out, err := s.call(ctx, "ListNodes", &rpcRequest{Table: tableName, MaxItems: maxItems(opts)})
+	if err != nil {
+		return nil, err
+	}
+	return out.Nodes, nil
+}
+
+func (s *RemoteStore) GetNode(ctx context.Context, tableName string, nodeID string) (*dynamodb.NodeInfo, error) {
+	out, err := s.call(ctx, "GetNode", &rpcRequest{Table: tableName, NodeID: nodeID})
+	if err != nil {
+		return nil, err
+	}
+	return out.Node, nil
+}
+
+func (s *RemoteStore) CreateFileMetadata(ctx context.Context, tableName string, file *dynamodb.FileMetadata) error {
+	out, err := s.call(ctx, "CreateFileMetadata", &rpcRequest{Table: tableName, File: file})
+	if err != nil {
+		return err
+	}
+	if out.File != nil {
+		*file = *out.File
+	}
+	return nil
+}
+
+func (s *RemoteStore) GetFileMetadata(ctx context.Context, tableName string, fileID string) (*dynamodb.FileMetadata, error) {
+	out, err := s.call(ctx, "GetFileMetadata", &rpcRequest{Table: tableName, FileID: fileID})
+	if err != nil {
+		return nil, err
+	}
+	return out.File, nil
+}
+
+func (s *RemoteStore) CompleteFile(ctx context.Context, tableName string, fileID string, chunkChecksums []string) error {
+	_, err := s.call(ctx, "CompleteFile", &rpcRequest{Table: tableName, FileID: fileID, Checksums: chunkChecksums})
+	return err
+}
+
+func maxItems(opts []dynamodb.QueryOption) int {
+	return dynamodb.ApplyQueryOptions(opts).MaxItems
+}
+
+// NewHandler exposes a MetadataStore over HTTP for RemoteStore clients.
+// It is mounted at /metadata/ and dispatches on the final path segment.
+// Every request must carry token as a bearer token, since the handler
+// can rewrite any metadata.
+func NewHandler(store MetadataStore, token string) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte("Method not allowed"))
+			return
+		}
+
+		var req rpcRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		ctx := r.Context()
+		method := strings.TrimPrefix(r.URL.Path, "/metadata/")
+		var out rpcResponse
+		var err error
+
+		switch method {
+		case "PutChunkMetadata":
+			if req.Chunk == nil {
+				http.Error(w, "missing chunk", http.StatusBadRequest)
+				return
+			}
+			err = store.PutChunkMetadata(ctx, req.Table, req.Chunk)
+			out.Chunk = req.Chunk
+		case "GetChunkReplicas":
+			out.Chunks, err = store.GetChunkReplicas(ctx, req.Table, req.FileID, req.ChunkIndex, dynamodb.WithMaxItems(req.MaxItems))
+		case "GetChunksByFileID":
+			out.Chunks, err = store.GetChunksByFileID(ctx, req.Table, req.FileID, dynamodb.WithMaxItems(req.MaxItems))
+		case "GetChunksByNodeID":
+			out.Chunks, err = store.GetChunksByNodeID(ctx, req.Table, req.NodeID, dynamodb.WithMaxItems(req.MaxItems))
+		// The service's backends keep metadata in memory, so a page is cut from the full
+		// listing; only the page crosses the network
+		case "PageChunksByFileID":
+			out.Chunks, err = store.GetChunksByFileID(ctx, req.Table, req.FileID)
+			out.Chunks = pageAfter(out.Chunks, req.After, fileChunkOrder, req.MaxItems)
+		case "PageChunksByNodeID":
+			out.Chunks, err = store.GetChunksByNodeID(ctx, req.Table, req.NodeID)
+			out.Chunks = pageAfter(out.Chunks, req.After, nodeChunkOrder, req.MaxItems)
+		case "MoveChunkReplica":
+			if req.Chunk == nil {
+				http.Error(w, "missing chunk", http.StatusBadRequest)
+				return
+			}
+			err = store.MoveChunkReplica(ctx, req.Table, req.Chunk, req.NodeID)
+			out.Chunk = req.Chunk
+		case "DeleteChunkMetadata":
+			err = store.DeleteChunkMetadata(ctx, req.Table, req.FileID, req.ChunkIndex, req.NodeID)
+		case "AdjustChunkRef":
+			if req.Ref == nil {
+				http.Error(w, "missing ref", http.StatusBadRequest)
+				return
+			}
+			ref := *req.Ref
+			ref.Refs, err = store.AdjustChunkRef(ctx, req.Table, ref.Checksum, ref.NodeID, req.Ref.Refs)
+			out.Ref = &ref
+		case "SetChunkRef":
+			if req.Ref == nil {
+				http.Error(w, "missing ref", http.StatusBadRequest)
+				return
+			}
+			err = store.SetChunkRef(ctx, req.Table, req.Ref.Checksum, req.Ref.NodeID, req.Ref.Refs)
+		case "GetChunkRefs":
+			if req.Ref == nil {
+				http.Error(w, "missing ref", http.StatusBadRequest)
+				return
+			}
+			out.Refs, err = store.GetChunkRefs(ctx, req.Table, req.Ref.Checksum)
+		case "RegisterNode":
+			if req.Node == nil {
+				http.Error(w, "missing node", http.StatusBadRequest)
+				return
+			}
+			err = store.RegisterNode(ctx, req.Table, req.Node)
+			out.Node = req.Node
+		case "UpdateHeartbeat":
+			err = store.UpdateHeartbeat(ctx, req.Table, req.NodeID, req.AvailableSpace, req.Disks)
+		case "SetNodeStatus":
+			err = store.SetNodeStatus(ctx, req.Table, req.NodeID, req.Status)
+		case "ListNodesByStatus":
+			out.Nodes, err = store.ListNodesByStatus(ctx, req.Table, req.Status, req.HeartbeatTimeout, dynamodb.WithMaxItems(req.MaxItems))
+		case "ListActiveNodes":
+			out.Nodes, err = store.ListActiveNodes(ctx, req.Table, req.HeartbeatTimeout, dynamodb.WithMaxItems(req.MaxItems))
+		case "ListNodes":
+			out.Nodes, err = store.ListNodes(ctx, req.Table, dynamodb.WithMaxItems(req.MaxItems))
+		case "GetNode":
+			out.Node, err = store.GetNode(ctx, req.Table, req.NodeID)
+		case "CreateFileMetadata":
+			if req.File == nil {
+				http.Error(w, "missing file", http.StatusBadRequest)
+				return
+			}
+			err = store.CreateFileMetadata(ctx, req.Table, req.File)
+			out.File = req.File
+		case "GetFileMetadata":
+			out.File, err = store.GetFileMetadata(ctx, req.Table, req.FileID)
+		case "CompleteFile":
+			err = store.CompleteFile(ctx, req.Table, req.FileID, req.Checksums)
+		default:
+			http.Error(w, fmt.Sprintf("unknown metadata method: %s", method), http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			switch {
+			case errors.Is(err, dynamodb.ErrNotFound):
+				http.Error(w, err.Error(), http.StatusNotFound)
+			case errors.Is(err, dynamodb.ErrConditionFailed):
+				http.Error(w, err.Error(), http.StatusConflict)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	})
+}
@@ -0,0 +1,64 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/timskillet/distributed-filestore/internal/dynamodb"
+)
+
+// wantChunks checks that seq yields the n records put by putChunks, in order
+func wantChunks(t *testing.T, seq iter.Seq2[*dynamodb.ChunkMetadata, error], n int, less func(a, b *dynamodb.ChunkMetadata) bool) {
+	t.Helper()
+	var prev *dynamodb.ChunkMetadata
+	count := 0
+	for chunk, err := range seq {
+		if err != nil {
+			t.Fatalf("iteration failed after %d records: %v", count, err)
+		}
+		if prev != nil && !less(prev, chunk) {
+			t.Fatalf("record %d (%s %s) does not follow %s %s", count, chunk.FileID, chunk.ChunkReplicaKey, prev.FileID, prev.ChunkReplicaKey)
+		}
+		prev = chunk
+		count++
+	}
+	if count != n {
+		t.Fatalf("iterated %d records, want %d", count, n)
+	}
+}
+
+func TestIterChunksPagesThroughLargeListings(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemoryStore()
+	n := 2*chunkPageSize + 17
+	for i := range n {
+		// Two files on node-a so the node listing crosses a file boundary mid-page
+		err := mem.PutChunkMetadata(ctx, "chunks", &dynamodb.ChunkMetadata{
+			FileID:     fmt.Sprintf("file-%d", i%2),
+			ChunkIndex: i / 2,
+			NodeID:     "node-a",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range n {
+		err := mem.PutChunkMetadata(ctx, "chunks", &dynamodb.ChunkMetadata{FileID: "file-0", ChunkIndex: i, NodeID: "node-b"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	service := httptest.NewServer(NewHandler(mem, "token"))
+	defer service.Close()
+	remote := NewRemoteStore(service.URL, "token")
+
+	for name, store := range map[string]MetadataStore{"memory": mem, "remote": remote} {
+		t.Run(name, func(t *testing.T) {
+			wantChunks(t, store.IterChunksByNodeID(ctx, "chunks", "node-a"), n, nodeChunkOrder)
+			wantChunks(t, store.IterChunksByFileID(ctx, "chunks", "file-0"), (n+1)/2+n, fileChunkOrder)
+		})
+	}
+}
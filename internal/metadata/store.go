@@ -0,0 +1,142 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"iter"
+
+	"github.com/timskillet/distributed-filestore/internal/config"
+	"github.com/timskillet/distributed-filestore/internal/dynamodb"
+)
+
+// MetadataStore is the set of chunk-metadata, chunk-ref, node-registry and file-manifest operations
+// used by the API server and storage nodes. Table names are passed through so every
+// backend can keep the same layout as the DynamoDB deployment.
+type MetadataStore interface {
+	// Chunk metadata
+	// List operations return every matching item unless capped with dynamodb.WithMaxItems;
+	// the Iter variants stream results for sets too large to hold in memory, fetching
+	// one page at a time (a DynamoDB page, or chunkPageSize records elsewhere).
+	PutChunkMetadata(ctx context.Context, tableName string, metadata *dynamodb.ChunkMetadata) error
+	GetChunkReplicas(ctx context.Context, tableName string, fileID string, chunkIndex int, opts ...dynamodb.QueryOption) ([]*dynamodb.ChunkMetadata, error)
+	GetChunksByFileID(ctx context.Context, tableName string, fileID string, opts ...dynamodb.QueryOption) ([]*dynamodb.ChunkMetadata, error)
+	IterChunksByFileID(ctx context.Context, tableName string, fileID string) iter.Seq2[*dynamodb.ChunkMetadata, error]
+	GetChunksByNodeID(ctx context.Context, tableName string, nodeID string, opts ...dynamodb.QueryOption) ([]*dynamodb.ChunkMetadata, error)
+	IterChunksByNodeID(ctx context.Context, tableName string, nodeID string) iter.Seq2[*dynamodb.ChunkMetadata, error]
+	MoveChunkReplica(ctx context.Context, tableName string, metadata *dynamodb.ChunkMetadata, fromNodeID string) error
+	DeleteChunkMetadata(ctx context.Context, tableName string, fileID string, chunkIndex int, nodeID string) error
+
+	// Chunk body reference counts, per node
+	AdjustChunkRef(ctx context.Context, tableName string, checksum string, nodeID string, delta int64) (int64, error)
+	SetChunkRef(ctx context.Context, tableName string, checksum string, nodeID string, refs int64) error
+	GetChunkRefs(ctx context.Context, tableName string, checksum string) ([]*dynamodb.ChunkRef, error)
+
+	// Node registry
+	RegisterNode(ctx context.Context, tableName string, node *dynamodb.NodeInfo) error
+	UpdateHeartbeat(ctx context.Context, tableName string, nodeID string, availableSpace int64, disks []dynamodb.DiskInfo) error
+	SetNodeStatus(ctx context.Context, tableName string, nodeID string, status string) error
+	ListActiveNodes(ctx context.Context, tableName string, heartbeatTimeout int64, opts ...dynamodb.QueryOption) ([]*dynamodb.NodeInfo, error)
+	ListNodesByStatus(ctx context.Context, tableName string, status string, heartbeatTimeout int64, opts ...dynamodb.QueryOption) ([]*dynamodb.NodeInfo, error)
+	ListNodes(ctx context.Context, tableName string, opts ...dynamodb.QueryOption) ([]*dynamodb.NodeInfo, error)
+	GetNode(ctx context.Context, tableName string, nodeID string) (*dynamodb.NodeInfo, error)
+
+	// File manifests
+	CreateFileMetadata(ctx context.Context, tableName string, file *dynamodb.FileMetadata) error
+	GetFileMetadata(ctx context.Context, tableName string, fileID string) (*dynamodb.FileMetadata, error)
+	CompleteFile(ctx context.Context, tableName string, fileID string, chunkChecksums []string) error
+}
+
+var (
+	_ MetadataStore = (*dynamodb.Client)(nil)
+	_ MetadataStore = (*MemoryStore)(nil)
+	_ MetadataStore = (*FileStore)(nil)
+	_ MetadataStore = (*RemoteStore)(nil)
+)
+
+// NewStore creates the metadata backend selected by cfg.MetadataBackend
+func NewStore(ctx context.Context, cfg *config.Config) (MetadataStore, error) {
+	switch cfg.MetadataBackend {
+	case "dynamodb":
+		client, err := dynamodb.NewClient(ctx, dynamodb.ClientOptions{
+			Region:          cfg.AWSRegion,
+			Endpoint:        cfg.DynamoDBEndpoint,
+			AccessKeyID:     cfg.DynamoDBAccessKeyID,
+			SecretAccessKey: cfg.DynamoDBSecretAccessKey,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create DynamoDB client: %w", err)
+		}
+		if cfg.DynamoDBCreateTables {
+			err := client.EnsureTables(ctx, dynamodb.TableNames{
+				ChunkMetadata: cfg.ChunkMetadataTable,
+				NodeRegistry:  cfg.NodeRegistryTable,
+				FileMetadata:  cfg.FileMetadataTable,
+				ChunkRefs:     cfg.ChunkRefsTable,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to bootstrap DynamoDB tables: %w", err)
+			}
+		}
+		return client, nil
+	case "memory":
+		return NewMemoryStore(), nil
+	case "file":
+		store, err := NewFileStore(cfg.MetadataDir, cfg.MetadataSnapshotEvery)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open file metadata store: %w", err)
+		}
+		return store, nil
+	case "remote":
+		return NewRemoteStore(cfg.MetadataURL, cfg.MetadataToken), nil
+	default:
+		return nil, fmt.Errorf("unknown metadata backend: %s", cfg.MetadataBackend)
+	}
+}
+
+// ServesRemote reports whether the backend is local to this process and should be
+// exposed over HTTP so storage nodes can use it through the "remote" backend
+func ServesRemote(cfg *config.Config) bool {
+	return cfg.MetadataBackend == "memory" || cfg.MetadataBackend == "file"
+}
+
+// chunkPageSize is how many chunk records the memory and remote iterators copy or
+// fetch at a time
+const chunkPageSize = 1000
+
+// pageSeq streams chunk records a page at a time. next returns up to chunkPageSize
+// records that follow after in the listing's order, starting from nil; a short page
+// ends the listing.
+func pageSeq(next func(after *dynamodb.ChunkMetadata) ([]*dynamodb.ChunkMetadata, error)) iter.Seq2[*dynamodb.ChunkMetadata, error] {
+	return func(yield func(*dynamodb.ChunkMetadata, error) bool) {
+		var after *dynamodb.ChunkMetadata
+		for {
+			page, err := next(after)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if len(page) == 0 {
+				return
+			}
+			// The cursor is copied first, since callers may change the records they get
+			last := *page[len(page)-1]
+			after = &last
+			for _, chunk := range page {
+				if !yield(chunk, nil) {
+					return
+				}
+			}
+			if len(page) < chunkPageSize {
+				return
+			}
+		}
+	}
+}
+
+// capItems truncates items to the MaxItems requested by opts
+func capItems[T any](items []T, opts []dynamodb.QueryOption) []T {
+	if o := dynamodb.ApplyQueryOptions(opts); o.MaxItems > 0 && len(items) > o.MaxItems {
+		return items[:o.MaxItems]
+	}
+	return items
+}
@@ -10,8 +10,10 @@ import (
 	"time"
 )
 
-// GetEC2InstanceMetadata retrieves metadata from EC2 instance metadata service
-func GetEC2InstanceMetadata() (instanceID string, privateIP string, err error) {
+// GetEC2InstanceMetadata retrieves metadata from EC2 instance metadata service.
+// The failure domain is the instance's availability zone unless NODE_FAILURE_DOMAIN
+// is set, and is left empty if neither is available.
+func GetEC2InstanceMetadata() (instanceID string, privateIP string, failureDomain string, err error) {
 	// Try to get from environment variables first (for local testing)
 	if id := os.Getenv("NODE_ID"); id != "" {
 		instanceID = id
@@ -19,7 +21,7 @@ func GetEC2InstanceMetadata() (instanceID string, privateIP string, err error) {
 		// Get instance ID from EC2 metadata
 		instanceID, err = getMetadata("instance-id")
 		if err != nil {
-			return "", "", fmt.Errorf("failed to get instance ID: %w", err)
+			return "", "", "", fmt.Errorf("failed to get instance ID: %w", err)
 		}
 	}
 
@@ -29,11 +31,18 @@ func GetEC2InstanceMetadata() (instanceID string, privateIP string, err error) {
 	} else {
 		privateIP, err = getMetadata("local-ipv4")
 		if err != nil {
-			return "", "", fmt.Errorf("failed to get private IP: %w", err)
+			return "", "", "", fmt.Errorf("failed to get private IP: %w", err)
 		}
 	}
 
-	return instanceID, privateIP, nil
+	// Get availability zone (replicas of a chunk are spread across zones)
+	if domain := os.Getenv("NODE_FAILURE_DOMAIN"); domain != "" {
+		failureDomain = domain
+	} else if zone, err := getMetadata("placement/availability-zone"); err == nil {
+		failureDomain = zone
+	}
+
+	return instanceID, privateIP, failureDomain, nil
 }
 
 func getMetadata(path string) (string, error) {
@@ -1,17 +1,17 @@
 package node
 
 import (
+	"bytes"
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
 	"time"
 
+	"github.com/timskillet/distributed-filestore/internal/chunkstore"
 	"github.com/timskillet/distributed-filestore/internal/dynamodb"
 )
 
@@ -47,60 +47,198 @@ func HandleStoreChunk() http.HandlerFunc {
 			replicaType = "primary" // Default to primary
 		}
 
-		dir := filepath.Join("./", nodeServer.nodeID, "chunks")
-		os.MkdirAll(dir, 0755)
-		chunkPath := filepath.Join(dir, fmt.Sprintf("%s_%d.bin", fileID, chunkIndex))
+		// Erasure-coded chunks are stored as one shard of the stripe per node
+		shardIndex := 0
+		if replicaType == "shard" {
+			shardIndex, err = strconv.Atoi(r.URL.Query().Get("shard_index"))
+			if err != nil || shardIndex < 0 {
+				http.Error(w, "invalid shard_index", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// A rebalance move hands the replica over from another node
+		moveFrom := r.URL.Query().Get("move_from")
+		if moveFrom == nodeServer.nodeID {
+			http.Error(w, "cannot move a chunk onto the node it is moving from", http.StatusBadRequest)
+			return
+		}
+
+		// Chunks may be no larger than the upload plan allows
+		ctx := context.Background()
+		file, err := nodeServer.store.GetFileMetadata(ctx, nodeServer.cfg.FileMetadataTable, fileID)
+		if errors.Is(err, dynamodb.ErrNotFound) {
+			file = nil // No manifest to size the chunk by, so MAX_CHUNK_SIZE applies
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get file: %v", err), http.StatusInternalServerError)
+			return
+		}
+		limit := file.ChunkSizeLimit(int64(nodeServer.cfg.MaxChunkSize))
+		if r.ContentLength > limit {
+			http.Error(w, fmt.Sprintf("chunk of %d bytes exceeds the limit of %d bytes", r.ContentLength, limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		body := http.MaxBytesReader(w, r.Body, limit)
+
+		// Bodies are stored under their checksum. Without a checksum header the chunk is
+		// buffered to compute it; it is bounded by the limit.
+		var key chunkstore.Key
+		var data []byte
+		if expected := r.Header.Get("X-Chunk-Checksum"); expected != "" {
+			key, err = chunkstore.ParseKey(expected)
+			if err != nil {
+				http.Error(w, "invalid X-Chunk-Checksum", http.StatusBadRequest)
+				return
+			}
+		} else {
+			data, err = io.ReadAll(body)
+			if err != nil {
+				writeStoreError(w, err, limit)
+				return
+			}
+			key = chunkstore.KeyOf(data)
+		}
 
-		// Read chunk data and calculate checksum
-		chunkData, err := io.ReadAll(r.Body)
+		info, stored, err := nodeServer.acquire(ctx, key)
 		if err != nil {
-			http.Error(w, "failed to read chunk data", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if !stored {
+			// Stream the chunk into the chunk store, hashing it on the way so a body that
+			// does not match its checksum is never committed
+			src := io.Reader(newChecksumReader(body, key.String()))
+			if data != nil {
+				src = bytes.NewReader(data)
+			}
+			info, err = nodeServer.chunks.Put(ctx, key, src)
+			if err != nil {
+				if releaseErr := nodeServer.release(ctx, key); releaseErr != nil {
+					fmt.Printf("Warning: Failed to release chunk %s: %v\n", key, releaseErr)
+				}
+				writeStoreError(w, err, limit)
+				return
+			}
+		}
+		checksum := key.String()
 
-		// Calculate SHA256 checksum
-		hash := sha256.Sum256(chunkData)
-		checksum := hex.EncodeToString(hash[:])
+		// Store metadata in DynamoDB
+		metadata := &dynamodb.ChunkMetadata{
+			FileID:      fileID,
+			ChunkIndex:  chunkIndex,
+			NodeID:      nodeServer.nodeID,
+			Path:        info.Location,
+			Checksum:    checksum,
+			ReplicaType: replicaType,
+			ShardIndex:  shardIndex,
+			Size:        info.Size,
+			CreatedAt:   time.Now().Unix(),
+		}
 
-		// Validate checksum if provided in header
-		expectedChecksum := r.Header.Get("X-Chunk-Checksum")
-		if expectedChecksum != "" && expectedChecksum != checksum {
-			http.Error(w, fmt.Sprintf("checksum mismatch: expected %s, got %s", expectedChecksum, checksum), http.StatusBadRequest)
+		if err := nodeServer.recordReplica(ctx, metadata, moveFrom); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, dynamodb.ErrConditionFailed) {
+				status = http.StatusConflict
+			}
+			http.Error(w, fmt.Sprintf("failed to store metadata: %v", err), status)
 			return
 		}
 
-		// Write chunk to file
-		outFile, err := os.Create(chunkPath)
+		// Primary replicas fan out to the secondaries chosen by the API server and acknowledge
+		// once the write quorum, this copy included, is stored. Async replication with a
+		// quorum of one acknowledges once the work is queued on disk.
+		if replicaType == "primary" {
+			if secondaries := parseReplicas(r.URL.Query().Get("replicas")); len(secondaries) > 0 {
+				needed := writeQuorum(r.URL.Query().Get("quorum"), len(secondaries)) - 1
+				if needed == 0 && nodeServer.cfg.ReplicationStrategy == "async" {
+					if err := nodeServer.replQueue.Enqueue(fileID, chunkIndex, checksum, secondaries); err != nil {
+						http.Error(w, fmt.Sprintf("failed to queue replication: %v", err), http.StatusInternalServerError)
+						return
+					}
+				} else if err := replicateChunk(ctx, fileID, chunkIndex, checksum, secondaries, needed); err != nil {
+					http.Error(w, err.Error(), http.StatusBadGateway)
+					return
+				}
+			}
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "Chunk %d stored on node %s", chunkIndex, nodeServer.nodeID)
+	}
+}
+
+// writeStoreError reports a chunk body that could not be stored
+func writeStoreError(w http.ResponseWriter, err error, limit int64) {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, fmt.Sprintf("chunk exceeds the limit of %d bytes", limit), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errChecksumMismatch):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, fmt.Sprintf("failed to store chunk: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// HandleLinkChunk records a replica of a chunk whose body this node already stores
+// for another chunk with the same checksum, so deduplicated uploads send no data.
+// It answers 404 if the body is not stored here.
+func HandleLinkChunk() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if nodeServer == nil {
+			http.Error(w, "Node server not initialized", http.StatusInternalServerError)
+			return
+		}
+
+		fileID := r.URL.Query().Get("file_id")
+		chunkIndex, err := strconv.Atoi(r.URL.Query().Get("chunk_index"))
+		if fileID == "" || err != nil {
+			http.Error(w, "missing file_id or invalid chunk_index", http.StatusBadRequest)
+			return
+		}
+		key, err := chunkstore.ParseKey(r.URL.Query().Get("checksum"))
 		if err != nil {
-			http.Error(w, "failed to create chunk file", http.StatusInternalServerError)
+			http.Error(w, "invalid checksum", http.StatusBadRequest)
+			return
+		}
+		replicaType := r.URL.Query().Get("replica_type")
+		if replicaType != "primary" && replicaType != "secondary" {
+			http.Error(w, "replica_type must be primary or secondary", http.StatusBadRequest)
+			return
+		}
+
+		ctx := r.Context()
+		info, err := nodeServer.acquireExisting(ctx, key)
+		if errors.Is(err, chunkstore.ErrNotFound) {
+			http.Error(w, "chunk not found", http.StatusNotFound)
 			return
 		}
-		defer outFile.Close()
-		_, err = outFile.Write(chunkData)
 		if err != nil {
-			http.Error(w, "failed to write chunk data", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// Store metadata in DynamoDB
-		ctx := context.Background()
 		metadata := &dynamodb.ChunkMetadata{
 			FileID:      fileID,
 			ChunkIndex:  chunkIndex,
 			NodeID:      nodeServer.nodeID,
-			Path:        chunkPath,
-			Checksum:    checksum,
+			Path:        info.Location,
+			Checksum:    key.String(),
 			ReplicaType: replicaType,
+			Size:        info.Size,
 			CreatedAt:   time.Now().Unix(),
 		}
-
-		if err := nodeServer.dbClient.PutChunkMetadata(ctx, nodeServer.cfg.ChunkMetadataTable, metadata); err != nil {
+		if err := nodeServer.recordReplica(ctx, metadata, ""); err != nil {
 			http.Error(w, fmt.Sprintf("failed to store metadata: %v", err), http.StatusInternalServerError)
 			return
 		}
 
 		w.WriteHeader(http.StatusCreated)
-		fmt.Fprintf(w, "Chunk %d stored on node %s", chunkIndex, nodeServer.nodeID)
+		fmt.Fprintf(w, "Chunk %d linked on node %s", chunkIndex, nodeServer.nodeID)
 	}
 }
 
@@ -124,10 +262,23 @@ func HandleGetChunk() http.HandlerFunc {
 			return
 		}
 
-		chunkPath := filepath.Join("./", nodeServer.nodeID, "chunks", fmt.Sprintf("%s_%d.bin", fileID, chunkIndex))
-		inFile, err := os.Open(chunkPath)
+		key, err := chunkKey(r, fileID, chunkIndex)
+		if errors.Is(err, chunkstore.ErrNotFound) {
+			http.Error(w, "chunk not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		inFile, err := nodeServer.chunks.Get(r.Context(), key)
+		if errors.Is(err, chunkstore.ErrNotFound) {
+			http.Error(w, "chunk not found", http.StatusNotFound)
+			return
+		}
 		if err != nil {
-			http.Error(w, "failed to open chunk file", http.StatusNotFound)
+			http.Error(w, fmt.Sprintf("failed to open chunk: %v", err), http.StatusInternalServerError)
 			return
 		}
 		defer inFile.Close()
@@ -138,3 +289,126 @@ func HandleGetChunk() http.HandlerFunc {
 		}
 	}
 }
+
+// chunkKey returns the body key of a chunk, from the checksum query parameter if the
+// caller knows it, or else from this node's replica record
+func chunkKey(r *http.Request, fileID string, chunkIndex int) (chunkstore.Key, error) {
+	if checksum := r.URL.Query().Get("checksum"); checksum != "" {
+		return chunkstore.ParseKey(checksum)
+	}
+	replica, err := nodeServer.localReplica(r.Context(), fileID, chunkIndex)
+	if err != nil {
+		return "", err
+	}
+	if replica == nil {
+		return "", chunkstore.ErrNotFound
+	}
+	return chunkstore.ParseKey(replica.Checksum)
+}
+
+// HandleDeleteChunk releases a chunk whose replica has moved to another node, given
+// the checksum it was stored under. The body is deleted once no other replica on this
+// node shares it. It refuses while the metadata still lists this node as a holder of
+// the chunk.
+func HandleDeleteChunk() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if nodeServer == nil {
+			http.Error(w, "Node server not initialized", http.StatusInternalServerError)
+			return
+		}
+
+		fileID := r.URL.Query().Get("file_id")
+		chunkIndexStr := r.URL.Query().Get("chunk_index")
+		if fileID == "" || chunkIndexStr == "" {
+			http.Error(w, "missing file_id or chunk_index", http.StatusBadRequest)
+			return
+		}
+
+		chunkIndex, err := strconv.Atoi(chunkIndexStr)
+		if err != nil {
+			http.Error(w, "invalid chunk_index", http.StatusBadRequest)
+			return
+		}
+
+		key, err := chunkstore.ParseKey(r.URL.Query().Get("checksum"))
+		if err != nil {
+			http.Error(w, "invalid checksum", http.StatusBadRequest)
+			return
+		}
+
+		replicas, err := nodeServer.store.GetChunkReplicas(r.Context(), nodeServer.cfg.ChunkMetadataTable, fileID, chunkIndex)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to load replicas: %v", err), http.StatusInternalServerError)
+			return
+		}
+		for _, replica := range replicas {
+			if replica.NodeID == nodeServer.nodeID {
+				http.Error(w, "chunk is still referenced by this node", http.StatusConflict)
+				return
+			}
+		}
+
+		if err := nodeServer.release(r.Context(), key); err != nil {
+			http.Error(w, fmt.Sprintf("failed to delete chunk: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleReplicationStatus reports the async replication queue depth
+func HandleReplicationStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if nodeServer == nil {
+			http.Error(w, "Node server not initialized", http.StatusInternalServerError)
+			return
+		}
+
+		status := map[string]interface{}{
+			"node_id":     nodeServer.nodeID,
+			"strategy":    nodeServer.cfg.ReplicationStrategy,
+			"queue_depth": nodeServer.replQueue.Depth(),
+			"failed":      len(nodeServer.replQueue.Failures()),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// HandleReplicationFailures lists the replication tasks this node gave up on (GET), or
+// removes one the API server's repair loop has restored (DELETE ?id=<task id>)
+func HandleReplicationFailures() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if nodeServer == nil {
+			http.Error(w, "Node server not initialized", http.StatusInternalServerError)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			failures := nodeServer.replQueue.Failures()
+			if failures == nil {
+				failures = []replicationTask{}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(failures)
+		case http.MethodDelete:
+			id := r.URL.Query().Get("id")
+			if id == "" {
+				http.Error(w, "missing id", http.StatusBadRequest)
+				return
+			}
+			if !nodeServer.replQueue.Resolve(id) {
+				http.Error(w, "replication task not found", http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package node
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// checksumReader hashes a chunk as it streams into the chunk store. If an expected
+// checksum is set, the final read fails on a mismatch instead of returning io.EOF, so
+// the store discards the chunk rather than committing it.
+type checksumReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	expected string
+	size     int64
+}
+
+func newChecksumReader(r io.Reader, expected string) *checksumReader {
+	return &checksumReader{r: r, hash: sha256.New(), expected: expected}
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.hash.Write(p[:n])
+	c.size += int64(n)
+	if err == io.EOF && c.expected != "" && c.Checksum() != c.expected {
+		return n, fmt.Errorf("%w: expected %s, got %s", errChecksumMismatch, c.expected, c.Checksum())
+	}
+	return n, err
+}
+
+// Checksum returns the hex SHA-256 of the bytes read so far
+func (c *checksumReader) Checksum() string {
+	return hex.EncodeToString(c.hash.Sum(nil))
+}
@@ -0,0 +1,175 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/timskillet/distributed-filestore/internal/chunkstore"
+	"github.com/timskillet/distributed-filestore/internal/dynamodb"
+)
+
+// Chunk bodies are stored once per node under their checksum and shared by every
+// replica with the same content. The chunk refs table counts the replicas using each
+// body; the body is deleted when the count drops to zero.
+
+// refLocks serializes reference changes per body, so a body is never deleted between
+// another replica taking a reference and finding it already stored
+type refLocks [64]sync.Mutex
+
+func (l *refLocks) lock(key chunkstore.Key) func() {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	mu := &l[h.Sum32()%uint32(len(l))]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// acquire takes a reference to a body for a new replica and reports whether the body
+// is already stored. The reference keeps the body from being deleted while it is
+// written, so the caller must release it if the replica is not recorded.
+func (s *Server) acquire(ctx context.Context, key chunkstore.Key) (chunkstore.Info, bool, error) {
+	unlock := s.refLocks.lock(key)
+	defer unlock()
+
+	if _, err := s.store.AdjustChunkRef(ctx, s.cfg.ChunkRefsTable, key.String(), s.nodeID, 1); err != nil {
+		return chunkstore.Info{}, false, fmt.Errorf("failed to reference chunk: %w", err)
+	}
+	info, err := s.chunks.Stat(ctx, key)
+	if errors.Is(err, chunkstore.ErrNotFound) {
+		return chunkstore.Info{}, false, nil
+	}
+	if err != nil {
+		s.store.AdjustChunkRef(ctx, s.cfg.ChunkRefsTable, key.String(), s.nodeID, -1)
+		return chunkstore.Info{}, false, fmt.Errorf("failed to stat chunk: %w", err)
+	}
+	return info, true, nil
+}
+
+// acquireExisting takes a reference to a body only if it is already stored, returning
+// chunkstore.ErrNotFound otherwise
+func (s *Server) acquireExisting(ctx context.Context, key chunkstore.Key) (chunkstore.Info, error) {
+	unlock := s.refLocks.lock(key)
+	defer unlock()
+
+	info, err := s.chunks.Stat(ctx, key)
+	if err != nil {
+		return chunkstore.Info{}, err
+	}
+	if _, err := s.store.AdjustChunkRef(ctx, s.cfg.ChunkRefsTable, key.String(), s.nodeID, 1); err != nil {
+		return chunkstore.Info{}, fmt.Errorf("failed to reference chunk: %w", err)
+	}
+	return info, nil
+}
+
+// release drops a reference to a body and deletes the body once no replica uses it
+func (s *Server) release(ctx context.Context, key chunkstore.Key) error {
+	unlock := s.refLocks.lock(key)
+	defer unlock()
+
+	refs, err := s.store.AdjustChunkRef(ctx, s.cfg.ChunkRefsTable, key.String(), s.nodeID, -1)
+	if err != nil {
+		return fmt.Errorf("failed to release chunk: %w", err)
+	}
+	if refs > 0 {
+		return nil
+	}
+	return s.chunks.Delete(ctx, key)
+}
+
+// localReplica returns this node's metadata record for a chunk, or nil if it has none
+func (s *Server) localReplica(ctx context.Context, fileID string, chunkIndex int) (*dynamodb.ChunkMetadata, error) {
+	replicas, err := s.store.GetChunkReplicas(ctx, s.cfg.ChunkMetadataTable, fileID, chunkIndex)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load replicas: %w", err)
+	}
+	for _, replica := range replicas {
+		if replica.NodeID == s.nodeID {
+			return replica, nil
+		}
+	}
+	return nil, nil
+}
+
+// recordReplica writes the metadata of a replica whose body reference is held. If
+// this node already had a replica of the chunk, the reference of the body it
+// replaces is released. On failure the new reference is released instead.
+// A non-empty moveFrom records the replica as moved from that node.
+func (s *Server) recordReplica(ctx context.Context, metadata *dynamodb.ChunkMetadata, moveFrom string) error {
+	key := chunkstore.Key(metadata.Checksum)
+	previous, err := s.localReplica(ctx, metadata.FileID, metadata.ChunkIndex)
+	if err == nil {
+		if moveFrom != "" {
+			// Swap the source replica's record for ours in one step
+			err = s.store.MoveChunkReplica(ctx, s.cfg.ChunkMetadataTable, metadata, moveFrom)
+		} else {
+			err = s.store.PutChunkMetadata(ctx, s.cfg.ChunkMetadataTable, metadata)
+		}
+	}
+	if err != nil {
+		if releaseErr := s.release(ctx, key); releaseErr != nil {
+			fmt.Printf("Warning: Failed to release chunk %s: %v\n", key, releaseErr)
+		}
+		return err
+	}
+
+	if previous != nil && previous.Checksum != "" {
+		if err := s.release(ctx, chunkstore.Key(previous.Checksum)); err != nil {
+			fmt.Printf("Warning: Failed to release chunk %s: %v\n", previous.Checksum, err)
+		}
+	}
+	return nil
+}
+
+// ReconcileRefs rebuilds this node's reference counts from its chunk metadata and
+// the bodies actually stored, correcting counts left behind by a crash between a
+// body and its metadata being written. It must run before the node serves requests.
+func (s *Server) ReconcileRefs(ctx context.Context) error {
+	counts := make(map[chunkstore.Key]int64)
+	for chunk, err := range s.store.IterChunksByNodeID(ctx, s.cfg.ChunkMetadataTable, s.nodeID) {
+		if err != nil {
+			return fmt.Errorf("failed to list chunks: %w", err)
+		}
+		if key, err := chunkstore.ParseKey(chunk.Checksum); err == nil {
+			counts[key]++
+		}
+	}
+
+	stored, err := s.chunks.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list stored chunks: %w", err)
+	}
+	present := make(map[chunkstore.Key]bool, len(stored))
+	unreferenced := 0
+	for _, info := range stored {
+		present[info.Key] = true
+		if counts[info.Key] == 0 {
+			unreferenced++
+		}
+		if err := s.store.SetChunkRef(ctx, s.cfg.ChunkRefsTable, info.Key.String(), s.nodeID, counts[info.Key]); err != nil {
+			return err
+		}
+	}
+
+	// Replicas whose body is gone must not be offered for deduplication
+	missing := 0
+	for key := range counts {
+		if present[key] {
+			continue
+		}
+		missing++
+		if err := s.store.SetChunkRef(ctx, s.cfg.ChunkRefsTable, key.String(), s.nodeID, 0); err != nil {
+			return err
+		}
+	}
+
+	if unreferenced > 0 {
+		fmt.Printf("Warning: %d stored chunks are not used by any replica\n", unreferenced)
+	}
+	if missing > 0 {
+		fmt.Printf("Warning: %d chunks in metadata are missing from this node\n", missing)
+	}
+	return nil
+}
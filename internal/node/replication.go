@@ -0,0 +1,140 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/timskillet/distributed-filestore/internal/chunkstore"
+)
+
+// parseReplicas splits the comma-separated replicas query parameter into node IDs
+func parseReplicas(value string) []string {
+	var replicas []string
+	for _, nodeID := range strings.Split(value, ",") {
+		nodeID = strings.TrimSpace(nodeID)
+		if nodeID != "" && nodeID != nodeServer.nodeID {
+			replicas = append(replicas, nodeID)
+		}
+	}
+	return replicas
+}
+
+// writeQuorum parses the quorum query parameter: the replicas, counting this node's own
+// copy, that must be stored before the upload is acknowledged. It defaults to the
+// node's WRITE_QUORUM and is clamped to the replicas available.
+func writeQuorum(value string, secondaries int) int {
+	quorum, err := strconv.Atoi(value)
+	if err != nil || quorum < 1 {
+		quorum = nodeServer.cfg.WriteQuorum
+	}
+	return max(1, min(quorum, secondaries+1))
+}
+
+type replicaResult struct {
+	nodeID string
+	err    error
+}
+
+// replicateChunk copies a chunk to every secondary node in parallel and returns once
+// needed of them have acknowledged. Copies still in flight finish in the background;
+// any secondary that fails after the quorum is met is handed to the replication queue.
+func replicateChunk(ctx context.Context, fileID string, chunkIndex int, checksum string, secondaries []string, needed int) error {
+	results := make(chan replicaResult, len(secondaries))
+	for _, nodeID := range secondaries {
+		go func(nodeID string) {
+			results <- replicaResult{nodeID, sendReplica(ctx, nodeID, fileID, chunkIndex, checksum)}
+		}(nodeID)
+	}
+
+	acked := 0
+	var failed []string
+	var errs []string
+	for received := 0; received < len(secondaries); received++ {
+		if acked >= needed {
+			// Quorum met: let the rest finish without holding up the upload
+			go queueFailedReplicas(fileID, chunkIndex, checksum, failed, results, len(secondaries)-received)
+			return nil
+		}
+
+		result := <-results
+		if result.err != nil {
+			failed = append(failed, result.nodeID)
+			errs = append(errs, fmt.Sprintf("%s: %v", result.nodeID, result.err))
+			if len(secondaries)-len(failed) < needed {
+				return fmt.Errorf("write quorum not met, replication failed on %d of %d secondaries: %s", len(failed), len(secondaries), strings.Join(errs, "; "))
+			}
+			continue
+		}
+		acked++
+	}
+
+	queueFailedReplicas(fileID, chunkIndex, checksum, failed, results, 0)
+	return nil
+}
+
+// queueFailedReplicas waits for pending replica results and queues every secondary
+// that did not store the chunk, so it is retried until REPLICATION_TIMEOUT
+func queueFailedReplicas(fileID string, chunkIndex int, checksum string, failed []string, results <-chan replicaResult, pending int) {
+	for ; pending > 0; pending-- {
+		if result := <-results; result.err != nil {
+			fmt.Printf("Warning: Replica of chunk %d of %s on %s failed after the write quorum was met: %v\n", chunkIndex, fileID, result.nodeID, result.err)
+			failed = append(failed, result.nodeID)
+		}
+	}
+	if len(failed) == 0 {
+		return
+	}
+	if err := nodeServer.replQueue.Enqueue(fileID, chunkIndex, checksum, failed); err != nil {
+		fmt.Printf("Warning: Failed to queue replication of chunk %d of %s: %v\n", chunkIndex, fileID, err)
+	}
+}
+
+// sendReplica streams a secondary copy of a locally stored chunk to another storage node
+func sendReplica(ctx context.Context, nodeID string, fileID string, chunkIndex int, checksum string) error {
+	node, err := nodeServer.store.GetNode(ctx, nodeServer.cfg.NodeRegistryTable, nodeID)
+	if err != nil {
+		return err
+	}
+
+	key, err := chunkstore.ParseKey(checksum)
+	if err != nil {
+		return err
+	}
+	info, err := nodeServer.chunks.Stat(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to stat chunk: %w", err)
+	}
+	chunk, err := nodeServer.chunks.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to open chunk: %w", err)
+	}
+	defer chunk.Close()
+
+	nodeURL := fmt.Sprintf("http://%s:%d/store-chunk?file_id=%s&chunk_index=%d&replica_type=secondary", node.PrivateIP, node.Port, fileID, chunkIndex)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, nodeURL, chunk)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.ContentLength = info.Size
+	req.Header.Set("X-Chunk-Checksum", checksum)
+
+	client := &http.Client{
+		Timeout: time.Duration(nodeServer.cfg.ReplicationTimeout) * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send replica: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("replica rejected with status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
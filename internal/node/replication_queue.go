@@ -0,0 +1,276 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	queuePollInterval  = 1 * time.Second
+	queueInitialDelay  = 1 * time.Second
+	queueMaxRetryDelay = 30 * time.Second
+)
+
+// replicationTask is a pending copy of a locally stored chunk to one secondary node.
+// A task that is still failing after the replication timeout is kept as failed, so
+// the API server's repair loop can restore the replica elsewhere.
+type replicationTask struct {
+	ID          string `json:"id"`
+	FileID      string `json:"file_id"`
+	ChunkIndex  int    `json:"chunk_index"`
+	Checksum    string `json:"checksum"`
+	TargetNode  string `json:"target_node"`
+	EnqueuedAt  int64  `json:"enqueued_at"`
+	Attempts    int    `json:"attempts"`
+	NextAttempt int64  `json:"next_attempt"`
+	Failed      bool   `json:"failed,omitempty"`
+}
+
+// ReplicationQueue is a durable, directory-backed queue of async replication tasks.
+// Each task is persisted as its own JSON file so pending work survives a node restart.
+type ReplicationQueue struct {
+	dir     string
+	timeout time.Duration
+	mu      sync.Mutex
+	tasks   map[string]*replicationTask
+	notify  chan struct{}
+}
+
+// NewReplicationQueue opens the queue in dir, reloading any tasks left from a previous run
+func NewReplicationQueue(dir string, timeout time.Duration) (*ReplicationQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create replication queue directory: %w", err)
+	}
+
+	q := &ReplicationQueue{
+		dir:     dir,
+		timeout: timeout,
+		tasks:   make(map[string]*replicationTask),
+		notify:  make(chan struct{}, 1),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read replication queue directory: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// Partially written task from a crash, the enqueue was never acknowledged
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			fmt.Printf("Warning: Failed to read replication task %s: %v\n", name, err)
+			continue
+		}
+		var task replicationTask
+		if err := json.Unmarshal(data, &task); err != nil {
+			fmt.Printf("Warning: Dropping corrupt replication task %s: %v\n", name, err)
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		q.tasks[task.ID] = &task
+	}
+
+	return q, nil
+}
+
+// Enqueue durably records replication of a chunk to each target node
+func (q *ReplicationQueue) Enqueue(fileID string, chunkIndex int, checksum string, targets []string) error {
+	now := time.Now()
+	for _, target := range targets {
+		task := &replicationTask{
+			ID:          uuid.New().String(),
+			FileID:      fileID,
+			ChunkIndex:  chunkIndex,
+			Checksum:    checksum,
+			TargetNode:  target,
+			EnqueuedAt:  now.Unix(),
+			NextAttempt: now.Unix(),
+		}
+		if err := q.persist(task); err != nil {
+			return err
+		}
+
+		q.mu.Lock()
+		q.tasks[task.ID] = task
+		q.mu.Unlock()
+	}
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Depth returns the number of replication tasks that are still being retried
+func (q *ReplicationQueue) Depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	depth := 0
+	for _, task := range q.tasks {
+		if !task.Failed {
+			depth++
+		}
+	}
+	return depth
+}
+
+// Failures returns the tasks that were given up on and wait for the repair loop
+func (q *ReplicationQueue) Failures() []replicationTask {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var failed []replicationTask
+	for _, task := range q.tasks {
+		if task.Failed {
+			failed = append(failed, *task)
+		}
+	}
+	sort.Slice(failed, func(i, j int) bool { return failed[i].EnqueuedAt < failed[j].EnqueuedAt })
+	return failed
+}
+
+// Resolve removes a failed task once the repair loop has restored its replica. It
+// reports whether the task was found.
+func (q *ReplicationQueue) Resolve(id string) bool {
+	q.mu.Lock()
+	task, ok := q.tasks[id]
+	failed := ok && task.Failed
+	q.mu.Unlock()
+	if !failed {
+		return false
+	}
+	q.remove(task)
+	return true
+}
+
+// Run processes queued tasks until stop is closed, retrying failures with backoff
+// until the task is older than the replication timeout
+func (q *ReplicationQueue) Run(ctx context.Context, stop <-chan struct{}) {
+	ticker := time.NewTicker(queuePollInterval)
+	defer ticker.Stop()
+
+	for {
+		q.processDue(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-q.notify:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (q *ReplicationQueue) processDue(ctx context.Context) {
+	now := time.Now().Unix()
+
+	q.mu.Lock()
+	var due []*replicationTask
+	for _, task := range q.tasks {
+		if !task.Failed && task.NextAttempt <= now {
+			due = append(due, task)
+		}
+	}
+	q.mu.Unlock()
+
+	for _, task := range due {
+		err := q.send(ctx, task)
+		if err == nil {
+			q.remove(task)
+			continue
+		}
+
+		if time.Since(time.Unix(task.EnqueuedAt, 0)) >= q.timeout {
+			fmt.Printf("Warning: Giving up replicating chunk %d of %s to %s after %d attempts, leaving it to repair: %v\n", task.ChunkIndex, task.FileID, task.TargetNode, task.Attempts+1, err)
+			q.mu.Lock()
+			task.Attempts++
+			task.Failed = true
+			q.mu.Unlock()
+			if err := q.persist(task); err != nil {
+				fmt.Printf("Warning: Failed to persist replication task %s: %v\n", task.ID, err)
+			}
+			continue
+		}
+
+		q.mu.Lock()
+		task.Attempts++
+		delay := queueInitialDelay << min(task.Attempts-1, 5)
+		if delay > queueMaxRetryDelay {
+			delay = queueMaxRetryDelay
+		}
+		task.NextAttempt = time.Now().Add(delay).Unix()
+		q.mu.Unlock()
+		if err := q.persist(task); err != nil {
+			fmt.Printf("Warning: Failed to persist replication task %s: %v\n", task.ID, err)
+		}
+	}
+}
+
+func (q *ReplicationQueue) send(ctx context.Context, task *replicationTask) error {
+	return sendReplica(ctx, task.TargetNode, task.FileID, task.ChunkIndex, task.Checksum)
+}
+
+// persist writes a task through a temporary file so a crash never leaves a half-written task
+func (q *ReplicationQueue) persist(task *replicationTask) error {
+	q.mu.Lock()
+	data, err := json.Marshal(task)
+	q.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to marshal replication task: %w", err)
+	}
+
+	path := filepath.Join(q.dir, task.ID+".json")
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create replication task: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write replication task: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to sync replication task: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to close replication task: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to commit replication task: %w", err)
+	}
+	if err := syncDir(q.dir); err != nil {
+		return fmt.Errorf("failed to sync replication queue directory: %w", err)
+	}
+	return nil
+}
+
+func (q *ReplicationQueue) remove(task *replicationTask) {
+	q.mu.Lock()
+	delete(q.tasks, task.ID)
+	q.mu.Unlock()
+
+	if err := os.Remove(filepath.Join(q.dir, task.ID+".json")); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Warning: Failed to remove replication task %s: %v\n", task.ID, err)
+	}
+}
@@ -0,0 +1,474 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/timskillet/distributed-filestore/internal/chunkstore"
+	"github.com/timskillet/distributed-filestore/internal/dynamodb"
+)
+
+// ScrubStatus reports the progress of the checksum scrubber
+type ScrubStatus struct {
+	Running       bool     `json:"running"`
+	LastStarted   int64    `json:"last_started,omitempty"`
+	LastFinished  int64    `json:"last_finished,omitempty"`
+	ChunksScanned int      `json:"chunks_scanned"`
+	BytesScanned  int64    `json:"bytes_scanned"`
+	ChunksCorrupt int      `json:"chunks_corrupt"` // Quarantined because they no longer match their checksum
+	ChunksMissing int      `json:"chunks_missing"` // Recorded in metadata but not stored
+	ChunksHealed  int      `json:"chunks_healed"`  // Replaced with a healthy copy from another node
+	Unrecoverable []string `json:"unrecoverable"`  // Checksums no other node had a healthy copy of
+	LastError     string   `json:"last_error,omitempty"`
+}
+
+// Scrubber re-reads every chunk body this node's metadata says it stores and compares
+// it with the recorded checksum, so silent disk corruption is found before a client
+// downloads the chunk. Corrupt bodies are moved to a quarantine directory and
+// replaced with a copy from another node holding the same checksum. Replicas that
+// cannot be healed that way, such as erasure-coded shards, are listed as lost for the
+// API server's repair loop to rebuild elsewhere.
+type Scrubber struct {
+	server        *Server
+	quarantineDir string
+	rate          float64 // Bytes per second; 0 is unlimited
+	next          time.Time
+
+	mu     sync.Mutex
+	status ScrubStatus
+	lost   map[string]*dynamodb.ChunkMetadata // By lostKey
+}
+
+// scrubStartDelay bounds the random delay before the first scrub pass, which spreads
+// nodes started together
+const scrubStartDelay = time.Minute
+
+func NewScrubber(s *Server, quarantineDir string) *Scrubber {
+	return &Scrubber{
+		server:        s,
+		quarantineDir: quarantineDir,
+		rate:          float64(s.cfg.ScrubRateKB) * 1024,
+		lost:          make(map[string]*dynamodb.ChunkMetadata),
+	}
+}
+
+// Run performs a scrub pass shortly after startup, then every ScrubInterval seconds
+// until the server is stopped
+func (sc *Scrubber) Run(ctx context.Context, stop <-chan struct{}) {
+	interval := time.Duration(sc.server.cfg.ScrubInterval) * time.Second
+	start := time.NewTimer(rand.N(min(interval, scrubStartDelay)))
+	defer start.Stop()
+	select {
+	case <-start.C:
+	case <-stop:
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := sc.RunOnce(ctx); err != nil {
+			fmt.Printf("Warning: Scrub pass failed: %v\n", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Status returns a snapshot of the current or most recent scrub pass
+func (sc *Scrubber) Status() ScrubStatus {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	status := sc.status
+	status.Unrecoverable = append([]string(nil), sc.status.Unrecoverable...)
+	return status
+}
+
+func lostKey(fileID string, chunkIndex int) string {
+	return fmt.Sprintf("%s/%d", fileID, chunkIndex)
+}
+
+// Lost returns the replicas whose bodies could not be healed, sorted by file and chunk
+func (sc *Scrubber) Lost() []*dynamodb.ChunkMetadata {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	lost := make([]*dynamodb.ChunkMetadata, 0, len(sc.lost))
+	for _, replica := range sc.lost {
+		lost = append(lost, replica)
+	}
+	sort.Slice(lost, func(i, j int) bool {
+		if lost[i].FileID != lost[j].FileID {
+			return lost[i].FileID < lost[j].FileID
+		}
+		return lost[i].ChunkIndex < lost[j].ChunkIndex
+	})
+	return lost
+}
+
+// Resolve forgets a lost replica once the repair loop has replaced it, reporting
+// whether it was listed
+func (sc *Scrubber) Resolve(fileID string, chunkIndex int) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	key := lostKey(fileID, chunkIndex)
+	_, ok := sc.lost[key]
+	delete(sc.lost, key)
+	return ok
+}
+
+// setLost lists or unlists this node's replicas of one body as lost
+func (sc *Scrubber) setLost(replicas []*dynamodb.ChunkMetadata, lost bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, replica := range replicas {
+		if lost {
+			sc.lost[lostKey(replica.FileID, replica.ChunkIndex)] = replica
+		} else {
+			delete(sc.lost, lostKey(replica.FileID, replica.ChunkIndex))
+		}
+	}
+}
+
+// RunOnce scrubs every chunk body referenced by this node's replicas once
+func (sc *Scrubber) RunOnce(ctx context.Context) error {
+	sc.mu.Lock()
+	sc.status = ScrubStatus{Running: true, LastStarted: time.Now().Unix()}
+	sc.mu.Unlock()
+
+	err := sc.scrub(ctx)
+
+	sc.mu.Lock()
+	sc.status.Running = false
+	sc.status.LastFinished = time.Now().Unix()
+	if err != nil {
+		sc.status.LastError = err.Error()
+	}
+	status := sc.status
+	sc.mu.Unlock()
+
+	if status.ChunksCorrupt > 0 || status.ChunksMissing > 0 {
+		fmt.Printf("Scrub found %d corrupt and %d missing chunks, %d healed, %d unrecoverable\n",
+			status.ChunksCorrupt, status.ChunksMissing, status.ChunksHealed, len(status.Unrecoverable))
+	}
+	return err
+}
+
+func (sc *Scrubber) scrub(ctx context.Context) error {
+	s := sc.server
+
+	// Replicas sharing a body are checked once, against the checksum they all record
+	replicas := make(map[chunkstore.Key][]*dynamodb.ChunkMetadata)
+	for chunk, err := range s.store.IterChunksByNodeID(ctx, s.cfg.ChunkMetadataTable, s.nodeID) {
+		if err != nil {
+			return fmt.Errorf("failed to list chunks: %w", err)
+		}
+		if key, err := chunkstore.ParseKey(chunk.Checksum); err == nil {
+			replicas[key] = append(replicas[key], chunk)
+		}
+	}
+	keys := make([]chunkstore.Key, 0, len(replicas))
+	for key := range replicas {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		healthy, size, err := sc.check(ctx, key)
+		if err != nil {
+			return err
+		}
+		sc.mu.Lock()
+		sc.status.ChunksScanned++
+		sc.status.BytesScanned += size
+		sc.mu.Unlock()
+		if healthy {
+			continue
+		}
+
+		if err := sc.heal(ctx, key, replicas[key][0]); err != nil {
+			fmt.Printf("Warning: No healthy copy of chunk %s, listing its replicas for repair: %v\n", key, err)
+			sc.setLost(replicas[key], true)
+			sc.mu.Lock()
+			sc.status.Unrecoverable = append(sc.status.Unrecoverable, key.String())
+			sc.mu.Unlock()
+			continue
+		}
+		sc.setLost(replicas[key], false)
+		sc.mu.Lock()
+		sc.status.ChunksHealed++
+		sc.mu.Unlock()
+	}
+	return nil
+}
+
+// check reads a body and compares it with its checksum, quarantining it if it does
+// not match. It reports whether the body is stored and intact, and how many bytes
+// were read. A body that cannot be read is left to the disk health check.
+func (sc *Scrubber) check(ctx context.Context, key chunkstore.Key) (bool, int64, error) {
+	s := sc.server
+	info, err := s.chunks.Stat(ctx, key)
+	if errors.Is(err, chunkstore.ErrNotFound) {
+		sc.mu.Lock()
+		sc.status.ChunksMissing++
+		sc.mu.Unlock()
+		return false, 0, nil
+	}
+	if err != nil {
+		fmt.Printf("Warning: Failed to stat chunk %s: %v\n", key, err)
+		return true, 0, nil // The disk health check deals with failing disks
+	}
+	if err := sc.throttle(ctx, info.Size); err != nil {
+		return false, 0, err
+	}
+
+	data, readErr := sc.read(ctx, key)
+	if intact, done := sc.verify(key, data, readErr); done {
+		return intact, int64(len(data)), nil
+	}
+
+	// Read again under the body's lock, so a body rewritten in the meantime is not
+	// mistaken for a corrupt one
+	unlock := s.refLocks.lock(key)
+	defer unlock()
+	data, readErr = sc.read(ctx, key)
+	if intact, done := sc.verify(key, data, readErr); done {
+		return intact, int64(len(data)), nil
+	}
+
+	reason := "checksum mismatch"
+	if readErr != nil {
+		reason = readErr.Error()
+	}
+	fmt.Printf("Warning: Chunk %s at %s is corrupt (%s), quarantining it\n", key, info.Location, reason)
+	if err := sc.quarantine(ctx, key, data); err != nil {
+		fmt.Printf("Warning: Failed to quarantine chunk %s: %v\n", key, err)
+		return true, int64(len(data)), nil
+	}
+	sc.mu.Lock()
+	sc.status.ChunksCorrupt++
+	sc.mu.Unlock()
+	return false, int64(len(data)), nil
+}
+
+// verify judges a read of a body. It reports done unless the body is corrupt: it
+// failed the store's integrity check or does not match its checksum. A body deleted
+// since it was listed, or one that could not be read, counts as intact.
+func (sc *Scrubber) verify(key chunkstore.Key, data []byte, readErr error) (intact, done bool) {
+	switch {
+	case readErr == nil:
+		matches := chunkstore.KeyOf(data) == key
+		return matches, matches
+	case errors.Is(readErr, chunkstore.ErrCorrupt):
+		return false, false
+	case errors.Is(readErr, chunkstore.ErrNotFound):
+		return true, true
+	default:
+		fmt.Printf("Warning: Failed to read chunk %s: %v\n", key, readErr)
+		return true, true
+	}
+}
+
+func (sc *Scrubber) read(ctx context.Context, key chunkstore.Key) ([]byte, error) {
+	rc, err := sc.server.chunks.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// quarantine keeps what could be read of a corrupt body for inspection and removes it
+// from the store, so it is never served again. Its replicas stay recorded until a
+// healthy copy is stored or the repair loop replaces them. Callers hold the body's lock.
+func (sc *Scrubber) quarantine(ctx context.Context, key chunkstore.Key, data []byte) error {
+	if err := os.MkdirAll(sc.quarantineDir, 0755); err != nil {
+		return fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+	name := fmt.Sprintf("%s.%d.bin", key, time.Now().Unix())
+	if err := os.WriteFile(filepath.Join(sc.quarantineDir, name), data, 0644); err != nil {
+		return fmt.Errorf("failed to write quarantined chunk: %w", err)
+	}
+	return sc.server.chunks.Delete(ctx, key)
+}
+
+// heal fetches a body from another node that stores the same checksum, either for any
+// file through the chunk refs table or as a replica of the same chunk, and stores it
+func (sc *Scrubber) heal(ctx context.Context, key chunkstore.Key, replica *dynamodb.ChunkMetadata) error {
+	s := sc.server
+	var sources []string
+	seen := map[string]bool{s.nodeID: true}
+	refs, err := s.store.GetChunkRefs(ctx, s.cfg.ChunkRefsTable, key.String())
+	if err != nil {
+		return fmt.Errorf("failed to look up chunk refs: %w", err)
+	}
+	for _, ref := range refs {
+		if ref.Refs > 0 && !seen[ref.NodeID] {
+			seen[ref.NodeID] = true
+			sources = append(sources, ref.NodeID)
+		}
+	}
+	others, err := s.store.GetChunkReplicas(ctx, s.cfg.ChunkMetadataTable, replica.FileID, replica.ChunkIndex)
+	if err != nil {
+		return fmt.Errorf("failed to load replicas: %w", err)
+	}
+	for _, other := range others {
+		if other.Checksum == replica.Checksum && !seen[other.NodeID] {
+			seen[other.NodeID] = true
+			sources = append(sources, other.NodeID)
+		}
+	}
+	if len(sources) == 0 {
+		return errors.New("no other node stores it")
+	}
+
+	var errs []error
+	for _, nodeID := range sources {
+		data, err := sc.fetch(ctx, nodeID, key, replica)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", nodeID, err))
+			continue
+		}
+
+		unlock := s.refLocks.lock(key)
+		_, err = s.chunks.Put(ctx, key, bytes.NewReader(data))
+		unlock()
+		if err != nil {
+			return fmt.Errorf("failed to store healthy copy: %w", err)
+		}
+		fmt.Printf("Replaced chunk %s with a healthy copy from %s\n", key, nodeID)
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// fetch downloads a body from another node and verifies it
+func (sc *Scrubber) fetch(ctx context.Context, nodeID string, key chunkstore.Key, replica *dynamodb.ChunkMetadata) ([]byte, error) {
+	s := sc.server
+	node, err := s.store.GetNode(ctx, s.cfg.NodeRegistryTable, nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("http://%s:%d/get-chunk?file_id=%s&chunk_index=%d&checksum=%s", node.PrivateIP, node.Port, replica.FileID, replica.ChunkIndex, key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	client := &http.Client{
+		Timeout: time.Duration(s.cfg.ReplicationTimeout) * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(s.cfg.MaxChunkSize)+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk: %w", err)
+	}
+	hash := sha256.Sum256(data)
+	if checksum := hex.EncodeToString(hash[:]); checksum != key.String() {
+		return nil, fmt.Errorf("checksum mismatch: expected %s, got %s", key, checksum)
+	}
+	return data, nil
+}
+
+// throttle paces reads to ScrubRateKB, so scrubbing does not starve client traffic
+func (sc *Scrubber) throttle(ctx context.Context, n int64) error {
+	if sc.rate <= 0 {
+		return nil
+	}
+	now := time.Now()
+	if sc.next.Before(now) {
+		sc.next = now
+	}
+	wait := sc.next.Sub(now)
+	sc.next = sc.next.Add(time.Duration(float64(n) / sc.rate * float64(time.Second)))
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// HandleScrubStatus reports progress of the checksum scrubber
+func HandleScrubStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if nodeServer == nil {
+			http.Error(w, "Node server not initialized", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(nodeServer.scrubber.Status())
+	}
+}
+
+// HandleScrubLosses lists the replicas whose bodies the scrubber could not heal (GET),
+// or forgets one the API server's repair loop has replaced (DELETE
+// ?file_id=<id>&chunk_index=<n>)
+func HandleScrubLosses() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if nodeServer == nil {
+			http.Error(w, "Node server not initialized", http.StatusInternalServerError)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(nodeServer.scrubber.Lost())
+		case http.MethodDelete:
+			fileID := r.URL.Query().Get("file_id")
+			chunkIndex, err := strconv.Atoi(r.URL.Query().Get("chunk_index"))
+			if fileID == "" || err != nil {
+				http.Error(w, "file_id and chunk_index are required", http.StatusBadRequest)
+				return
+			}
+			if !nodeServer.scrubber.Resolve(fileID, chunkIndex) {
+				http.Error(w, "lost replica not found", http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
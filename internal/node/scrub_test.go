@@ -0,0 +1,212 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/timskillet/distributed-filestore/internal/chunkstore"
+	"github.com/timskillet/distributed-filestore/internal/config"
+	"github.com/timskillet/distributed-filestore/internal/dynamodb"
+	"github.com/timskillet/distributed-filestore/internal/metadata"
+)
+
+// faultyStore fails reads of chosen chunks with a given error
+type faultyStore struct {
+	*chunkstore.MemoryStore
+	errs map[chunkstore.Key]error
+}
+
+func (s *faultyStore) Get(ctx context.Context, key chunkstore.Key) (io.ReadCloser, error) {
+	if err := s.errs[key]; err != nil {
+		return nil, err
+	}
+	return s.MemoryStore.Get(ctx, key)
+}
+
+func newScrubTest(t *testing.T) (*Scrubber, *faultyStore) {
+	t.Helper()
+	chunks := &faultyStore{MemoryStore: chunkstore.NewMemoryStore(), errs: make(map[chunkstore.Key]error)}
+	s := &Server{
+		store: metadata.NewMemoryStore(),
+		cfg: &config.Config{
+			ChunkMetadataTable: "chunks",
+			ChunkRefsTable:     "refs",
+			NodeRegistryTable:  "nodes",
+			ReplicationTimeout: 5,
+			MaxChunkSize:       1 << 20,
+		},
+		nodeID:   "node-a",
+		chunks:   chunks,
+		stopChan: make(chan struct{}),
+	}
+	return NewScrubber(s, t.TempDir()), chunks
+}
+
+// addReplica records a replica of data and stores body as its content on this node
+func addReplica(t *testing.T, sc *Scrubber, fileID string, data, body []byte) chunkstore.Key {
+	t.Helper()
+	s := sc.server
+	key := chunkstore.KeyOf(data)
+	err := s.store.PutChunkMetadata(context.Background(), s.cfg.ChunkMetadataTable, &dynamodb.ChunkMetadata{
+		FileID:      fileID,
+		NodeID:      s.nodeID,
+		Checksum:    key.String(),
+		ReplicaType: "shard",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != nil {
+		if _, err := s.chunks.Put(context.Background(), key, bytes.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return key
+}
+
+func runScrub(t *testing.T, sc *Scrubber) ScrubStatus {
+	t.Helper()
+	if err := sc.RunOnce(context.Background()); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	return sc.Status()
+}
+
+func stored(t *testing.T, chunks chunkstore.ChunkStore, key chunkstore.Key) []byte {
+	t.Helper()
+	rc, err := chunks.Get(context.Background(), key)
+	if errors.Is(err, chunkstore.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestScrubLeavesHealthyChunks(t *testing.T) {
+	sc, chunks := newScrubTest(t)
+	data := []byte("healthy chunk")
+	key := addReplica(t, sc, "file-1", data, data)
+
+	status := runScrub(t, sc)
+	if status.ChunksScanned != 1 || status.BytesScanned != int64(len(data)) || status.ChunksCorrupt != 0 || status.ChunksMissing != 0 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if !bytes.Equal(stored(t, chunks, key), data) {
+		t.Fatal("healthy chunk was changed")
+	}
+}
+
+func TestScrubListsUnhealableReplicasAsLost(t *testing.T) {
+	sc, chunks := newScrubTest(t)
+	data := []byte("original shard")
+	key := addReplica(t, sc, "file-1", data, []byte("bit-rotted shard"))
+	missing := addReplica(t, sc, "file-2", []byte("missing shard"), nil)
+
+	status := runScrub(t, sc)
+	if status.ChunksCorrupt != 1 || status.ChunksMissing != 1 || len(status.Unrecoverable) != 2 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if stored(t, chunks, key) != nil {
+		t.Fatal("corrupt chunk is still served")
+	}
+	quarantined, _ := os.ReadDir(sc.quarantineDir)
+	if len(quarantined) != 1 {
+		t.Fatalf("%d chunks quarantined, want 1", len(quarantined))
+	}
+
+	lost := sc.Lost()
+	if len(lost) != 2 || lost[0].Checksum != key.String() || lost[1].Checksum != missing.String() {
+		t.Fatalf("lost replicas %+v, want the corrupt and the missing one", lost)
+	}
+	if !sc.Resolve("file-1", 0) || sc.Resolve("file-1", 0) {
+		t.Fatal("Resolve did not remove the lost replica exactly once")
+	}
+	if lost := sc.Lost(); len(lost) != 1 || lost[0].FileID != "file-2" {
+		t.Fatalf("lost replicas %+v after resolving file-1", lost)
+	}
+}
+
+func TestScrubHealsFromAnotherNode(t *testing.T) {
+	sc, chunks := newScrubTest(t)
+	data := []byte("replicated chunk")
+	key := addReplica(t, sc, "file-1", data, []byte("replicated chunK"))
+	sc.setLost([]*dynamodb.ChunkMetadata{{FileID: "file-1", NodeID: "node-a", Checksum: key.String()}}, true)
+
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/get-chunk" || r.URL.Query().Get("checksum") != key.String() {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer peer.Close()
+	host, port, err := net.SplitHostPort(peer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNum, _ := strconv.Atoi(port)
+	ctx := context.Background()
+	s := sc.server
+	if err := s.store.RegisterNode(ctx, s.cfg.NodeRegistryTable, &dynamodb.NodeInfo{NodeID: "node-b", PrivateIP: host, Port: portNum}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store.PutChunkMetadata(ctx, s.cfg.ChunkMetadataTable, &dynamodb.ChunkMetadata{FileID: "file-1", NodeID: "node-b", Checksum: key.String()}); err != nil {
+		t.Fatal(err)
+	}
+
+	status := runScrub(t, sc)
+	if status.ChunksCorrupt != 1 || status.ChunksHealed != 1 || len(status.Unrecoverable) != 0 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if !bytes.Equal(stored(t, chunks, key), data) {
+		t.Fatal("chunk was not replaced with the healthy copy")
+	}
+	if lost := sc.Lost(); len(lost) != 0 {
+		t.Fatalf("healed chunk is still listed as lost: %+v", lost)
+	}
+}
+
+func TestScrubTreatsStoreCorruptionAsCorrupt(t *testing.T) {
+	sc, chunks := newScrubTest(t)
+	data := []byte("segment record")
+	key := addReplica(t, sc, "file-1", data, data)
+	chunks.errs[key] = chunkstore.ErrCorrupt
+
+	status := runScrub(t, sc)
+	if status.ChunksCorrupt != 1 || len(sc.Lost()) != 1 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if _, err := chunks.Stat(context.Background(), key); !errors.Is(err, chunkstore.ErrNotFound) {
+		t.Fatalf("corrupt chunk was not removed: %v", err)
+	}
+}
+
+func TestScrubLeavesUnreadableChunksToDiskCheck(t *testing.T) {
+	sc, chunks := newScrubTest(t)
+	data := []byte("chunk on a failing disk")
+	key := addReplica(t, sc, "file-1", data, data)
+	chunks.errs[key] = errors.New("input/output error")
+
+	status := runScrub(t, sc)
+	if status.ChunksCorrupt != 0 || len(status.Unrecoverable) != 0 || len(sc.Lost()) != 0 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if _, err := chunks.Stat(context.Background(), key); err != nil {
+		t.Fatalf("unreadable chunk was removed: %v", err)
+	}
+}
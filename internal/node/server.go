@@ -2,39 +2,114 @@ package node
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"path/filepath"
 	"time"
 
+	"github.com/timskillet/distributed-filestore/internal/chunkstore"
 	"github.com/timskillet/distributed-filestore/internal/config"
 	"github.com/timskillet/distributed-filestore/internal/dynamodb"
+	"github.com/timskillet/distributed-filestore/internal/metadata"
 )
 
 type Server struct {
-	dbClient *dynamodb.Client
-	cfg      *config.Config
-	nodeID   string
-	nodeInfo *dynamodb.NodeInfo
-	stopChan chan struct{}
+	store     metadata.MetadataStore
+	cfg       *config.Config
+	nodeID    string
+	nodeInfo  *dynamodb.NodeInfo
+	chunks    chunkstore.ChunkStore
+	disks     *chunkstore.DiskStore // nil unless chunks are kept on local disks
+	refLocks  refLocks
+	replQueue *ReplicationQueue
+	scrubber  *Scrubber
+	stopChan  chan struct{}
 }
 
 func NewServer(cfg *config.Config, nodeID string, nodeInfo *dynamodb.NodeInfo) (*Server, error) {
 	ctx := context.Background()
-	dbClient, err := dynamodb.NewClient(ctx, cfg.AWSRegion)
+	store, err := metadata.NewStore(ctx, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create DynamoDB client: %w", err)
+		return nil, fmt.Errorf("failed to create metadata store: %w", err)
 	}
 
-	return &Server{
-		dbClient: dbClient,
-		cfg:      cfg,
-		nodeID:   nodeID,
-		nodeInfo: nodeInfo,
-		stopChan: make(chan struct{}),
-	}, nil
+	dataDir := cfg.NodeDataDir
+	if dataDir == "" {
+		dataDir = filepath.Join("./", nodeID)
+	}
+
+	chunks, err := newChunkStore(cfg, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	disks, _ := chunks.(*chunkstore.DiskStore)
+
+	queueDir := filepath.Join(dataDir, "replication-queue")
+	replQueue, err := NewReplicationQueue(queueDir, time.Duration(cfg.ReplicationTimeout)*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open replication queue: %w", err)
+	}
+
+	s := &Server{
+		store:     store,
+		cfg:       cfg,
+		nodeID:    nodeID,
+		nodeInfo:  nodeInfo,
+		chunks:    chunks,
+		disks:     disks,
+		replQueue: replQueue,
+		stopChan:  make(chan struct{}),
+	}
+	s.scrubber = NewScrubber(s, filepath.Join(dataDir, "quarantine"))
+	return s, nil
+}
+
+// newChunkStore opens the chunk store selected by cfg.ChunkStore, keeping chunks under
+// dataDir unless CHUNK_DIRS names other directories
+func newChunkStore(cfg *config.Config, dataDir string) (chunkstore.ChunkStore, error) {
+	switch cfg.ChunkStore {
+	case "memory":
+		return chunkstore.NewMemoryStore(), nil
+	case "filesystem", "segment":
+		dirs := cfg.ChunkDirs
+		if len(dirs) == 0 {
+			dirs = []string{filepath.Join(dataDir, "chunks")}
+		}
+		open := chunkstore.OpenFileStore
+		if cfg.ChunkStore == "segment" {
+			opts := chunkstore.SegmentOptions{
+				SegmentSize:    int64(cfg.SegmentSizeMB) << 20,
+				GarbagePercent: cfg.SegmentGarbagePercent,
+			}
+			open = func(dir string) (chunkstore.ChunkStore, error) {
+				return chunkstore.NewSegmentStore(dir, opts)
+			}
+		}
+		store, err := chunkstore.NewDiskStore(dirs, open)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open chunk directories: %w", err)
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown chunk store %q", cfg.ChunkStore)
+	}
 }
 
 func (s *Server) Register(ctx context.Context) error {
-	return s.dbClient.RegisterNode(ctx, s.cfg.NodeRegistryTable, s.nodeInfo)
+	space, disks := s.capacity(ctx)
+	s.nodeInfo.AvailableSpace = space
+	s.nodeInfo.Disks = disks
+
+	// A restart must not bring a draining or decommissioned node back into placement
+	if existing, err := s.store.GetNode(ctx, s.cfg.NodeRegistryTable, s.nodeID); err == nil {
+		switch existing.Status {
+		case dynamodb.NodeStatusDraining, dynamodb.NodeStatusDecommissioned:
+			s.nodeInfo.Status = existing.Status
+		}
+	} else if !errors.Is(err, dynamodb.ErrNotFound) {
+		return fmt.Errorf("failed to look up node registration: %w", err)
+	}
+	return s.store.RegisterNode(ctx, s.cfg.NodeRegistryTable, s.nodeInfo)
 }
 
 func (s *Server) StartHeartbeat(ctx context.Context) {
@@ -42,14 +117,16 @@ func (s *Server) StartHeartbeat(ctx context.Context) {
 	defer ticker.Stop()
 
 	// Send initial heartbeat
-	if err := s.dbClient.UpdateHeartbeat(ctx, s.cfg.NodeRegistryTable, s.nodeID); err != nil {
+	space, disks := s.capacity(ctx)
+	if err := s.store.UpdateHeartbeat(ctx, s.cfg.NodeRegistryTable, s.nodeID, space, disks); err != nil {
 		fmt.Printf("Warning: Failed to send initial heartbeat: %v\n", err)
 	}
 
 	for {
 		select {
 		case <-ticker.C:
-			if err := s.dbClient.UpdateHeartbeat(ctx, s.cfg.NodeRegistryTable, s.nodeID); err != nil {
+			space, disks := s.capacity(ctx)
+			if err := s.store.UpdateHeartbeat(ctx, s.cfg.NodeRegistryTable, s.nodeID, space, disks); err != nil {
 				fmt.Printf("Warning: Failed to update heartbeat: %v\n", err)
 			}
 		case <-s.stopChan:
@@ -58,12 +135,54 @@ func (s *Server) StartHeartbeat(ctx context.Context) {
 	}
 }
 
+// capacity health-checks the node's disks and reports their free space, summed over
+// healthy disks, with a per-disk breakdown. Free space is -1 when it cannot be
+// determined, such as for in-memory chunks, so the registry keeps its previous value.
+func (s *Server) capacity(ctx context.Context) (int64, []dynamodb.DiskInfo) {
+	if s.disks == nil {
+		return -1, nil
+	}
+
+	var space int64 = -1
+	healthy := false
+	var disks []dynamodb.DiskInfo
+	for _, status := range s.disks.Check(ctx) {
+		disks = append(disks, dynamodb.DiskInfo{
+			Dir:            status.Dir,
+			Healthy:        status.Healthy,
+			AvailableSpace: max(status.AvailableSpace, 0),
+			TotalSpace:     status.TotalSpace,
+			LastError:      status.LastError,
+		})
+		if status.Healthy {
+			healthy = true
+			if status.AvailableSpace >= 0 {
+				space = max(space, 0) + status.AvailableSpace
+			}
+		}
+	}
+	if !healthy {
+		space = 0 // Nothing is writable; the per-disk report keeps placement away
+	}
+	return space, disks
+}
+
+// StartReplicationWorker drains the async replication queue until the server is stopped
+func (s *Server) StartReplicationWorker(ctx context.Context) {
+	s.replQueue.Run(ctx, s.stopChan)
+}
+
+// StartScrubber re-checks stored chunks every ScrubInterval seconds until the server is stopped
+func (s *Server) StartScrubber(ctx context.Context) {
+	s.scrubber.Run(ctx, s.stopChan)
+}
+
 func (s *Server) Stop() {
 	close(s.stopChan)
 }
 
-func (s *Server) GetDBClient() *dynamodb.Client {
-	return s.dbClient
+func (s *Server) GetStore() metadata.MetadataStore {
+	return s.store
 }
 
 func (s *Server) GetConfig() *config.Config {
@@ -73,3 +192,11 @@ func (s *Server) GetConfig() *config.Config {
 func (s *Server) GetNodeID() string {
 	return s.nodeID
 }
+
+func (s *Server) GetChunkStore() chunkstore.ChunkStore {
+	return s.chunks
+}
+
+func (s *Server) GetReplicationQueue() *ReplicationQueue {
+	return s.replQueue
+}
@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd)
+
+package node
+
+// syncDir is a no-op where directories cannot be opened for syncing
+func syncDir(dir string) error {
+	return nil
+}
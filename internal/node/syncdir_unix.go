@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd
+
+package node
+
+import "os"
+
+// syncDir flushes a directory's entries, making renames and removals in it durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -56,6 +56,8 @@ git clone https://github.com/timskillet/distributed-filestore.git . || {
 export AWS_REGION=${AWS_REGION:-us-east-1}
 export CHUNK_METADATA_TABLE=${CHUNK_METADATA_TABLE:-dfs-chunk-metadata}
 export NODE_REGISTRY_TABLE=${NODE_REGISTRY_TABLE:-dfs-node-registry}
+export FILE_METADATA_TABLE=${FILE_METADATA_TABLE:-dfs-file-metadata}
+export CHUNK_REFS_TABLE=${CHUNK_REFS_TABLE:-dfs-chunk-refs}
 export REPLICATION_FACTOR=${REPLICATION_FACTOR:-2}
 
 echo "Building API server..."
@@ -91,6 +93,8 @@ Environment="GOPATH=/home/ubuntu/go"
 Environment="AWS_REGION=$AWS_REGION"
 Environment="CHUNK_METADATA_TABLE=$CHUNK_METADATA_TABLE"
 Environment="NODE_REGISTRY_TABLE=$NODE_REGISTRY_TABLE"
+Environment="FILE_METADATA_TABLE=$FILE_METADATA_TABLE"
+Environment="CHUNK_REFS_TABLE=$CHUNK_REFS_TABLE"
 Environment="REPLICATION_FACTOR=$REPLICATION_FACTOR"
 ExecStart=$APP_DIR/dfs-api
 Restart=always
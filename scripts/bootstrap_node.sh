@@ -63,6 +63,7 @@ PRIVATE_IP=$(curl -s http://169.254.169.254/latest/meta-data/local-ipv4)
 export AWS_REGION=$${AWS_REGION:-us-east-1}
 export CHUNK_METADATA_TABLE=$${CHUNK_METADATA_TABLE:-dfs-chunk-metadata}
 export NODE_REGISTRY_TABLE=$${NODE_REGISTRY_TABLE:-dfs-node-registry}
+export CHUNK_REFS_TABLE=$${CHUNK_REFS_TABLE:-dfs-chunk-refs}
 export NODE_ID=$NODE_ID
 export NODE_PORT=$${NODE_PORT:-8080}
 export REPLICATION_FACTOR=$${REPLICATION_FACTOR:-2}
@@ -107,8 +108,10 @@ Environment="GOPATH=/home/ec2-user/go"
 Environment="AWS_REGION=$AWS_REGION"
 Environment="CHUNK_METADATA_TABLE=$CHUNK_METADATA_TABLE"
 Environment="NODE_REGISTRY_TABLE=$NODE_REGISTRY_TABLE"
+Environment="CHUNK_REFS_TABLE=$CHUNK_REFS_TABLE"
 Environment="NODE_ID=$NODE_ID"
 Environment="NODE_PORT=$NODE_PORT"
+Environment="CHUNK_DIRS=/opt/dfs/chunks"
 Environment="REPLICATION_FACTOR=$REPLICATION_FACTOR"
 Environment="NODE_HEARTBEAT_INTERVAL=$NODE_HEARTBEAT_INTERVAL"
 Environment="NODE_HEARTBEAT_TIMEOUT=$NODE_HEARTBEAT_TIMEOUT"